@@ -222,6 +222,20 @@ func (intent *IntentAPI) SendMessageEvent(ctx context.Context, roomID id.RoomID,
 	return intent.Client.SendMessageEvent(ctx, roomID, eventType, contentJSON)
 }
 
+func (intent *IntentAPI) SendMessageStrict(ctx context.Context, roomID id.RoomID, content *event.MessageEventContent) (*mautrix.RespSendEvent, error) {
+	if err := content.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid message content: %w", err)
+	}
+	return intent.SendMessageEvent(ctx, roomID, event.EventMessage, content)
+}
+
+func (intent *IntentAPI) SendEphemeralMessage(ctx context.Context, roomID id.RoomID, userID id.UserID, content *event.MessageEventContent, deviceIDs ...id.DeviceID) error {
+	if err := intent.EnsureJoined(ctx, roomID); err != nil {
+		return err
+	}
+	return intent.Client.SendEphemeralMessage(ctx, roomID, userID, content, deviceIDs...)
+}
+
 func (intent *IntentAPI) SendMessageEventByUserId(ctx context.Context, userID id.UserID, eventType event.Type, contentJSON interface{}) (*mautrix.RespSendEvent, error) {
 	contentJSON = intent.AddDoublePuppetValue(contentJSON)
 	return intent.Client.SendMessageEventByUserId(ctx, userID, eventType, contentJSON)
@@ -508,6 +522,50 @@ func (intent *IntentAPI) Whoami(ctx context.Context) (*mautrix.RespWhoami, error
 	return intent.Client.Whoami(ctx)
 }
 
+var (
+	ErrNotKnocking            = errors.New("user is not knocking on the room")
+	ErrInsufficientPowerLevel = errors.New("insufficient power level")
+)
+
+func (intent *IntentAPI) checkKnock(ctx context.Context, roomID id.RoomID, userID id.UserID, requiredLevel func(*event.PowerLevelsEventContent) int) error {
+	if member := intent.Member(ctx, roomID, userID); member == nil || member.Membership != event.MembershipKnock {
+		return fmt.Errorf("%w: %s", ErrNotKnocking, userID)
+	}
+	pl, err := intent.PowerLevels(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("failed to get power levels: %w", err)
+	} else if ownLevel, required := pl.GetUserLevel(intent.UserID), requiredLevel(pl); ownLevel < required {
+		return fmt.Errorf("%w: have %d, need %d", ErrInsufficientPowerLevel, ownLevel, required)
+	}
+	return nil
+}
+
+// AcceptKnock accepts the knock of the given user by inviting them to the room.
+// It returns ErrNotKnocking if the user isn't knocking on the room, and
+// ErrInsufficientPowerLevel if the intent doesn't have the power level to invite users.
+func (intent *IntentAPI) AcceptKnock(ctx context.Context, roomID id.RoomID, userID id.UserID, reason string) error {
+	if err := intent.EnsureJoined(ctx, roomID); err != nil {
+		return err
+	} else if err = intent.checkKnock(ctx, roomID, userID, (*event.PowerLevelsEventContent).Invite); err != nil {
+		return err
+	}
+	_, err := intent.InviteUser(ctx, roomID, &mautrix.ReqInviteUser{UserID: userID, Reason: reason})
+	return err
+}
+
+// DenyKnock denies the knock of the given user by kicking them from the room.
+// It returns ErrNotKnocking if the user isn't knocking on the room, and
+// ErrInsufficientPowerLevel if the intent doesn't have the power level to kick users.
+func (intent *IntentAPI) DenyKnock(ctx context.Context, roomID id.RoomID, userID id.UserID, reason string) error {
+	if err := intent.EnsureJoined(ctx, roomID); err != nil {
+		return err
+	} else if err = intent.checkKnock(ctx, roomID, userID, (*event.PowerLevelsEventContent).Kick); err != nil {
+		return err
+	}
+	_, err := intent.KickUser(ctx, roomID, &mautrix.ReqKickUser{UserID: userID, Reason: reason})
+	return err
+}
+
 func (intent *IntentAPI) EnsureInvited(ctx context.Context, roomID id.RoomID, userID id.UserID) error {
 	if !intent.as.StateStore.IsInvited(ctx, roomID, userID) {
 		_, err := intent.InviteUser(ctx, roomID, &mautrix.ReqInviteUser{
@@ -0,0 +1,357 @@
+package mautrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/De-IM/mautrix/event"
+	"github.com/De-IM/mautrix/id"
+)
+
+const (
+	DefaultBackfillMaxEvents = 1000
+	DefaultBackfillPageSize  = 100
+)
+
+var ErrSyncerNotDispatchable = errors.New("syncer must be a *DefaultSyncer or implement DispatchableSyncer to dispatch backfilled events")
+
+// TimelineGap is a part of a room timeline that was skipped by a limited sync.
+type TimelineGap struct {
+	RoomID id.RoomID `json:"room_id"`
+	// From is the prev_batch token of the limited timeline, i.e. the end of the gap.
+	From string `json:"from"`
+	// LastSeen is the ID of the last event that was dispatched before the gap, i.e. the start of the gap.
+	// It's moved forward as the events in the gap are dispatched.
+	LastSeen id.EventID `json:"last_seen"`
+	// Latest is the ID of the newest event that was dispatched in the room after the gap. It becomes
+	// the last seen event of the room once all gaps in the room are filled.
+	Latest id.EventID `json:"latest"`
+}
+
+// BackfillStore persists the progress of GapBackfiller. The sqlbackfillstore package contains a SQL implementation.
+type BackfillStore interface {
+	// GetLastSeenEvent returns the ID of the last timeline event in the room that was dispatched
+	// with no unfilled gaps before it.
+	GetLastSeenEvent(ctx context.Context, roomID id.RoomID) (id.EventID, error)
+	SetLastSeenEvent(ctx context.Context, roomID id.RoomID, eventID id.EventID) error
+
+	// PutGap stores a gap that is being filled, so that it can be resumed if the program is stopped.
+	// Gaps are identified by the room ID and From token, so a room can have multiple gaps.
+	PutGap(ctx context.Context, gap *TimelineGap) error
+	DeleteGap(ctx context.Context, gap *TimelineGap) error
+	// GetGaps returns all stored gaps. The gaps of each room must be in the order they were first stored.
+	GetGaps(ctx context.Context) ([]*TimelineGap, error)
+}
+
+// MemoryBackfillStore is a simple in-memory BackfillStore.
+type MemoryBackfillStore struct {
+	LastSeen map[id.RoomID]id.EventID
+	Gaps     []*TimelineGap
+	lock     sync.RWMutex
+}
+
+var _ BackfillStore = (*MemoryBackfillStore)(nil)
+
+func NewMemoryBackfillStore() *MemoryBackfillStore {
+	return &MemoryBackfillStore{
+		LastSeen: make(map[id.RoomID]id.EventID),
+	}
+}
+
+func (store *MemoryBackfillStore) GetLastSeenEvent(_ context.Context, roomID id.RoomID) (id.EventID, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return store.LastSeen[roomID], nil
+}
+
+func (store *MemoryBackfillStore) SetLastSeenEvent(_ context.Context, roomID id.RoomID, eventID id.EventID) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.LastSeen[roomID] = eventID
+	return nil
+}
+
+func (store *MemoryBackfillStore) findGap(gap *TimelineGap) int {
+	return slices.IndexFunc(store.Gaps, func(existing *TimelineGap) bool {
+		return existing.RoomID == gap.RoomID && existing.From == gap.From
+	})
+}
+
+func (store *MemoryBackfillStore) PutGap(_ context.Context, gap *TimelineGap) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	gapCopy := *gap
+	if idx := store.findGap(gap); idx >= 0 {
+		store.Gaps[idx] = &gapCopy
+	} else {
+		store.Gaps = append(store.Gaps, &gapCopy)
+	}
+	return nil
+}
+
+func (store *MemoryBackfillStore) DeleteGap(_ context.Context, gap *TimelineGap) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if idx := store.findGap(gap); idx >= 0 {
+		store.Gaps = slices.Delete(store.Gaps, idx, idx+1)
+	}
+	return nil
+}
+
+func (store *MemoryBackfillStore) GetGaps(_ context.Context) ([]*TimelineGap, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	gaps := make([]*TimelineGap, len(store.Gaps))
+	for i, gap := range store.Gaps {
+		gapCopy := *gap
+		gaps[i] = &gapCopy
+	}
+	return gaps, nil
+}
+
+// GapBackfiller is a sync handler that fills gaps in room timelines. When a joined room has a limited timeline
+// in a sync response, it paginates backwards from prev_batch until it finds the last event it saw in the room
+// and dispatches the missed events in chronological order before the events in the sync response.
+//
+// Backfilled events are dispatched with event.SourceBackfill in their event source. Gaps in rooms that
+// haven't had any events dispatched yet (e.g. on the initial sync) are not filled.
+//
+// To use it, register it with your Syncer after the crypto helper (if any), so that the keys from
+// to-device events are available when backfilled events are decrypted:
+//
+//	backfiller, err := mautrix.NewGapBackfiller(client, mautrix.NewMemoryBackfillStore())
+//	err = backfiller.ResumeGaps(ctx)
+//	client.Syncer.(mautrix.ExtensibleSyncer).OnSync(backfiller.SyncHandler)
+type GapBackfiller struct {
+	Client *Client
+	Store  BackfillStore
+	// MaxEvents is the maximum number of events to backfill for a single gap. If the gap is larger,
+	// only the most recent events are dispatched. Defaults to DefaultBackfillMaxEvents.
+	MaxEvents int
+	// PageSize is the number of events to request per /messages call. Defaults to DefaultBackfillPageSize.
+	PageSize int
+	// ParseErrorHandler is called when parsing the content of a backfilled event fails if the syncer
+	// isn't a *DefaultSyncer (which uses its own ParseErrorHandler). If it returns false, the event
+	// is not dispatched. Defaults to the same behavior as NewDefaultSyncer.
+	ParseErrorHandler func(evt *event.Event, err error) bool
+}
+
+// NewGapBackfiller creates a new gap backfiller for the given client. The syncer of the client must be
+// a *DefaultSyncer or implement DispatchableSyncer, otherwise ErrSyncerNotDispatchable is returned.
+func NewGapBackfiller(cli *Client, store BackfillStore) (*GapBackfiller, error) {
+	if !canDispatch(cli.Syncer) {
+		return nil, ErrSyncerNotDispatchable
+	}
+	return &GapBackfiller{
+		Client:    cli,
+		Store:     store,
+		MaxEvents: DefaultBackfillMaxEvents,
+		PageSize:  DefaultBackfillPageSize,
+	}, nil
+}
+
+func canDispatch(syncer Syncer) bool {
+	switch syncer.(type) {
+	case *DefaultSyncer, DispatchableSyncer:
+		return true
+	default:
+		return false
+	}
+}
+
+var _ SyncHandler = (*GapBackfiller)(nil).SyncHandler
+
+// SyncHandler fills the gaps in limited timelines of the sync response and records the last seen event of each room.
+//
+// The last seen event of a room isn't moved forward while the room has unfilled gaps. If filling a gap fails,
+// it's retried on the next sync response, and newer gaps in the same room are only filled after it.
+func (gb *GapBackfiller) SyncHandler(ctx context.Context, resp *RespSync, since string) bool {
+	log := gb.Client.cliOrContextLog(ctx)
+	pendingGaps, err := gb.getGapsByRoom(ctx)
+	if err != nil {
+		log.Err(err).Msg("Failed to get pending timeline gaps")
+		return true
+	}
+	for roomID, room := range resp.Rooms.Join {
+		log := log.With().Stringer("room_id", roomID).Logger()
+		gaps := pendingGaps[roomID]
+		var latest id.EventID
+		if len(room.Timeline.Events) > 0 {
+			latest = room.Timeline.Events[len(room.Timeline.Events)-1].ID
+		}
+		// The newest event that was dispatched before this sync response
+		var lastSeen id.EventID
+		if len(gaps) > 0 {
+			lastSeen = gaps[len(gaps)-1].Latest
+		} else if lastSeen, err = gb.Store.GetLastSeenEvent(ctx, roomID); err != nil {
+			log.Err(err).Msg("Failed to get last seen event")
+			continue
+		}
+		if room.Timeline.Limited && room.Timeline.PrevBatch != "" && lastSeen != "" && !containsEvent(room.Timeline.Events, lastSeen) {
+			gap := &TimelineGap{RoomID: roomID, From: room.Timeline.PrevBatch, LastSeen: lastSeen, Latest: latest}
+			if err = gb.Store.PutGap(ctx, gap); err != nil {
+				log.Err(err).Msg("Failed to save timeline gap")
+			}
+			gaps = append(gaps, gap)
+		} else if len(gaps) > 0 && latest != "" {
+			newestGap := gaps[len(gaps)-1]
+			newestGap.Latest = latest
+			if err = gb.Store.PutGap(ctx, newestGap); err != nil {
+				log.Err(err).Msg("Failed to save timeline gap")
+			}
+		}
+		if len(gaps) > 0 {
+			if err = gb.fillGaps(ctx, gaps); err != nil {
+				log.Err(err).Msg("Failed to backfill timeline gap")
+			}
+		} else if latest != "" {
+			if err = gb.Store.SetLastSeenEvent(ctx, roomID, latest); err != nil {
+				log.Err(err).Msg("Failed to save last seen event")
+			}
+		}
+	}
+	return true
+}
+
+func containsEvent(evts []*event.Event, eventID id.EventID) bool {
+	return slices.ContainsFunc(evts, func(evt *event.Event) bool {
+		return evt.ID == eventID
+	})
+}
+
+func (gb *GapBackfiller) getGapsByRoom(ctx context.Context) (map[id.RoomID][]*TimelineGap, error) {
+	gaps, err := gb.Store.GetGaps(ctx)
+	if err != nil {
+		return nil, err
+	}
+	gapsByRoom := make(map[id.RoomID][]*TimelineGap)
+	for _, gap := range gaps {
+		gapsByRoom[gap.RoomID] = append(gapsByRoom[gap.RoomID], gap)
+	}
+	return gapsByRoom, nil
+}
+
+// fillGaps fills the given gaps of a single room from oldest to newest. The last seen event of the room
+// is moved to the end of each gap after it's filled. Filling stops at the first gap that fails.
+func (gb *GapBackfiller) fillGaps(ctx context.Context, gaps []*TimelineGap) error {
+	for _, gap := range gaps {
+		if err := gb.FillGap(ctx, gap); err != nil {
+			return err
+		}
+		if gap.Latest != "" {
+			if err := gb.Store.SetLastSeenEvent(ctx, gap.RoomID, gap.Latest); err != nil {
+				return fmt.Errorf("failed to save last seen event: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// ResumeGaps fills the gaps that were being filled when the program was stopped.
+// It should be called before starting to sync.
+func (gb *GapBackfiller) ResumeGaps(ctx context.Context) error {
+	gapsByRoom, err := gb.getGapsByRoom(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get timeline gaps: %w", err)
+	}
+	for roomID, gaps := range gapsByRoom {
+		gb.Client.cliOrContextLog(ctx).Debug().
+			Stringer("room_id", roomID).
+			Int("gap_count", len(gaps)).
+			Msg("Resuming timeline gap backfill")
+		if err = gb.fillGaps(ctx, gaps); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FillGap paginates backwards from the end of the gap until the last seen event of the gap and dispatches
+// the missed events. The gap is deleted from the store once it's filled. Older gaps in the same room must
+// be filled first. The last seen event of the room isn't changed.
+func (gb *GapBackfiller) FillGap(ctx context.Context, gap *TimelineGap) error {
+	if !canDispatch(gb.Client.Syncer) {
+		return ErrSyncerNotDispatchable
+	}
+	log := gb.Client.cliOrContextLog(ctx).With().Stringer("room_id", gap.RoomID).Logger()
+	if gap.LastSeen == "" {
+		log.Debug().Msg("Gap doesn't have a last seen event, not backfilling it")
+		return gb.Store.DeleteGap(ctx, gap)
+	}
+	maxEvents := gb.MaxEvents
+	if maxEvents <= 0 {
+		maxEvents = DefaultBackfillMaxEvents
+	}
+	pageSize := gb.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultBackfillPageSize
+	}
+	var missed []*event.Event
+	reachedLastSeen := false
+	from := gap.From
+	for !reachedLastSeen && len(missed) < maxEvents {
+		resp, err := gb.Client.Messages(ctx, gap.RoomID, from, "", DirectionBackward, nil, min(pageSize, maxEvents-len(missed)))
+		if err != nil {
+			return fmt.Errorf("failed to fetch messages: %w", err)
+		}
+		for _, evt := range resp.Chunk {
+			if evt.ID == gap.LastSeen {
+				reachedLastSeen = true
+				break
+			}
+			missed = append(missed, evt)
+		}
+		if len(resp.Chunk) == 0 || resp.End == "" {
+			break
+		}
+		from = resp.End
+	}
+	if !reachedLastSeen {
+		log.Warn().
+			Stringer("last_seen_event_id", gap.LastSeen).
+			Int("backfilled_count", len(missed)).
+			Msg("Didn't find last seen event while backfilling gap, some events were not backfilled")
+	} else {
+		log.Debug().Int("backfilled_count", len(missed)).Msg("Backfilling timeline gap")
+	}
+	slices.Reverse(missed)
+	for _, evt := range missed {
+		gb.dispatch(ctx, gap.RoomID, evt)
+		// Record the progress so that resuming the gap doesn't dispatch the same events again
+		gap.LastSeen = evt.ID
+		if err := gb.Store.PutGap(ctx, gap); err != nil {
+			return fmt.Errorf("failed to save gap progress: %w", err)
+		}
+	}
+	return gb.Store.DeleteGap(ctx, gap)
+}
+
+func (gb *GapBackfiller) dispatch(ctx context.Context, roomID id.RoomID, evt *event.Event) {
+	source := event.SourceJoin | event.SourceTimeline | event.SourceBackfill
+	switch syncer := gb.Client.Syncer.(type) {
+	case *DefaultSyncer:
+		syncer.processSyncEvent(ctx, roomID, evt, source)
+	case DispatchableSyncer:
+		evt.RoomID = roomID
+		if evt.StateKey != nil {
+			evt.Type.Class = event.StateEventType
+		} else {
+			evt.Type.Class = event.MessageEventType
+		}
+		err := evt.Content.ParseRaw(evt.Type)
+		if err != nil {
+			parseErrorHandler := gb.ParseErrorHandler
+			if parseErrorHandler == nil {
+				parseErrorHandler = defaultParseErrorHandler
+			}
+			if !parseErrorHandler(evt, err) {
+				return
+			}
+		}
+		evt.Mautrix.EventSource = source
+		syncer.Dispatch(ctx, evt)
+	}
+}
@@ -0,0 +1,53 @@
+package botcmd
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrUnknownCommand     = errors.New("unknown command")
+	ErrUnknownOption      = errors.New("unknown option")
+	ErrMissingOption      = errors.New("missing required option")
+	ErrInvalidOptionValue = errors.New("invalid option value")
+	ErrDuplicateOption    = errors.New("option specified multiple times")
+	ErrWrongCommandType   = errors.New("wrong command type")
+	ErrMissingTarget      = errors.New("missing command target")
+)
+
+// UsageError is returned when a received command doesn't match the definition
+// it was registered with. It wraps one of the Err* values in this package, so
+// errors.Is can be used to check what went wrong.
+type UsageError struct {
+	// Command is the name of the command that was invoked.
+	Command string
+	// Option is the name of the offending option, if the error is about a
+	// specific option.
+	Option string
+	// Usage is a human-readable usage string for the command, or empty if the
+	// command is not known.
+	Usage string
+
+	Err error
+	// Reason is an optional extra explanation, e.g. the parse error of an
+	// integer option.
+	Reason string
+}
+
+func (ue *UsageError) Error() string {
+	msg := ue.Err.Error()
+	if ue.Option != "" {
+		msg = fmt.Sprintf("%s %q", msg, ue.Option)
+	}
+	if ue.Reason != "" {
+		msg = fmt.Sprintf("%s: %s", msg, ue.Reason)
+	}
+	if ue.Command != "" {
+		msg = fmt.Sprintf("/%s: %s", ue.Command, msg)
+	}
+	return msg
+}
+
+func (ue *UsageError) Unwrap() error {
+	return ue.Err
+}
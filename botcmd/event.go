@@ -0,0 +1,114 @@
+package botcmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+
+	"github.com/De-IM/mautrix/event"
+	"github.com/De-IM/mautrix/id"
+)
+
+// Event contains the data of a single command invocation that is passed to
+// command handlers.
+type Event struct {
+	Processor *Processor
+	// Event is the raw m.room.message event that contained the command.
+	Event   *event.Event
+	Content *event.MessageEventContent
+	// Command is the definition the command was registered with.
+	Command *event.BotCommand
+	// Received is the command object received in the message.
+	Received *event.BotCommand
+
+	RoomID  id.RoomID
+	Sender  id.UserID
+	EventID id.EventID
+	// ReplyTo is the ID of the event the command message replied to, if any.
+	// For message commands, this is the message the command was invoked on.
+	ReplyTo id.EventID
+	// TargetUser is the user that a user command was invoked on.
+	TargetUser id.UserID
+
+	// Args contains the parsed option values. Strings are stored as string,
+	// integers as int64 and booleans as bool.
+	Args map[string]any
+
+	Log zerolog.Logger
+
+	replyToEvent *event.Event
+}
+
+// Has returns whether the option with the given name was provided.
+func (evt *Event) Has(name string) bool {
+	_, ok := evt.Args[name]
+	return ok
+}
+
+// String returns the value of a string option, or an empty string if it wasn't provided.
+func (evt *Event) String(name string) string {
+	val, _ := evt.Args[name].(string)
+	return val
+}
+
+// Int returns the value of an integer option, or zero if it wasn't provided.
+func (evt *Event) Int(name string) int64 {
+	val, _ := evt.Args[name].(int64)
+	return val
+}
+
+// Bool returns the value of a boolean option, or false if it wasn't provided.
+func (evt *Event) Bool(name string) bool {
+	val, _ := evt.Args[name].(bool)
+	return val
+}
+
+// GetReplyToEvent fetches the event that the command message replied to.
+// The result is cached, so calling this multiple times is cheap.
+func (evt *Event) GetReplyToEvent(ctx context.Context) (*event.Event, error) {
+	if evt.ReplyTo == "" {
+		return nil, nil
+	} else if evt.replyToEvent != nil {
+		return evt.replyToEvent, nil
+	} else if evt.Processor.Client == nil {
+		return nil, fmt.Errorf("processor doesn't have a client to fetch events with")
+	}
+	replyTo, err := evt.Processor.Client.GetEvent(ctx, evt.RoomID, evt.ReplyTo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get reply target: %w", err)
+	}
+	if replyTo.Type == event.EventEncrypted && evt.Processor.Client.Crypto != nil {
+		_ = replyTo.Content.ParseRaw(replyTo.Type)
+		decrypted, err := evt.Processor.Client.Crypto.Decrypt(ctx, replyTo)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt reply target: %w", err)
+		}
+		replyTo = decrypted
+	}
+	err = replyTo.Content.ParseRaw(replyTo.Type)
+	if err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) && !errors.Is(err, event.ErrUnsupportedContentType) {
+		return nil, fmt.Errorf("failed to parse reply target: %w", err)
+	}
+	evt.replyToEvent = replyTo
+	return replyTo, nil
+}
+
+// Reply sends a notice to the room the command was sent in, as a reply to
+// the command message.
+func (evt *Event) Reply(ctx context.Context, text string) (id.EventID, error) {
+	if evt.Processor.Client == nil {
+		return "", fmt.Errorf("processor doesn't have a client to send messages with")
+	}
+	content := &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    text,
+	}
+	content.SetReply(evt.Event)
+	resp, err := evt.Processor.Client.SendMessageEvent(ctx, evt.RoomID, event.EventMessage, content)
+	if err != nil {
+		return "", err
+	}
+	return resp.EventID, nil
+}
@@ -0,0 +1,377 @@
+package botcmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"github.com/De-IM/mautrix"
+	"github.com/De-IM/mautrix/event"
+	"github.com/De-IM/mautrix/format"
+	"github.com/De-IM/mautrix/id"
+)
+
+var ErrUnhandledInteraction = errors.New("no handler for interaction")
+
+// InteractionHandler is a function that handles a single button click or
+// select menu interaction.
+type InteractionHandler func(ctx context.Context, ia *Interaction) error
+
+type interactionHandlers struct {
+	exact  map[string]InteractionHandler
+	prefix map[string]InteractionHandler
+}
+
+func (ih *interactionHandlers) find(key string) InteractionHandler {
+	if handler, ok := ih.exact[key]; ok {
+		return handler
+	}
+	var longest string
+	var handler InteractionHandler
+	for prefix, prefixHandler := range ih.prefix {
+		if strings.HasPrefix(key, prefix) && len(prefix) >= len(longest) {
+			longest = prefix
+			handler = prefixHandler
+		}
+	}
+	return handler
+}
+
+func (ih *interactionHandlers) set(key string, isPrefix bool, handler InteractionHandler) {
+	if handler == nil {
+		panic("botcmd: handler must not be nil")
+	}
+	if isPrefix {
+		if ih.prefix == nil {
+			ih.prefix = make(map[string]InteractionHandler)
+		}
+		ih.prefix[key] = handler
+	} else {
+		if ih.exact == nil {
+			ih.exact = make(map[string]InteractionHandler)
+		}
+		ih.exact[key] = handler
+	}
+}
+
+// OnButton registers a handler for clicks on buttons with the given callback data.
+func (proc *Processor) OnButton(callbackData string, handler InteractionHandler) {
+	proc.handlersLock.Lock()
+	proc.buttonHandlers.set(callbackData, false, handler)
+	proc.handlersLock.Unlock()
+}
+
+// OnButtonPrefix registers a handler for clicks on buttons whose callback data
+// starts with the given prefix. Exact matches registered with OnButton take
+// precedence, and longer prefixes take precedence over shorter ones.
+func (proc *Processor) OnButtonPrefix(prefix string, handler InteractionHandler) {
+	proc.handlersLock.Lock()
+	proc.buttonHandlers.set(prefix, true, handler)
+	proc.handlersLock.Unlock()
+}
+
+// OnSelectMenu registers a handler for select menus whose custom ID starts
+// with the given prefix. Longer prefixes take precedence over shorter ones.
+func (proc *Processor) OnSelectMenu(customIDPrefix string, handler InteractionHandler) {
+	proc.handlersLock.Lock()
+	proc.selectMenuHandlers.set(customIDPrefix, true, handler)
+	proc.handlersLock.Unlock()
+}
+
+// Interaction contains the data of a single button click or select menu
+// interaction that is passed to interaction handlers.
+type Interaction struct {
+	Processor *Processor
+	// Event is the raw fi.mau.interaction event, which may be either an in-room or
+	// a to-device event.
+	Event   *event.Event
+	Content *event.InteractionEventContent
+
+	Type       event.InteractionType
+	RoomID     id.RoomID
+	Sender     id.UserID
+	FromDevice id.DeviceID
+	// MessageID is the ID of the message that contains the component.
+	MessageID id.EventID
+
+	// CallbackData is the callback data of the clicked button.
+	CallbackData string
+	// CustomID and Values are the custom ID and selected values of the select menu.
+	CustomID string
+	Values   []string
+
+	Log zerolog.Logger
+
+	loadingEventID id.EventID
+}
+
+// ProcessInteraction parses the interaction event and calls the handler
+// registered for the clicked button or select menu.
+//
+// Interactions with messages that weren't sent by this bot are ignored. For
+// to-device interactions, the sender must be a member of the room.
+func (proc *Processor) ProcessInteraction(ctx context.Context, evt *event.Event) error {
+	content := evt.Content.AsInteraction()
+	if proc.Client == nil {
+		return fmt.Errorf("processor doesn't have a client to check interactions with")
+	} else if evt.Sender == proc.Client.UserID {
+		return nil
+	}
+	ia := &Interaction{
+		Processor:    proc,
+		Event:        evt,
+		Content:      content,
+		Type:         content.Type,
+		RoomID:       evt.RoomID,
+		Sender:       evt.Sender,
+		FromDevice:   content.FromDevice,
+		MessageID:    content.RelatesTo.GetReferenceID(),
+		CallbackData: content.CallbackData,
+		CustomID:     content.CustomID,
+		Values:       content.Values,
+	}
+	if ia.RoomID == "" {
+		ia.RoomID = content.RoomID
+		if ia.RoomID == "" {
+			return fmt.Errorf("to-device interaction doesn't have a room ID")
+		} else if proc.Client.StateStore == nil {
+			return fmt.Errorf("client doesn't have a state store to check the sender of to-device interactions with")
+		} else if !proc.Client.StateStore.IsInRoom(ctx, ia.RoomID, ia.Sender) {
+			zerolog.Ctx(ctx).Debug().
+				Stringer("room_id", ia.RoomID).
+				Stringer("sender", ia.Sender).
+				Msg("Ignoring to-device interaction from user who isn't in the room")
+			return nil
+		}
+	}
+	if ia.MessageID == "" {
+		return fmt.Errorf("interaction doesn't reference a message")
+	}
+	messageSender, err := proc.getMessageSender(ctx, ia.RoomID, ia.MessageID)
+	if err != nil {
+		return fmt.Errorf("failed to get interacted message: %w", err)
+	} else if messageSender != proc.Client.UserID {
+		// The message belongs to another bot, which will handle the interaction itself.
+		return nil
+	}
+
+	var handler InteractionHandler
+	var key string
+	proc.handlersLock.RLock()
+	switch content.Type {
+	case event.InteractionTypeButton:
+		key = content.CallbackData
+		handler = proc.buttonHandlers.find(key)
+	case event.InteractionTypeSelectMenu:
+		key = content.CustomID
+		handler = proc.selectMenuHandlers.find(key)
+	}
+	proc.handlersLock.RUnlock()
+	if handler == nil {
+		return fmt.Errorf("%w: %s %q", ErrUnhandledInteraction, content.Type, key)
+	}
+
+	ia.Log = zerolog.Ctx(ctx).With().
+		Str("interaction_type", string(content.Type)).
+		Str("interaction_key", key).
+		Stringer("room_id", ia.RoomID).
+		Stringer("message_id", ia.MessageID).
+		Stringer("sender", ia.Sender).
+		Logger()
+	ctx = ia.Log.WithContext(ctx)
+	return handler(ctx, ia)
+}
+
+// messageSenderCacheSize is the number of message senders that are cached for
+// checking whether interactions are meant for this bot.
+const messageSenderCacheSize = 256
+
+// getMessageSender returns the sender of the given message. Senders of
+// recently interacted messages are cached, as they never change.
+func (proc *Processor) getMessageSender(ctx context.Context, roomID id.RoomID, eventID id.EventID) (id.UserID, error) {
+	if proc.messageSenders != nil {
+		if sender, ok := proc.messageSenders.Get(eventID); ok {
+			return sender, nil
+		}
+	}
+	message, err := proc.Client.GetEvent(ctx, roomID, eventID)
+	if err != nil {
+		return "", err
+	} else if proc.messageSenders != nil {
+		proc.messageSenders.Push(eventID, message.Sender)
+	}
+	return message.Sender, nil
+}
+
+func (ia *Interaction) client() (*mautrix.Client, error) {
+	if ia.Processor.Client == nil {
+		return nil, fmt.Errorf("processor doesn't have a client to respond with")
+	}
+	return ia.Processor.Client, nil
+}
+
+// sendEphemeral sends the given content only to the user who interacted.
+// See [mautrix.Client.SendEphemeralMessage] for details.
+func (ia *Interaction) sendEphemeral(ctx context.Context, content *event.MessageEventContent) error {
+	cli, err := ia.client()
+	if err != nil {
+		return err
+	}
+	var deviceIDs []id.DeviceID
+	if ia.FromDevice != "" {
+		deviceIDs = []id.DeviceID{ia.FromDevice}
+	}
+	return cli.SendEphemeralMessage(ctx, ia.RoomID, ia.Sender, content, deviceIDs...)
+}
+
+// Ack acknowledges the interaction without showing anything to the user.
+// There's no acknowledgement event, so nothing is sent: clients don't wait for
+// a response to interactions, so handlers that have nothing to show can simply
+// return.
+func (ia *Interaction) Ack(ctx context.Context) error {
+	return nil
+}
+
+// ReplyEphemeral sends a message that is only visible to the user who
+// interacted.
+func (ia *Interaction) ReplyEphemeral(ctx context.Context, content *event.MessageEventContent) error {
+	if content.RelatesTo == nil {
+		content.RelatesTo = &event.RelatesTo{Type: event.RelReference, EventID: ia.MessageID}
+	}
+	return ia.sendEphemeral(ctx, content)
+}
+
+// UpdateMessage replaces the message that contains the component with the
+// given content using an edit.
+func (ia *Interaction) UpdateMessage(ctx context.Context, content *event.MessageEventContent) (id.EventID, error) {
+	cli, err := ia.client()
+	if err != nil {
+		return "", err
+	}
+	content.SetEdit(ia.MessageID)
+	resp, err := cli.SendMessageEvent(ctx, ia.RoomID, event.EventMessage, content)
+	if err != nil {
+		return "", err
+	}
+	return resp.EventID, nil
+}
+
+// UpdateComponents replaces the components of the message that contains the
+// component, keeping the rest of the content as-is. The current content is
+// taken from the latest edit of the message, so earlier updates are kept. The
+// text fallback of the components is regenerated with [format.RenderRichFallback].
+func (ia *Interaction) UpdateComponents(ctx context.Context, components [][]event.MessageComponent) (id.EventID, error) {
+	cli, err := ia.client()
+	if err != nil {
+		return "", err
+	}
+	currentContent, err := ia.getCurrentContent(ctx, cli)
+	if err != nil {
+		return "", err
+	}
+	content := *currentContent
+	content.NewContent = nil
+	content.RelatesTo = nil
+	format.StripRichFallback(&content)
+	content.Components = components
+	format.RenderRichFallback(&content)
+	return ia.UpdateMessage(ctx, &content)
+}
+
+// getCurrentContent returns the content of the latest edit of the message
+// that contains the component, or the original content if it hasn't been edited.
+func (ia *Interaction) getCurrentContent(ctx context.Context, cli *mautrix.Client) (*event.MessageEventContent, error) {
+	original, err := cli.GetEvent(ctx, ia.RoomID, ia.MessageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get original message: %w", err)
+	}
+	original, err = parseMessage(ctx, cli, original)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse original message: %w", err)
+	}
+	edits, err := cli.GetRelations(ctx, ia.RoomID, ia.MessageID, &mautrix.ReqGetRelations{
+		RelationType: event.RelReplace,
+		Dir:          mautrix.DirectionBackward,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get edits of original message: %w", err)
+	}
+	// Edits are returned newest first
+	for _, edit := range edits.Chunk {
+		if edit.Sender != original.Sender {
+			continue
+		}
+		edit.RoomID = ia.RoomID
+		edit, err = parseMessage(ctx, cli, edit)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Stringer("edit_event_id", edit.ID).Msg("Failed to parse edit of original message")
+			continue
+		}
+		if newContent := edit.Content.AsMessage().NewContent; newContent != nil {
+			return newContent, nil
+		}
+	}
+	return original.Content.AsMessage(), nil
+}
+
+// parseMessage decrypts the given message event if necessary and parses its content.
+func parseMessage(ctx context.Context, cli *mautrix.Client, evt *event.Event) (*event.Event, error) {
+	if evt.Type == event.EventEncrypted && cli.Crypto != nil {
+		_ = evt.Content.ParseRaw(evt.Type)
+		decrypted, err := cli.Crypto.Decrypt(ctx, evt)
+		if err != nil {
+			return evt, fmt.Errorf("failed to decrypt: %w", err)
+		}
+		evt = decrypted
+	}
+	err := evt.Content.ParseRaw(evt.Type)
+	if err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
+		return evt, err
+	}
+	return evt, nil
+}
+
+// ShowLoading sends a placeholder reply with the loading flag set, which
+// clients can render as the bot "thinking". The placeholder is replaced by
+// the next call to Respond.
+func (ia *Interaction) ShowLoading(ctx context.Context) error {
+	cli, err := ia.client()
+	if err != nil {
+		return err
+	}
+	content := &event.MessageEventContent{
+		MsgType:   event.MsgNotice,
+		Body:      "Loading...",
+		Flags:     event.MessageFlagsLoading,
+		RelatesTo: (&event.RelatesTo{}).SetReplyTo(ia.MessageID),
+	}
+	resp, err := cli.SendMessageEvent(ctx, ia.RoomID, event.EventMessage, content)
+	if err != nil {
+		return err
+	}
+	ia.loadingEventID = resp.EventID
+	return nil
+}
+
+// Respond sends a reply to the message that contains the component. If
+// ShowLoading was called before, the placeholder is edited instead.
+func (ia *Interaction) Respond(ctx context.Context, content *event.MessageEventContent) (id.EventID, error) {
+	cli, err := ia.client()
+	if err != nil {
+		return "", err
+	}
+	content.Flags &^= event.MessageFlagsLoading
+	if ia.loadingEventID != "" {
+		content.SetEdit(ia.loadingEventID)
+	} else if content.RelatesTo == nil {
+		content.RelatesTo = (&event.RelatesTo{}).SetReplyTo(ia.MessageID)
+	}
+	resp, err := cli.SendMessageEvent(ctx, ia.RoomID, event.EventMessage, content)
+	if err != nil {
+		return "", err
+	}
+	return resp.EventID, nil
+}
@@ -0,0 +1,302 @@
+// Package botcmd implements a router for bot commands sent as m.command
+// messages containing an [event.BotCommand], as well as for interactions with
+// message components such as buttons and select menus.
+package botcmd
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/exsync"
+
+	"github.com/De-IM/mautrix"
+	"github.com/De-IM/mautrix/appservice"
+	"github.com/De-IM/mautrix/event"
+	"github.com/De-IM/mautrix/id"
+)
+
+// Handler is a function that handles a single command invocation. Errors
+// returned by the handler are passed to [Processor.OnError].
+type Handler func(ctx context.Context, evt *Event) error
+
+type registeredCommand struct {
+	def     *event.BotCommand
+	handler Handler
+}
+
+// Processor parses m.command messages, validates them against the registered
+// command definitions and dispatches them to the appropriate handler.
+type Processor struct {
+	// Client is used for fetching replied-to events and sending replies.
+	// It may be nil if those features aren't needed.
+	Client *mautrix.Client
+	// BotID is the ID of this bot. If set, commands with a different non-empty
+	// bot_id are ignored. Unknown commands are only reported as errors if
+	// they're explicitly addressed to this bot ID, because they may be meant
+	// for another bot in the same room.
+	BotID string
+	// OnError is called by Handle when processing a command fails. If nil,
+	// the error is only logged.
+	OnError func(ctx context.Context, evt *event.Event, err error)
+
+	commands           map[string]*registeredCommand
+	buttonHandlers     interactionHandlers
+	selectMenuHandlers interactionHandlers
+	handlersLock       sync.RWMutex
+	messageSenders     *exsync.RingBuffer[id.EventID, id.UserID]
+}
+
+// NewProcessor creates a new command processor. The client may be nil.
+func NewProcessor(client *mautrix.Client) *Processor {
+	return &Processor{
+		Client:         client,
+		commands:       make(map[string]*registeredCommand),
+		messageSenders: exsync.NewRingBuffer[id.EventID, id.UserID](messageSenderCacheSize),
+	}
+}
+
+func normalizeCommandName(name string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(name), "/"))
+}
+
+// commandType returns the type of the command, defaulting to chat commands.
+func commandType(cmd *event.BotCommand) string {
+	if cmd.Type == "" {
+		return event.BotCommandTypeChat
+	}
+	return cmd.Type
+}
+
+// Register adds a handler for the given command definition. The definition's
+// options are used to parse and validate the options of incoming commands.
+// Registering the same command name again replaces the previous handler.
+func (proc *Processor) Register(def event.BotCommand, handler Handler) {
+	def.Command = normalizeCommandName(def.Command)
+	if def.Command == "" {
+		panic("botcmd: command name must not be empty")
+	} else if handler == nil {
+		panic("botcmd: handler must not be nil")
+	}
+	switch def.Type {
+	case "", event.BotCommandTypeChat, event.BotCommandTypeUser, event.BotCommandTypeMessage:
+	default:
+		panic(fmt.Sprintf("botcmd: unsupported command type %q for /%s", def.Type, def.Command))
+	}
+	for _, opt := range def.Options {
+		switch opt.Type {
+		case "", event.CommandOptionTypeString, event.CommandOptionTypeInteger, event.CommandOptionTypeBoolean:
+		default:
+			panic(fmt.Sprintf("botcmd: unsupported type %q for option %q of /%s", opt.Type, opt.Name, def.Command))
+		}
+	}
+	proc.handlersLock.Lock()
+	proc.commands[def.Command] = &registeredCommand{def: &def, handler: handler}
+	proc.handlersLock.Unlock()
+}
+
+// Unregister removes the handler for the given command name.
+func (proc *Processor) Unregister(name string) {
+	proc.handlersLock.Lock()
+	delete(proc.commands, normalizeCommandName(name))
+	proc.handlersLock.Unlock()
+}
+
+// Commands returns the definitions of all registered commands sorted by name.
+func (proc *Processor) Commands() []event.BotCommand {
+	proc.handlersLock.RLock()
+	defer proc.handlersLock.RUnlock()
+	cmds := make([]event.BotCommand, 0, len(proc.commands))
+	for _, cmd := range proc.commands {
+		cmds = append(cmds, *cmd.def)
+	}
+	slices.SortFunc(cmds, func(a, b event.BotCommand) int {
+		return strings.Compare(a.Command, b.Command)
+	})
+	return cmds
+}
+
+// AddToSyncer registers the processor as a m.room.message and fi.mau.interaction
+// handler in the given syncer.
+func (proc *Processor) AddToSyncer(syncer mautrix.ExtensibleSyncer) {
+	syncer.OnEventType(event.EventMessage, proc.Handle)
+	syncer.OnEventType(event.EventInteraction, proc.Handle)
+	syncer.OnEventType(event.ToDeviceInteraction, proc.Handle)
+}
+
+// AddToEventProcessor registers the processor as a m.room.message and
+// fi.mau.interaction handler in the given appservice event processor.
+func (proc *Processor) AddToEventProcessor(ep *appservice.EventProcessor) {
+	ep.On(event.EventMessage, proc.Handle)
+	ep.On(event.EventInteraction, proc.Handle)
+	ep.On(event.ToDeviceInteraction, proc.Handle)
+}
+
+// Handle processes the given command or interaction event and passes any
+// errors to OnError. It can be used directly as an event handler.
+func (proc *Processor) Handle(ctx context.Context, evt *event.Event) {
+	var err error
+	switch evt.Type.Type {
+	case event.EventMessage.Type:
+		err = proc.Process(ctx, evt)
+	case event.EventInteraction.Type:
+		err = proc.ProcessInteraction(ctx, evt)
+	}
+	if err == nil {
+		return
+	} else if proc.OnError != nil {
+		proc.OnError(ctx, evt, err)
+	} else {
+		zerolog.Ctx(ctx).Warn().Err(err).
+			Stringer("event_id", evt.ID).
+			Stringer("room_id", evt.RoomID).
+			Stringer("sender", evt.Sender).
+			Str("event_type", evt.Type.Type).
+			Msg("Failed to handle bot command or interaction")
+	}
+}
+
+// Process parses the command in the given event and calls the handler
+// registered for it. Events that aren't commands for this bot are ignored and
+// nil is returned. Unknown commands and commands of the wrong type are also
+// ignored, unless they're explicitly addressed to BotID.
+//
+// The type of the received command must match the registered definition.
+// Message commands must reply to the target message and user commands must
+// mention exactly one target user.
+//
+// If the command doesn't match its definition, a [*UsageError] is returned.
+// Otherwise, the error returned by the handler is returned as-is.
+func (proc *Processor) Process(ctx context.Context, evt *event.Event) error {
+	content := evt.Content.AsMessage()
+	if content.MsgType != event.MsgCommand || content.BotCommand == nil {
+		return nil
+	} else if proc.Client != nil && evt.Sender == proc.Client.UserID {
+		return nil
+	} else if proc.BotID != "" && content.BotCommand.BotId != "" && content.BotCommand.BotId != proc.BotID {
+		return nil
+	}
+
+	name := normalizeCommandName(content.BotCommand.Command)
+	proc.handlersLock.RLock()
+	cmd, ok := proc.commands[name]
+	proc.handlersLock.RUnlock()
+	// Commands that we don't know may be meant for other bots, so they're only
+	// reported if they're explicitly addressed to us.
+	addressedToUs := proc.BotID != "" && content.BotCommand.BotId == proc.BotID
+	if !ok {
+		if addressedToUs {
+			return &UsageError{Command: name, Err: ErrUnknownCommand}
+		}
+		return nil
+	} else if cmdType := commandType(content.BotCommand); cmdType != commandType(cmd.def) {
+		if addressedToUs {
+			return &UsageError{Command: name, Usage: Usage(cmd.def), Err: ErrWrongCommandType, Reason: fmt.Sprintf("expected %s command, got %s", commandType(cmd.def), cmdType)}
+		}
+		return nil
+	}
+	replyTo := content.RelatesTo.GetReplyTo()
+	var targetUser id.UserID
+	switch commandType(cmd.def) {
+	case event.BotCommandTypeMessage:
+		if replyTo == "" {
+			return &UsageError{Command: name, Usage: Usage(cmd.def), Err: ErrMissingTarget, Reason: "message commands must reply to the target message"}
+		}
+	case event.BotCommandTypeUser:
+		if content.Mentions == nil || len(content.Mentions.UserIDs) != 1 {
+			return &UsageError{Command: name, Usage: Usage(cmd.def), Err: ErrMissingTarget, Reason: "user commands must mention exactly one target user"}
+		}
+		targetUser = content.Mentions.UserIDs[0]
+	}
+	args, err := ParseOptions(cmd.def, content.BotCommand.Options)
+	if err != nil {
+		return err
+	}
+
+	log := zerolog.Ctx(ctx).With().
+		Str("command", name).
+		Stringer("event_id", evt.ID).
+		Stringer("room_id", evt.RoomID).
+		Stringer("sender", evt.Sender).
+		Logger()
+	ctx = log.WithContext(ctx)
+	return cmd.handler(ctx, &Event{
+		Processor:  proc,
+		Event:      evt,
+		Content:    content,
+		Command:    cmd.def,
+		Received:   content.BotCommand,
+		RoomID:     evt.RoomID,
+		Sender:     evt.Sender,
+		EventID:    evt.ID,
+		ReplyTo:    replyTo,
+		TargetUser: targetUser,
+		Args:       args,
+		Log:        log,
+	})
+}
+
+// ParseOptions validates the received options against the command definition
+// and converts the values to the declared types.
+func ParseOptions(def *event.BotCommand, received []event.CommandOption) (map[string]any, error) {
+	args := make(map[string]any, len(received))
+	for _, opt := range received {
+		idx := slices.IndexFunc(def.Options, func(declared event.CommandOption) bool {
+			return declared.Name == opt.Name
+		})
+		if idx == -1 {
+			return nil, &UsageError{Command: def.Command, Option: opt.Name, Usage: Usage(def), Err: ErrUnknownOption}
+		} else if _, alreadySet := args[opt.Name]; alreadySet {
+			return nil, &UsageError{Command: def.Command, Option: opt.Name, Usage: Usage(def), Err: ErrDuplicateOption}
+		}
+		declared := &def.Options[idx]
+		var err error
+		switch declared.Type {
+		case event.CommandOptionTypeInteger:
+			args[opt.Name], err = strconv.ParseInt(strings.TrimSpace(opt.Value), 10, 64)
+		case event.CommandOptionTypeBoolean:
+			args[opt.Name], err = strconv.ParseBool(strings.TrimSpace(opt.Value))
+		default:
+			args[opt.Name] = opt.Value
+		}
+		if err != nil {
+			return nil, &UsageError{
+				Command: def.Command,
+				Option:  opt.Name,
+				Usage:   Usage(def),
+				Err:     ErrInvalidOptionValue,
+				Reason:  fmt.Sprintf("expected %s", declared.Type),
+			}
+		}
+	}
+	for _, declared := range def.Options {
+		if _, ok := args[declared.Name]; !ok && declared.Required {
+			return nil, &UsageError{Command: def.Command, Option: declared.Name, Usage: Usage(def), Err: ErrMissingOption}
+		}
+	}
+	return args, nil
+}
+
+// Usage returns a human-readable usage string for the command, such as
+// `/ban <user:string> [reason:string]`.
+func Usage(def *event.BotCommand) string {
+	var buf strings.Builder
+	buf.WriteByte('/')
+	buf.WriteString(def.Command)
+	for _, opt := range def.Options {
+		optType := opt.Type
+		if optType == "" {
+			optType = event.CommandOptionTypeString
+		}
+		if opt.Required {
+			_, _ = fmt.Fprintf(&buf, " <%s:%s>", opt.Name, optType)
+		} else {
+			_, _ = fmt.Fprintf(&buf, " [%s:%s]", opt.Name, optType)
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,172 @@
+package botcmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/De-IM/mautrix"
+	"github.com/De-IM/mautrix/event"
+	"github.com/De-IM/mautrix/id"
+)
+
+// ScopeResolver computes which commands apply to a given user in a given room
+// based on the scopes of the commands.
+type ScopeResolver struct {
+	StateStore mautrix.StateStore
+	// AdminPowerLevel is the minimum power level for a user to be considered
+	// an administrator. If zero, the level required to send m.room.power_levels
+	// events in the room is used.
+	AdminPowerLevel int
+}
+
+// ErrRoomMembersUnknown is returned by [ScopeResolver.IsDirectChat] if the
+// state store doesn't have any members cached for the room.
+var ErrRoomMembersUnknown = errors.New("state store doesn't have members of the room")
+
+// IsDirectChat returns whether the room is a direct chat, which is defined as
+// having at most two joined or invited members. If the state store doesn't
+// know any members of the room, ErrRoomMembersUnknown is returned.
+func (sr *ScopeResolver) IsDirectChat(ctx context.Context, roomID id.RoomID) (bool, error) {
+	members, err := sr.StateStore.GetRoomJoinedOrInvitedMembers(ctx, roomID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get room members: %w", err)
+	} else if len(members) == 0 {
+		return false, fmt.Errorf("%w %s", ErrRoomMembersUnknown, roomID)
+	}
+	return len(members) <= 2, nil
+}
+
+// IsAdmin returns whether the user is an administrator of the room according
+// to the cached power levels.
+func (sr *ScopeResolver) IsAdmin(ctx context.Context, roomID id.RoomID, userID id.UserID) (bool, error) {
+	pl, err := sr.StateStore.GetPowerLevels(ctx, roomID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get power levels: %w", err)
+	} else if pl == nil {
+		return false, nil
+	}
+	adminLevel := sr.AdminPowerLevel
+	if adminLevel == 0 {
+		adminLevel = pl.GetEventLevel(event.StatePowerLevels)
+	}
+	return pl.GetUserLevel(userID) >= adminLevel, nil
+}
+
+// Resolve returns the commands that are effective for the given user in the
+// given room with the given language.
+//
+// Like Telegram's command scopes, only the most specific scope that has any
+// commands is used. For direct chats, the order is chat, all_private_chats
+// and default. For group chats, the order is chat_member,
+// chat_administrators, chat, all_chat_administrators, all_group_chats and
+// default, where the administrator scopes are skipped for non-admins. Within
+// each scope, commands for the given language are preferred over commands
+// without a language code.
+func (sr *ScopeResolver) Resolve(ctx context.Context, commands []event.BotCommand, roomID id.RoomID, userID id.UserID, language string) ([]event.BotCommand, error) {
+	isDirect, err := sr.IsDirectChat(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	var scopes []string
+	if isDirect {
+		scopes = []string{event.BotCommandScopeChat, event.BotCommandScopeAllPrivateChats, event.BotCommandScopeDefault}
+	} else {
+		isAdmin, err := sr.IsAdmin(ctx, roomID, userID)
+		if err != nil {
+			return nil, err
+		}
+		scopes = []string{event.BotCommandScopeChatMember}
+		if isAdmin {
+			scopes = append(scopes, event.BotCommandScopeChatAdministrators)
+		}
+		scopes = append(scopes, event.BotCommandScopeChat)
+		if isAdmin {
+			scopes = append(scopes, event.BotCommandScopeAllChatAdministrators)
+		}
+		scopes = append(scopes, event.BotCommandScopeAllGroupChats, event.BotCommandScopeDefault)
+	}
+	for _, scope := range scopes {
+		languages := []string{""}
+		if language != "" {
+			languages = []string{language, ""}
+		}
+		for _, lang := range languages {
+			var matched []event.BotCommand
+			for _, cmd := range commands {
+				if cmd.LanguageCode == lang && scopeMatches(&cmd.Scope, scope, roomID, userID) {
+					matched = append(matched, cmd)
+				}
+			}
+			if len(matched) > 0 {
+				return matched, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func scopeMatches(cmdScope *event.BotCommandScope, scope string, roomID id.RoomID, userID id.UserID) bool {
+	scopeType := cmdScope.Type
+	if scopeType == "" {
+		scopeType = event.BotCommandScopeDefault
+	}
+	if scopeType != scope {
+		return false
+	}
+	switch scope {
+	case event.BotCommandScopeChat, event.BotCommandScopeChatAdministrators:
+		return cmdScope.ChatId == roomID.String()
+	case event.BotCommandScopeChatMember:
+		return cmdScope.ChatId == roomID.String() && cmdScope.UserId == userID.String()
+	default:
+		return true
+	}
+}
+
+// ResolveCommands returns the registered commands that are effective for the
+// given user in the given room. The processor must have a client with a state
+// store.
+func (proc *Processor) ResolveCommands(ctx context.Context, roomID id.RoomID, userID id.UserID, language string) ([]event.BotCommand, error) {
+	if proc.Client == nil || proc.Client.StateStore == nil {
+		return nil, fmt.Errorf("processor doesn't have a client with a state store")
+	}
+	resolver := &ScopeResolver{StateStore: proc.Client.StateStore}
+	return resolver.Resolve(ctx, proc.Commands(), roomID, userID, language)
+}
+
+// PublishRoomCommands publishes the command menu of the client's user in the
+// given room as a m.room.config state event with the user ID as the state key.
+// Publishing again replaces the previous menu.
+func PublishRoomCommands(ctx context.Context, cli *mautrix.Client, roomID id.RoomID, commands []event.BotCommand) error {
+	_, err := cli.SendStateEvent(ctx, roomID, event.StateRoomConfig, cli.UserID.String(), &event.ConfigEvent{
+		Config: &event.BotCommandsEventContent{
+			BotID:    cli.UserID.String(),
+			Commands: commands,
+		},
+	})
+	return err
+}
+
+// PublishUserCommands publishes the command menu of the client's user for the
+// given user by updating the fi.mau.bot_commands account data of that user. Menus
+// of other bots are preserved. Passing an empty command list removes the menu.
+//
+// This uses the admin account data endpoints, so the client must be allowed
+// to modify the account data of other users.
+func PublishUserCommands(ctx context.Context, cli *mautrix.Client, userID id.UserID, commands []event.BotCommand) error {
+	var content event.BotCommandMenusEventContent
+	err := cli.GetAccountDataByAdmin(ctx, userID, event.AccountDataBotCommands.Type, &content)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return fmt.Errorf("failed to get existing command menus: %w", err)
+	}
+	if content.Menus == nil {
+		content.Menus = make(map[string][]event.BotCommand)
+	}
+	if len(commands) == 0 {
+		delete(content.Menus, cli.UserID.String())
+	} else {
+		content.Menus[cli.UserID.String()] = commands
+	}
+	return cli.SetAccountDataByAdmin(ctx, userID, event.AccountDataBotCommands.Type, &content)
+}
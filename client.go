@@ -16,6 +16,7 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -88,6 +89,19 @@ type Client struct {
 	Verification  VerificationHelper
 	SpecVersions  *RespVersions
 
+	// The refresh token for the client. If set, the access token is refreshed automatically
+	// before it expires and when the server returns a soft logout error.
+	RefreshToken string
+	// The time when the access token expires. Zero if the token doesn't expire.
+	AccessTokenExpiresAt time.Time
+	// How long before expiry the access token should be refreshed, defaults to DefaultTokenRefreshMargin
+	TokenRefreshMargin time.Duration
+	// The thing which can store the credentials after login and token refreshes. Optional.
+	CredentialsStore CredentialsStore
+	// TokenRefresher exchanges the refresh token for new tokens. If nil, the /refresh endpoint is used.
+	// This is set by OAuth logins, where tokens are refreshed using the authorization server instead.
+	TokenRefresher func(ctx context.Context, refreshToken string) (*RespRefresh, error)
+
 	Log zerolog.Logger
 
 	RequestHook  func(req *http.Request)
@@ -118,6 +132,9 @@ type Client struct {
 	SetAppServiceDeviceID bool
 
 	syncingID uint32 // Identifies the current Sync. Only one Sync can be active at any given time.
+
+	credsLock   sync.RWMutex
+	refreshLock sync.Mutex
 }
 
 type ClientWellKnown struct {
@@ -177,16 +194,25 @@ func DiscoverClientAPI(ctx context.Context, serverName string) (*ClientWellKnown
 }
 
 // SetCredentials sets the user ID and access token on this client instance.
+// Any refresh token and access token expiry from previous credentials are cleared.
 //
 // Deprecated: use the StoreCredentials field in ReqLogin instead.
 func (cli *Client) SetCredentials(userID id.UserID, accessToken string) {
+	cli.credsLock.Lock()
+	defer cli.credsLock.Unlock()
 	cli.AccessToken = accessToken
+	cli.RefreshToken = ""
+	cli.AccessTokenExpiresAt = time.Time{}
 	cli.UserID = userID
 }
 
-// ClearCredentials removes the user ID and access token on this client instance.
+// ClearCredentials removes the user ID and tokens on this client instance.
 func (cli *Client) ClearCredentials() {
+	cli.credsLock.Lock()
+	defer cli.credsLock.Unlock()
 	cli.AccessToken = ""
+	cli.RefreshToken = ""
+	cli.AccessTokenExpiresAt = time.Time{}
 	cli.UserID = ""
 	cli.DeviceID = ""
 }
@@ -214,22 +240,10 @@ func (cli *Client) SyncWithContext(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	filterID, err := cli.Store.LoadFilterID(ctx, cli.UserID)
+	filterID, err := cli.loadFilterID(ctx)
 	if err != nil {
 		return err
 	}
-
-	if filterID == "" {
-		filterJSON := cli.Syncer.GetFilterJSON(cli.UserID)
-		resFilter, err := cli.CreateFilter(ctx, filterJSON)
-		if err != nil {
-			return err
-		}
-		filterID = resFilter.FilterID
-		if err := cli.Store.SaveFilterID(ctx, cli.UserID, filterID); err != nil {
-			return err
-		}
-	}
 	lastSuccessfulSync := time.Now().Add(-cli.StreamSyncMinAge - 1*time.Hour)
 	// Always do first sync with 0 timeout
 	isFailing := true
@@ -295,6 +309,50 @@ func (cli *Client) SyncWithContext(ctx context.Context) error {
 	}
 }
 
+// loadFilterID loads the filter ID from the sync store, or uploads the syncer's filter if there's no stored ID.
+// If the store implements FilterHashSyncStore, the filter is also uploaded again when it has changed.
+func (cli *Client) loadFilterID(ctx context.Context) (string, error) {
+	filterJSON := cli.Syncer.GetFilterJSON(cli.UserID)
+	hashStore, isHashStore := cli.Store.(FilterHashSyncStore)
+	var filterID, filterHash string
+	var err error
+	if isHashStore {
+		filterHash, err = HashFilter(filterJSON)
+		if err != nil {
+			return "", fmt.Errorf("failed to hash filter: %w", err)
+		}
+		var storedHash string
+		filterID, storedHash, err = hashStore.LoadFilterIDWithHash(ctx, cli.UserID)
+		if err != nil {
+			return "", err
+		} else if filterID != "" && storedHash != filterHash {
+			cli.Log.Debug().Str("old_filter_id", filterID).Msg("Filter has changed, uploading new filter")
+			filterID = ""
+		}
+	} else {
+		filterID, err = cli.Store.LoadFilterID(ctx, cli.UserID)
+		if err != nil {
+			return "", err
+		}
+	}
+	if filterID != "" {
+		return filterID, nil
+	}
+	resFilter, err := cli.CreateFilter(ctx, filterJSON)
+	if err != nil {
+		return "", err
+	}
+	if isHashStore {
+		err = hashStore.SaveFilterIDWithHash(ctx, cli.UserID, resFilter.FilterID, filterHash)
+	} else {
+		err = cli.Store.SaveFilterID(ctx, cli.UserID, resFilter.FilterID)
+	}
+	if err != nil {
+		return "", err
+	}
+	return resFilter.FilterID, nil
+}
+
 func (cli *Client) incrementSyncingID() uint32 {
 	return atomic.AddUint32(&cli.syncingID, 1)
 }
@@ -314,6 +372,9 @@ type contextKey int
 const (
 	LogBodyContextKey contextKey = iota
 	LogRequestIDContextKey
+
+	unauthenticatedContextKey
+	tokenReplayedContextKey
 )
 
 func (cli *Client) RequestStart(req *http.Request) {
@@ -489,9 +550,11 @@ func (cli *Client) MakeFullRequestWithResp(ctx context.Context, params FullReque
 		}
 	}
 	req.Header.Set("User-Agent", cli.UserAgent)
-	if len(cli.AccessToken) > 0 {
-		fmt.Println("cli.AccessToken:", cli.AccessToken)
-		req.Header.Set("Authorization", "Bearer "+cli.AccessToken)
+	if ctx.Value(unauthenticatedContextKey) == nil {
+		accessToken := cli.getAccessToken(ctx)
+		if len(accessToken) > 0 {
+			req.Header.Set("Authorization", "Bearer "+accessToken)
+		}
 	}
 	if params.Client == nil {
 		params.Client = cli.Client
@@ -507,26 +570,32 @@ func (cli *Client) cliOrContextLog(ctx context.Context) *zerolog.Logger {
 	return log
 }
 
+// rewindRequestBody prepares the body of the given request for sending it again.
+func rewindRequestBody(req *http.Request) error {
+	if req.Body == nil {
+		return nil
+	} else if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return fmt.Errorf("failed to get new body: %w", err)
+		}
+		req.Body = body
+	} else if bodySeeker, ok := req.Body.(io.ReadSeeker); ok {
+		_, err := bodySeeker.Seek(0, io.SeekStart)
+		if err != nil {
+			return fmt.Errorf("failed to seek to beginning of body: %w", err)
+		}
+	} else {
+		return errors.New("GetBody is nil and Body is not an io.ReadSeeker")
+	}
+	return nil
+}
+
 func (cli *Client) doRetry(req *http.Request, cause error, retries int, backoff time.Duration, responseJSON any, handler ClientResponseHandler, dontReadResponse bool, client *http.Client) ([]byte, *http.Response, error) {
 	log := zerolog.Ctx(req.Context())
-	if req.Body != nil {
-		var err error
-		if req.GetBody != nil {
-			req.Body, err = req.GetBody()
-			if err != nil {
-				log.Warn().Err(err).Msg("Failed to get new body to retry request")
-				return nil, nil, cause
-			}
-		} else if bodySeeker, ok := req.Body.(io.ReadSeeker); ok {
-			_, err = bodySeeker.Seek(0, io.SeekStart)
-			if err != nil {
-				log.Warn().Err(err).Msg("Failed to seek to beginning of request body")
-				return nil, nil, cause
-			}
-		} else {
-			log.Warn().Msg("Failed to get new body to retry request: GetBody is nil and Body is not an io.ReadSeeker")
-			return nil, nil, cause
-		}
+	if err := rewindRequestBody(req); err != nil {
+		log.Warn().Err(err).Msg("Failed to rewind body to retry request")
+		return nil, nil, cause
 	}
 	log.Warn().Err(cause).
 		Int("retry_in_seconds", int(backoff.Seconds())).
@@ -655,6 +724,11 @@ func (cli *Client) executeCompiledRequest(req *http.Request, retries int, backof
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
 		body, err = ParseErrorResponse(req, res)
 		cli.LogRequestDone(req, res, nil, nil, len(body), duration)
+		if isSoftLogout(err) {
+			if replayReq := cli.refreshForReplay(req, err); replayReq != nil {
+				return cli.executeCompiledRequest(replayReq, retries, backoff, responseJSON, handler, dontReadResponse, client)
+			}
+		}
 	} else {
 		body, err = handler(req, res, responseJSON)
 		cli.LogRequestDone(req, res, nil, err, len(body), duration)
@@ -662,6 +736,40 @@ func (cli *Client) executeCompiledRequest(req *http.Request, retries int, backof
 	return body, res, err
 }
 
+// refreshForReplay refreshes the access token after a soft logout error and returns
+// a copy of the request with the new token, or nil if the request shouldn't be replayed.
+func (cli *Client) refreshForReplay(req *http.Request, cause error) *http.Request {
+	ctx := req.Context()
+	if ctx.Value(unauthenticatedContextKey) != nil || ctx.Value(tokenReplayedContextKey) != nil {
+		return nil
+	}
+	staleToken, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil
+	}
+	log := cli.cliOrContextLog(ctx)
+	cli.credsLock.RLock()
+	hasRefreshToken := cli.RefreshToken != ""
+	cli.credsLock.RUnlock()
+	if !hasRefreshToken {
+		return nil
+	} else if err := cli.refreshAccessToken(ctx, staleToken); err != nil {
+		log.Err(err).AnErr("cause", cause).Msg("Failed to refresh access token after soft logout")
+		return nil
+	} else if err = rewindRequestBody(req); err != nil {
+		log.Warn().Err(err).Msg("Failed to rewind body to replay request after token refresh")
+		return nil
+	}
+	cli.credsLock.RLock()
+	accessToken := cli.AccessToken
+	cli.credsLock.RUnlock()
+	log.Debug().Msg("Replaying request with refreshed access token")
+	replayReq := req.WithContext(context.WithValue(ctx, tokenReplayedContextKey, true))
+	replayReq.Header = req.Header.Clone()
+	replayReq.Header.Set("Authorization", "Bearer "+accessToken)
+	return replayReq
+}
+
 // Whoami gets the user ID of the current user. See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3accountwhoami
 func (cli *Client) Whoami(ctx context.Context) (resp *RespWhoami, err error) {
 
@@ -815,6 +923,21 @@ func (cli *Client) Register(ctx context.Context, req *ReqRegister) (*RespRegiste
 	return cli.register(ctx, u, req)
 }
 
+// RegisterWithUIA registers a new user like Register, but completes the user-interactive auth
+// flow with the given callback (see MakeUIARequest) instead of returning the UIA response.
+//
+// This does not set credentials on the client instance. See SetCredentials() instead.
+func (cli *Client) RegisterWithUIA(ctx context.Context, req *ReqRegister, uiaCallback UIACallback) (resp *RespRegister, err error) {
+	_, err = cli.MakeUIARequest(ctx, FullRequest{
+		Method:           http.MethodPost,
+		URL:              cli.BuildClientURL("v3", "register"),
+		RequestJSON:      req,
+		ResponseJSON:     &resp,
+		SensitiveContent: len(req.Password) > 0,
+	}, func(auth interface{}) { req.Auth = auth }, uiaCallback)
+	return
+}
+
 // RegisterGuest makes an HTTP request according to https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3register
 // with kind=guest.
 //
@@ -876,13 +999,19 @@ func (cli *Client) Login(ctx context.Context, req *ReqLogin) (resp *RespLogin, e
 		SensitiveContent: len(req.Password) > 0 || len(req.Token) > 0,
 	})
 	if req.StoreCredentials && err == nil {
-		cli.DeviceID = resp.DeviceID
-		cli.AccessToken = resp.AccessToken
-		cli.UserID = resp.UserID
+		cli.SetFullCredentials(&Credentials{
+			UserID:       resp.UserID,
+			DeviceID:     resp.DeviceID,
+			AccessToken:  resp.AccessToken,
+			RefreshToken: resp.RefreshToken,
+			ExpiresAt:    expiryFromMS(resp.ExpiresInMS),
+		})
+		cli.saveCredentials(ctx)
 
 		cli.Log.Debug().
 			Str("user_id", cli.UserID.String()).
 			Str("device_id", cli.DeviceID.String()).
+			Bool("refreshable", resp.RefreshToken != "").
 			Msg("Stored credentials after login")
 	}
 	if req.StoreHomeserverURL && err == nil && resp.WellKnown != nil && len(resp.WellKnown.Homeserver.BaseURL) > 0 {
@@ -958,6 +1087,30 @@ func (cli *Client) JoinRoom(ctx context.Context, roomIDorAlias, serverName strin
 	return
 }
 
+// KnockRoom requests to join a room with the knock join rule.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3knockroomidoralias
+func (cli *Client) KnockRoom(ctx context.Context, roomIDorAlias string, req *ReqKnockRoom) (resp *RespKnockRoom, err error) {
+	if req == nil {
+		req = &ReqKnockRoom{}
+	}
+	urlPath := cli.BuildURLWithFullQuery(ClientURLPath{"v3", "knock", roomIDorAlias}, func(q url.Values) {
+		if len(req.Via) > 0 {
+			q["via"] = req.Via
+			// server_name is deprecated in favor of via, but older servers only support it
+			q["server_name"] = req.Via
+		}
+	})
+	_, err = cli.MakeRequest(ctx, http.MethodPost, urlPath, req, &resp)
+	if err == nil && cli.StateStore != nil {
+		err = cli.StateStore.SetMembership(ctx, resp.RoomID, cli.UserID, event.MembershipKnock)
+		if err != nil {
+			err = fmt.Errorf("failed to update state store: %w", err)
+		}
+	}
+	return
+}
+
 // JoinRoomByID joins the client to a room ID. See https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3roomsroomidjoin
 //
 // Unlike JoinRoom, this method can only be used to join rooms that the server already knows about.
@@ -979,6 +1132,19 @@ func (cli *Client) GetProfile(ctx context.Context, mxid id.UserID) (resp *RespUs
 	return
 }
 
+// SearchUserDirectory searches for users by user ID and display name. The
+// server decides which users are searched, but it usually includes at least
+// the users who share a room with the current user and users in public rooms.
+// If the limit is zero, the server default (usually 10) is used. Limited is set
+// in the response if there were more results than the limit.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3user_directorysearch
+func (cli *Client) SearchUserDirectory(ctx context.Context, searchTerm string, limit int) (resp *RespSearchUserDirectory, err error) {
+	urlPath := cli.BuildClientURL("v3", "user_directory", "search")
+	_, err = cli.MakeRequest(ctx, http.MethodPost, urlPath, &ReqSearchUserDirectory{SearchTerm: searchTerm, Limit: limit}, &resp)
+	return
+}
+
 // GetDisplayName returns the display name of the user with the specified MXID. See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3profileuseriddisplayname
 func (cli *Client) GetDisplayName(ctx context.Context, mxid id.UserID) (resp *RespUserDisplayName, err error) {
 	urlPath := cli.BuildClientURL("v3", "profile", mxid, "displayname")
@@ -1144,6 +1310,16 @@ func (cli *Client) SendMessageEvent(ctx context.Context, roomID id.RoomID, event
 	return
 }
 
+// SendMessageStrict validates the cards and components of the given message
+// before sending it as a m.room.message event. Invalid content is rejected
+// with an [event.ValidationErrors] without making a request.
+func (cli *Client) SendMessageStrict(ctx context.Context, roomID id.RoomID, content *event.MessageEventContent, extra ...ReqSendEvent) (*RespSendEvent, error) {
+	if err := content.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid message content: %w", err)
+	}
+	return cli.SendMessageEvent(ctx, roomID, event.EventMessage, content, extra...)
+}
+
 func (cli *Client) SendMessageEventByUserId(ctx context.Context, userID id.UserID, eventType event.Type, contentJSON interface{}, extra ...ReqSendEvent) (resp *RespSendEvent, err error) {
 	var req ReqSendEvent
 	if len(extra) > 0 {
@@ -1167,7 +1343,6 @@ func (cli *Client) SendMessageEventByUserId(ctx context.Context, userID id.UserI
 
 	urlData := ClientURLPath{"v3", "notice", userID, "send", eventType.String(), txnID}
 	urlPath := cli.BuildURLWithQuery(urlData, queryParams)
-	fmt.Println("urlPath:", urlPath)
 	_, err = cli.MakeRequest(ctx, http.MethodPut, urlPath, contentJSON, &resp)
 	return
 }
@@ -1304,6 +1479,17 @@ func (cli *Client) LeaveRoom(ctx context.Context, roomID id.RoomID, optionalReq
 	return
 }
 
+// UpgradeRoom upgrades the given room to a new room version. The server
+// creates a new room, copies the important state over and sends a tombstone
+// event to the old room.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3roomsroomidupgrade
+func (cli *Client) UpgradeRoom(ctx context.Context, roomID id.RoomID, newVersion event.RoomVersion) (resp *RespUpgradeRoom, err error) {
+	urlPath := cli.BuildClientURL("v3", "rooms", roomID, "upgrade")
+	_, err = cli.MakeRequest(ctx, http.MethodPost, urlPath, &ReqUpgradeRoom{NewVersion: newVersion}, &resp)
+	return
+}
+
 // ForgetRoom forgets a room entirely. See https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3roomsroomidforget
 func (cli *Client) ForgetRoom(ctx context.Context, roomID id.RoomID) (resp *RespForgetRoom, err error) {
 	u := cli.BuildClientURL("v3", "rooms", roomID, "forget")
@@ -1524,7 +1710,7 @@ func (cli *Client) StateAsArray(ctx context.Context, roomID id.RoomID) (state []
 
 // GetMediaConfig fetches the configuration of the content repository, such as upload limitations.
 func (cli *Client) GetMediaConfig(ctx context.Context) (resp *RespMediaConfig, err error) {
-	_, err = cli.MakeRequest(ctx, http.MethodGet, cli.BuildClientURL("v1", "media", "config"), nil, &resp)
+	_, err = cli.MakeRequest(ctx, http.MethodGet, cli.BuildURL(cli.mediaURLPath("config")), nil, &resp)
 	return
 }
 
@@ -1545,15 +1731,58 @@ func (cli *Client) UploadLink(ctx context.Context, link string) (*RespMediaUploa
 	return cli.Upload(ctx, res.Body, res.Header.Get("Content-Type"), res.ContentLength)
 }
 
+// mediaURLPath returns the path of a media repository endpoint. Authenticated
+// media (/_matrix/client/v1/media) is used unless the server is known to not
+// support it, in which case the legacy /_matrix/media/v3 endpoints are used.
+func (cli *Client) mediaURLPath(path ...any) PrefixableURLPath {
+	if cli.SpecVersions != nil && !cli.SpecVersions.Supports(FeatureAuthenticatedMedia) {
+		return append(MediaURLPath{"v3"}, path...)
+	}
+	return append(ClientURLPath{"v1", "media"}, path...)
+}
+
+// Download downloads the given media. The caller must close the response body.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv1mediadownloadservernamemediaid
 func (cli *Client) Download(ctx context.Context, mxcURL id.ContentURI) (*http.Response, error) {
 	_, resp, err := cli.MakeFullRequestWithResp(ctx, FullRequest{
 		Method:           http.MethodGet,
-		URL:              cli.BuildClientURL("v1", "media", "download", mxcURL.Homeserver, mxcURL.FileID),
+		URL:              cli.BuildURL(cli.mediaURLPath("download", mxcURL.Homeserver, mxcURL.FileID)),
 		DontReadResponse: true,
 	})
 	return resp, err
 }
 
+// DownloadStream downloads the given media without buffering it. The caller
+// must close the returned download.
+func (cli *Client) DownloadStream(ctx context.Context, mxcURL id.ContentURI) (*MediaDownload, error) {
+	resp, err := cli.Download(ctx, mxcURL)
+	if err != nil {
+		return nil, err
+	}
+	return newMediaDownload(resp), nil
+}
+
+// Thumbnail downloads a thumbnail of the given media without buffering it.
+// The caller must close the returned download. The width and height of the
+// request are required.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv1mediathumbnailservernamemediaid
+func (cli *Client) Thumbnail(ctx context.Context, mxcURL id.ContentURI, req *ReqThumbnail) (*MediaDownload, error) {
+	if req == nil || req.Width <= 0 || req.Height <= 0 {
+		return nil, errors.New("thumbnail width and height must be positive")
+	}
+	_, resp, err := cli.MakeFullRequestWithResp(ctx, FullRequest{
+		Method:           http.MethodGet,
+		URL:              cli.BuildURLWithQuery(cli.mediaURLPath("thumbnail", mxcURL.Homeserver, mxcURL.FileID), req.Query()),
+		DontReadResponse: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newMediaDownload(resp), nil
+}
+
 func (cli *Client) DownloadBytes(ctx context.Context, mxcURL id.ContentURI) ([]byte, error) {
 	resp, err := cli.Download(ctx, mxcURL)
 	if err != nil {
@@ -1770,7 +1999,7 @@ func (cli *Client) UploadMedia(ctx context.Context, data ReqUploadMedia) (*RespM
 //
 // See https://spec.matrix.org/v1.2/client-server-api/#get_matrixmediav3preview_url
 func (cli *Client) GetURLPreview(ctx context.Context, url string) (*RespPreviewURL, error) {
-	reqURL := cli.BuildURLWithQuery(ClientURLPath{"v1", "media", "preview_url"}, map[string]string{
+	reqURL := cli.BuildURLWithQuery(cli.mediaURLPath("preview_url"), map[string]string{
 		"url": url,
 	})
 	var output RespPreviewURL
@@ -1904,6 +2133,93 @@ func (cli *Client) Messages(ctx context.Context, roomID id.RoomID, from, to stri
 	return
 }
 
+// GetRelations returns the events that relate to the given event, optionally
+// filtered by relation type and event type.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv1roomsroomidrelationseventid
+func (cli *Client) GetRelations(ctx context.Context, roomID id.RoomID, eventID id.EventID, req *ReqGetRelations) (resp *RespGetRelations, err error) {
+	urlPath := cli.BuildURLWithQuery(append(ClientURLPath{"v1", "rooms", roomID, "relations", eventID}, req.PathSuffix()...), req.Query())
+	_, err = cli.MakeRequest(ctx, http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
+// GetThreads returns the thread root events in the given room, ordered by
+// the most recent activity first.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv1roomsroomidthreads
+func (cli *Client) GetThreads(ctx context.Context, roomID id.RoomID, req *ReqGetThreads) (resp *RespGetThreads, err error) {
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v1", "rooms", roomID, "threads"}, req.Query())
+	_, err = cli.MakeRequest(ctx, http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
+// RelationsPaginator returns a [Paginator] that fetches all events relating
+// to the given event using [Client.GetRelations], following next_batch until
+// there are no more pages. The From field of the request is used as the
+// starting point.
+func (cli *Client) RelationsPaginator(roomID id.RoomID, eventID id.EventID, req *ReqGetRelations) *Paginator[*event.Event] {
+	var reqCopy ReqGetRelations
+	if req != nil {
+		reqCopy = *req
+	}
+	return NewPaginator(reqCopy.From, func(ctx context.Context, from string) ([]*event.Event, string, error) {
+		reqCopy.From = from
+		resp, err := cli.GetRelations(ctx, roomID, eventID, &reqCopy)
+		if err != nil {
+			return nil, "", err
+		}
+		return resp.Chunk, resp.NextBatch, nil
+	})
+}
+
+// ThreadsPaginator returns a [Paginator] that fetches all thread roots in the
+// given room using [Client.GetThreads], following next_batch until there are
+// no more pages. The From field of the request is used as the starting point.
+func (cli *Client) ThreadsPaginator(roomID id.RoomID, req *ReqGetThreads) *Paginator[*event.Event] {
+	var reqCopy ReqGetThreads
+	if req != nil {
+		reqCopy = *req
+	}
+	return NewPaginator(reqCopy.From, func(ctx context.Context, from string) ([]*event.Event, string, error) {
+		reqCopy.From = from
+		resp, err := cli.GetThreads(ctx, roomID, &reqCopy)
+		if err != nil {
+			return nil, "", err
+		}
+		return resp.Chunk, resp.NextBatch, nil
+	})
+}
+
+// Search performs a server-side search. The nextBatch parameter is the
+// pagination token from a previous response, or empty for the first page.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3search
+func (cli *Client) Search(ctx context.Context, req *ReqSearch, nextBatch string) (resp *RespSearch, err error) {
+	query := map[string]string{}
+	if nextBatch != "" {
+		query["next_batch"] = nextBatch
+	}
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "search"}, query)
+	_, err = cli.MakeRequest(ctx, http.MethodPost, urlPath, req, &resp)
+	return
+}
+
+// SearchRoomEvents returns a [Paginator] that fetches all room event search
+// results for the given criteria using [Client.Search], following next_batch
+// until there are no more pages.
+func (cli *Client) SearchRoomEvents(criteria *ReqSearchRoomEvents) *Paginator[*SearchResult] {
+	req := &ReqSearch{SearchCategories: ReqSearchCategories{RoomEvents: criteria}}
+	return NewPaginator("", func(ctx context.Context, from string) ([]*SearchResult, string, error) {
+		resp, err := cli.Search(ctx, req, from)
+		if err != nil {
+			return nil, "", err
+		} else if resp.SearchCategories.RoomEvents == nil {
+			return nil, "", nil
+		}
+		return resp.SearchCategories.RoomEvents.Results, resp.SearchCategories.RoomEvents.NextBatch, nil
+	})
+}
+
 // TimestampToEvent finds the ID of the event closest to the given timestamp.
 //
 // See https://spec.matrix.org/v1.6/client-server-api/#get_matrixclientv1roomsroomidtimestamp_to_event
@@ -2040,6 +2356,91 @@ func (cli *Client) DeleteAlias(ctx context.Context, alias id.RoomAlias) (resp *R
 	return
 }
 
+// GetRoomDirectoryVisibility returns whether the given room is published in
+// the room directory of the server.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv3directorylistroomroomid
+func (cli *Client) GetRoomDirectoryVisibility(ctx context.Context, roomID id.RoomID) (resp *RespRoomDirectoryVisibility, err error) {
+	urlPath := cli.BuildClientURL("v3", "directory", "list", "room", roomID)
+	_, err = cli.MakeRequest(ctx, http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
+// SetRoomDirectoryVisibility publishes the given room in the room directory of
+// the server, or removes it from the directory.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#put_matrixclientv3directorylistroomroomid
+func (cli *Client) SetRoomDirectoryVisibility(ctx context.Context, roomID id.RoomID, visibility RoomDirectoryVisibility) (err error) {
+	urlPath := cli.BuildClientURL("v3", "directory", "list", "room", roomID)
+	_, err = cli.MakeRequest(ctx, http.MethodPut, urlPath, &ReqSetRoomDirectoryVisibility{Visibility: visibility}, nil)
+	return
+}
+
+// SetAppserviceRoomDirectoryVisibility publishes the given room in the room
+// directory of the server under the given third party network, or removes it
+// from the directory. This can only be used by application services.
+//
+// See https://spec.matrix.org/v1.12/application-service-api/#put_matrixclientv3directorylistappservicenetworkidroomid
+func (cli *Client) SetAppserviceRoomDirectoryVisibility(ctx context.Context, networkID string, roomID id.RoomID, visibility RoomDirectoryVisibility) (err error) {
+	urlPath := cli.BuildClientURL("v3", "directory", "list", "appservice", networkID, roomID)
+	_, err = cli.MakeRequest(ctx, http.MethodPut, urlPath, &ReqSetRoomDirectoryVisibility{Visibility: visibility}, nil)
+	return
+}
+
+// PublicRooms lists the rooms in the public room directory of a server. Only
+// the server, limit and since fields of the request are used. To filter the
+// results, use [Client.SearchPublicRooms].
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv3publicrooms
+func (cli *Client) PublicRooms(ctx context.Context, req *ReqPublicRooms) (resp *RespPublicRooms, err error) {
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "publicRooms"}, req.Query())
+	_, err = cli.MakeRequest(ctx, http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
+// SearchPublicRooms lists the rooms in the public room directory of a server
+// with optional filters and third party network selection.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3publicrooms
+func (cli *Client) SearchPublicRooms(ctx context.Context, req *ReqPublicRooms) (resp *RespPublicRooms, err error) {
+	if req == nil {
+		req = &ReqPublicRooms{}
+	}
+	query := map[string]string{}
+	if req.Server != "" {
+		query["server"] = req.Server
+	}
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "publicRooms"}, query)
+	_, err = cli.MakeRequest(ctx, http.MethodPost, urlPath, req, &resp)
+	return
+}
+
+// PublicRoomsPaginator returns a [Paginator] that fetches all rooms in the
+// public room directory, following next_batch until there are no more pages.
+// [Client.SearchPublicRooms] is used if the request has filters, otherwise
+// [Client.PublicRooms] is used. The Since field of the request is used as the
+// starting point.
+func (cli *Client) PublicRoomsPaginator(req *ReqPublicRooms) *Paginator[*PublicRoomsChunk] {
+	var reqCopy ReqPublicRooms
+	if req != nil {
+		reqCopy = *req
+	}
+	return NewPaginator(reqCopy.Since, func(ctx context.Context, from string) ([]*PublicRoomsChunk, string, error) {
+		reqCopy.Since = from
+		var resp *RespPublicRooms
+		var err error
+		if reqCopy.NeedsPost() {
+			resp, err = cli.SearchPublicRooms(ctx, &reqCopy)
+		} else {
+			resp, err = cli.PublicRooms(ctx, &reqCopy)
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		return resp.Chunk, resp.NextBatch, nil
+	})
+}
+
 func (cli *Client) GetAliases(ctx context.Context, roomID id.RoomID) (resp *RespAliasList, err error) {
 	urlPath := cli.BuildClientURL("v3", "rooms", roomID, "aliases")
 	_, err = cli.MakeRequest(ctx, http.MethodGet, urlPath, nil, &resp)
@@ -2249,45 +2650,225 @@ func (cli *Client) SetDeviceInfo(ctx context.Context, deviceID id.DeviceID, req
 	return err
 }
 
+// DeleteDevice deletes the given device and invalidates its access token.
+// The endpoint requires user-interactive authentication, so the Auth field of the request should be set.
+// See DeleteDeviceWithUIA for completing the auth flow with a callback.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#delete_matrixclientv3devicesdeviceid
 func (cli *Client) DeleteDevice(ctx context.Context, deviceID id.DeviceID, req *ReqDeleteDevice) error {
-	urlPath := cli.BuildClientURL("v3", "devices", deviceID)
-	_, err := cli.MakeRequest(ctx, http.MethodDelete, urlPath, req, nil)
+	return cli.DeleteDeviceWithUIA(ctx, deviceID, req, nil)
+}
+
+// DeleteDeviceWithUIA deletes the given device like DeleteDevice, but completes the user-interactive
+// auth flow with the given callback (see MakeUIARequest).
+func (cli *Client) DeleteDeviceWithUIA(ctx context.Context, deviceID id.DeviceID, req *ReqDeleteDevice, uiaCallback UIACallback) error {
+	if req == nil {
+		req = &ReqDeleteDevice{}
+	}
+	_, err := cli.MakeUIARequest(ctx, FullRequest{
+		Method:           http.MethodDelete,
+		URL:              cli.BuildClientURL("v3", "devices", deviceID),
+		RequestJSON:      req,
+		SensitiveContent: req.Auth != nil,
+	}, func(auth interface{}) { req.Auth = auth }, uiaCallback)
 	return err
 }
 
+// DeleteDevices deletes the given devices and invalidates their access tokens.
+// The endpoint requires user-interactive authentication, so the Auth field of the request should be set.
+// See DeleteDevicesWithUIA for completing the auth flow with a callback.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3delete_devices
 func (cli *Client) DeleteDevices(ctx context.Context, req *ReqDeleteDevices) error {
-	urlPath := cli.BuildClientURL("v3", "delete_devices")
-	_, err := cli.MakeRequest(ctx, http.MethodDelete, urlPath, req, nil)
+	return cli.DeleteDevicesWithUIA(ctx, req, nil)
+}
+
+// DeleteDevicesWithUIA deletes the given devices like DeleteDevices, but completes the user-interactive
+// auth flow with the given callback (see MakeUIARequest).
+func (cli *Client) DeleteDevicesWithUIA(ctx context.Context, req *ReqDeleteDevices, uiaCallback UIACallback) error {
+	if req == nil {
+		req = &ReqDeleteDevices{}
+	}
+	_, err := cli.MakeUIARequest(ctx, FullRequest{
+		Method:           http.MethodPost,
+		URL:              cli.BuildClientURL("v3", "delete_devices"),
+		RequestJSON:      req,
+		SensitiveContent: req.Auth != nil,
+	}, func(auth interface{}) { req.Auth = auth }, uiaCallback)
 	return err
 }
 
 type UIACallback = func(*RespUserInteractive) interface{}
 
+// maxUIARounds is the maximum number of times MakeUIARequest retries a request
+// with new auth data.
+const maxUIARounds = 16
+
+// MakeUIARequest makes a request to an endpoint that may require user-interactive authentication.
+//
+// If the server responds with a UIA response and uiaCallback is set, the callback is called with the
+// UI auth parameters and the request is retried with the auth data it returns (passed to setAuth).
+// This is repeated until the request succeeds or the callback returns nil. The callback is also
+// called for subsequent stages of multi-stage flows, so it should use the Completed list and
+// the Session from the response. If the callback returns an error, the flow is aborted and the
+// error is returned. If the server rejects the submitted auth data or the retry doesn't complete
+// any new stage, the flow is aborted too, so rejected credentials are only ever submitted once.
+//
+// See [UIAuthenticator] for a callback implementation that handles the common stages.
+func (cli *Client) MakeUIARequest(ctx context.Context, params FullRequest, setAuth func(auth interface{}), uiaCallback UIACallback) ([]byte, error) {
+	prevCompleted := -1
+	for i := 0; ; i++ {
+		content, err := cli.MakeFullRequest(ctx, params)
+		var httpErr HTTPError
+		if uiaCallback == nil || i >= maxUIARounds || !errors.As(err, &httpErr) || !httpErr.IsStatus(http.StatusUnauthorized) {
+			return content, err
+		}
+		var uiAuthResp RespUserInteractive
+		if jsonErr := json.Unmarshal(content, &uiAuthResp); jsonErr != nil || len(uiAuthResp.Flows) == 0 {
+			// Not a UIA response, e.g. an invalid access token
+			return content, err
+		} else if i > 0 && (uiAuthResp.ErrCode != "" || len(uiAuthResp.Completed) <= prevCompleted) {
+			// The server rejected the previous auth data, don't resubmit it
+			return content, err
+		}
+		prevCompleted = len(uiAuthResp.Completed)
+		auth := uiaCallback(&uiAuthResp)
+		if auth == nil {
+			return content, err
+		} else if callbackErr, ok := auth.(error); ok {
+			return content, callbackErr
+		}
+		setAuth(auth)
+		params.SensitiveContent = true
+	}
+}
+
 // UploadCrossSigningKeys uploads the given cross-signing keys to the server.
 // Because the endpoint requires user-interactive authentication a callback must be provided that,
 // given the UI auth parameters, produces the required result (or nil to end the flow).
 func (cli *Client) UploadCrossSigningKeys(ctx context.Context, keys *UploadCrossSigningKeysReq, uiaCallback UIACallback) error {
-	content, err := cli.MakeFullRequest(ctx, FullRequest{
+	_, err := cli.MakeUIARequest(ctx, FullRequest{
 		Method:           http.MethodPost,
 		URL:              cli.BuildClientURL("v3", "keys", "device_signing", "upload"),
 		RequestJSON:      keys,
 		SensitiveContent: keys.Auth != nil,
+	}, func(auth interface{}) { keys.Auth = auth }, uiaCallback)
+	return err
+}
+
+// ChangePassword changes the password of the current user.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3accountpassword
+func (cli *Client) ChangePassword(ctx context.Context, req *ReqChangePassword, uiaCallback UIACallback) error {
+	_, err := cli.MakeUIARequest(ctx, FullRequest{
+		Method:           http.MethodPost,
+		URL:              cli.BuildClientURL("v3", "account", "password"),
+		RequestJSON:      req,
+		SensitiveContent: true,
+	}, func(auth interface{}) { req.Auth = auth }, uiaCallback)
+	return err
+}
+
+// DeactivateAccount permanently deactivates the current user's account.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3accountdeactivate
+func (cli *Client) DeactivateAccount(ctx context.Context, req *ReqDeactivateAccount, uiaCallback UIACallback) (resp *RespDeactivateAccount, err error) {
+	_, err = cli.MakeUIARequest(ctx, FullRequest{
+		Method:           http.MethodPost,
+		URL:              cli.BuildClientURL("v3", "account", "deactivate"),
+		RequestJSON:      req,
+		ResponseJSON:     &resp,
+		SensitiveContent: req.Auth != nil,
+	}, func(auth interface{}) { req.Auth = auth }, uiaCallback)
+	return
+}
+
+// Get3PIDs returns the third party identifiers that are associated with the current user's account.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv3account3pid
+func (cli *Client) Get3PIDs(ctx context.Context) (resp *RespGet3PIDs, err error) {
+	urlPath := cli.BuildClientURL("v3", "account", "3pid")
+	_, err = cli.MakeRequest(ctx, http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
+// Add3PID adds a validated third party identifier to the current user's account.
+// The identifier must first be validated with RequestEmailToken or RequestMSISDNToken.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3account3pidadd
+func (cli *Client) Add3PID(ctx context.Context, req *ReqAdd3PID, uiaCallback UIACallback) error {
+	_, err := cli.MakeUIARequest(ctx, FullRequest{
+		Method:           http.MethodPost,
+		URL:              cli.BuildClientURL("v3", "account", "3pid", "add"),
+		RequestJSON:      req,
+		SensitiveContent: true,
+	}, func(auth interface{}) { req.Auth = auth }, uiaCallback)
+	return err
+}
+
+// Bind3PID binds a validated third party identifier to the current user on an identity server.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3account3pidbind
+func (cli *Client) Bind3PID(ctx context.Context, req *ReqBind3PID) error {
+	_, err := cli.MakeFullRequest(ctx, FullRequest{
+		Method:           http.MethodPost,
+		URL:              cli.BuildClientURL("v3", "account", "3pid", "bind"),
+		RequestJSON:      req,
+		SensitiveContent: true,
 	})
-	if respErr, ok := err.(HTTPError); ok && respErr.IsStatus(http.StatusUnauthorized) && uiaCallback != nil {
-		// try again with UI auth
-		var uiAuthResp RespUserInteractive
-		if err := json.Unmarshal(content, &uiAuthResp); err != nil {
-			return fmt.Errorf("failed to decode UIA response: %w", err)
-		}
-		auth := uiaCallback(&uiAuthResp)
-		if auth != nil {
-			keys.Auth = auth
-			return cli.UploadCrossSigningKeys(ctx, keys, nil)
-		}
-	}
 	return err
 }
 
+// Delete3PID removes a third party identifier from the current user's account.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3account3piddelete
+func (cli *Client) Delete3PID(ctx context.Context, req *ReqDelete3PID) (resp *RespDelete3PID, err error) {
+	urlPath := cli.BuildClientURL("v3", "account", "3pid", "delete")
+	_, err = cli.MakeRequest(ctx, http.MethodPost, urlPath, req, &resp)
+	return
+}
+
+// Unbind3PID removes a third party identifier binding from an identity server
+// without removing it from the current user's account.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3account3pidunbind
+func (cli *Client) Unbind3PID(ctx context.Context, req *ReqDelete3PID) (resp *RespDelete3PID, err error) {
+	urlPath := cli.BuildClientURL("v3", "account", "3pid", "unbind")
+	_, err = cli.MakeRequest(ctx, http.MethodPost, urlPath, req, &resp)
+	return
+}
+
+func requestTokenPath(purpose RequestTokenPurpose, medium ThreePIDMedium) ClientURLPath {
+	switch purpose {
+	case RequestTokenRegister:
+		return ClientURLPath{"v3", "register", medium, "requestToken"}
+	case RequestTokenPassword:
+		return ClientURLPath{"v3", "account", "password", medium, "requestToken"}
+	default:
+		return ClientURLPath{"v3", "account", "3pid", medium, "requestToken"}
+	}
+}
+
+// RequestEmailToken asks the server to send a validation token to the given email address.
+// The purpose determines whether the token is used for registration, adding a 3PID or resetting the password.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3account3pidemailrequesttoken
+func (cli *Client) RequestEmailToken(ctx context.Context, purpose RequestTokenPurpose, req *ReqRequestEmailToken) (resp *RespRequestToken, err error) {
+	urlPath := cli.BuildURL(requestTokenPath(purpose, ThreePIDMediumEmail))
+	_, err = cli.MakeRequest(ctx, http.MethodPost, urlPath, req, &resp)
+	return
+}
+
+// RequestMSISDNToken asks the server to send a validation token to the given phone number.
+// The purpose determines whether the token is used for registration, adding a 3PID or resetting the password.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3account3pidmsisdnrequesttoken
+func (cli *Client) RequestMSISDNToken(ctx context.Context, purpose RequestTokenPurpose, req *ReqRequestMSISDNToken) (resp *RespRequestToken, err error) {
+	urlPath := cli.BuildURL(requestTokenPath(purpose, ThreePIDMediumMSISDN))
+	_, err = cli.MakeRequest(ctx, http.MethodPost, urlPath, req, &resp)
+	return
+}
+
 func (cli *Client) UploadSignatures(ctx context.Context, req *ReqUploadSignatures) (resp *RespUploadSignatures, err error) {
 	urlPath := cli.BuildClientURL("v3", "keys", "signatures", "upload")
 	_, err = cli.MakeRequest(ctx, http.MethodPost, urlPath, req, &resp)
@@ -2336,6 +2917,60 @@ func (cli *Client) PutPushRule(ctx context.Context, scope string, kind pushrules
 	return err
 }
 
+// GetNotifications returns the events that the user has been notified about.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv3notifications
+func (cli *Client) GetNotifications(ctx context.Context, req *ReqGetNotifications) (resp *RespGetNotifications, err error) {
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "notifications"}, req.Query())
+	_, err = cli.MakeRequest(ctx, http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
+// NotificationsPaginator returns a [Paginator] that fetches all notifications
+// using [Client.GetNotifications], following next_token until there are no
+// more pages. The From field of the request is used as the starting point.
+func (cli *Client) NotificationsPaginator(req *ReqGetNotifications) *Paginator[*Notification] {
+	var reqCopy ReqGetNotifications
+	if req != nil {
+		reqCopy = *req
+	}
+	return NewPaginator(reqCopy.From, func(ctx context.Context, from string) ([]*Notification, string, error) {
+		reqCopy.From = from
+		resp, err := cli.GetNotifications(ctx, &reqCopy)
+		if err != nil {
+			return nil, "", err
+		}
+		return resp.Notifications, resp.NextToken, nil
+	})
+}
+
+// GetPushers returns the pushers that are active for the current user.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv3pushers
+func (cli *Client) GetPushers(ctx context.Context) (resp *RespGetPushers, err error) {
+	urlPath := cli.BuildClientURL("v3", "pushers")
+	_, err = cli.MakeRequest(ctx, http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
+// SetPusher creates or updates a pusher for the current user.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3pushersset
+func (cli *Client) SetPusher(ctx context.Context, req *ReqSetPusher) error {
+	urlPath := cli.BuildClientURL("v3", "pushers", "set")
+	_, err := cli.MakeRequest(ctx, http.MethodPost, urlPath, req, nil)
+	return err
+}
+
+// DeletePusher deletes the pusher with the given app ID and pushkey.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3pushersset
+func (cli *Client) DeletePusher(ctx context.Context, appID, pushkey string) error {
+	urlPath := cli.BuildClientURL("v3", "pushers", "set")
+	_, err := cli.MakeRequest(ctx, http.MethodPost, urlPath, &ReqDeletePusher{AppID: appID, Pushkey: pushkey}, nil)
+	return err
+}
+
 func (cli *Client) ReportEvent(ctx context.Context, roomID id.RoomID, eventID id.EventID, reason string) error {
 	urlPath := cli.BuildClientURL("v3", "rooms", roomID, "report", eventID)
 	_, err := cli.MakeRequest(ctx, http.MethodPost, urlPath, &ReqReport{Reason: reason, Score: -100}, nil)
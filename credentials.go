@@ -0,0 +1,221 @@
+package mautrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/De-IM/mautrix/id"
+)
+
+// DefaultTokenRefreshMargin is the default time before the expiry of the access token
+// when the token is refreshed proactively.
+const DefaultTokenRefreshMargin = 1 * time.Minute
+
+var ErrNoRefreshToken = errors.New("client doesn't have a refresh token")
+
+// Credentials contains the tokens of a logged-in device.
+type Credentials struct {
+	UserID       id.UserID   `json:"user_id"`
+	DeviceID     id.DeviceID `json:"device_id"`
+	AccessToken  string      `json:"access_token"`
+	RefreshToken string      `json:"refresh_token,omitempty"`
+	// ExpiresAt is the time when the access token expires. Zero if the token doesn't expire.
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+// CredentialsStore persists the credentials of a client, so that rotated refresh tokens
+// survive restarts. The credentials are saved after login and after every token refresh.
+type CredentialsStore interface {
+	GetCredentials(ctx context.Context) (*Credentials, error)
+	PutCredentials(ctx context.Context, creds *Credentials) error
+}
+
+// MemoryCredentialsStore is a simple in-memory CredentialsStore.
+type MemoryCredentialsStore struct {
+	creds *Credentials
+	lock  sync.RWMutex
+}
+
+var _ CredentialsStore = (*MemoryCredentialsStore)(nil)
+
+func NewMemoryCredentialsStore() *MemoryCredentialsStore {
+	return &MemoryCredentialsStore{}
+}
+
+func (store *MemoryCredentialsStore) GetCredentials(_ context.Context) (*Credentials, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	if store.creds == nil {
+		return nil, nil
+	}
+	creds := *store.creds
+	return &creds, nil
+}
+
+func (store *MemoryCredentialsStore) PutCredentials(_ context.Context, creds *Credentials) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	credsCopy := *creds
+	store.creds = &credsCopy
+	return nil
+}
+
+// Credentials returns the current credentials of the client.
+func (cli *Client) Credentials() *Credentials {
+	cli.credsLock.RLock()
+	defer cli.credsLock.RUnlock()
+	return &Credentials{
+		UserID:       cli.UserID,
+		DeviceID:     cli.DeviceID,
+		AccessToken:  cli.AccessToken,
+		RefreshToken: cli.RefreshToken,
+		ExpiresAt:    cli.AccessTokenExpiresAt,
+	}
+}
+
+// SetFullCredentials sets the user ID, device ID and tokens on this client instance.
+func (cli *Client) SetFullCredentials(creds *Credentials) {
+	cli.credsLock.Lock()
+	defer cli.credsLock.Unlock()
+	cli.UserID = creds.UserID
+	cli.DeviceID = creds.DeviceID
+	cli.AccessToken = creds.AccessToken
+	cli.RefreshToken = creds.RefreshToken
+	cli.AccessTokenExpiresAt = creds.ExpiresAt
+}
+
+// LoadCredentials loads the credentials from the CredentialsStore of the client.
+// It returns false if the store doesn't have credentials.
+func (cli *Client) LoadCredentials(ctx context.Context) (bool, error) {
+	if cli.CredentialsStore == nil {
+		return false, nil
+	}
+	creds, err := cli.CredentialsStore.GetCredentials(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to get credentials from store: %w", err)
+	} else if creds == nil {
+		return false, nil
+	}
+	cli.SetFullCredentials(creds)
+	return true, nil
+}
+
+func (cli *Client) saveCredentials(ctx context.Context) {
+	if cli.CredentialsStore == nil {
+		return
+	}
+	err := cli.CredentialsStore.PutCredentials(ctx, cli.Credentials())
+	if err != nil {
+		cli.Log.Err(err).Msg("Failed to save credentials")
+	}
+}
+
+func (cli *Client) tokenRefreshMargin() time.Duration {
+	if cli.TokenRefreshMargin > 0 {
+		return cli.TokenRefreshMargin
+	}
+	return DefaultTokenRefreshMargin
+}
+
+// getAccessToken returns the access token to use for a request, refreshing it first if it's about to expire.
+func (cli *Client) getAccessToken(ctx context.Context) string {
+	cli.credsLock.RLock()
+	accessToken, refreshToken, expiresAt := cli.AccessToken, cli.RefreshToken, cli.AccessTokenExpiresAt
+	cli.credsLock.RUnlock()
+	if refreshToken == "" || expiresAt.IsZero() || time.Until(expiresAt) > cli.tokenRefreshMargin() {
+		return accessToken
+	}
+	err := cli.refreshAccessToken(ctx, accessToken)
+	if err != nil {
+		// The request is still attempted with the old token, which may fail and trigger another refresh
+		cli.cliOrContextLog(ctx).Warn().Err(err).Msg("Failed to proactively refresh access token")
+		return accessToken
+	}
+	cli.credsLock.RLock()
+	defer cli.credsLock.RUnlock()
+	return cli.AccessToken
+}
+
+// RefreshAccessToken uses the refresh token of the client to get a new access token.
+// The new tokens are stored in the client and saved in the CredentialsStore.
+//
+// The client refreshes the token automatically when it's about to expire or when the server
+// returns a soft logout error, so this doesn't normally need to be called manually.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3refresh
+func (cli *Client) RefreshAccessToken(ctx context.Context) error {
+	cli.credsLock.RLock()
+	accessToken := cli.AccessToken
+	cli.credsLock.RUnlock()
+	return cli.refreshAccessToken(ctx, accessToken)
+}
+
+// refreshAccessToken refreshes the access token unless it has already been changed from staleToken.
+// Only one refresh runs at a time: concurrent callers wait for the ongoing refresh and then
+// notice that the token was already replaced.
+func (cli *Client) refreshAccessToken(ctx context.Context, staleToken string) error {
+	cli.refreshLock.Lock()
+	defer cli.refreshLock.Unlock()
+	cli.credsLock.RLock()
+	accessToken, refreshToken := cli.AccessToken, cli.RefreshToken
+	cli.credsLock.RUnlock()
+	if accessToken != staleToken {
+		return nil
+	} else if refreshToken == "" {
+		return ErrNoRefreshToken
+	}
+	refresher := cli.TokenRefresher
+	if refresher == nil {
+		refresher = cli.refreshWithMatrixAPI
+	}
+	resp, err := refresher(ctx, refreshToken)
+	if err != nil {
+		return fmt.Errorf("failed to refresh access token: %w", err)
+	}
+	cli.credsLock.Lock()
+	cli.AccessToken = resp.AccessToken
+	if resp.RefreshToken != "" {
+		cli.RefreshToken = resp.RefreshToken
+	}
+	expiresAt := expiryFromMS(resp.ExpiresInMS)
+	cli.AccessTokenExpiresAt = expiresAt
+	cli.credsLock.Unlock()
+	cli.cliOrContextLog(ctx).Debug().
+		Time("expires_at", expiresAt).
+		Msg("Refreshed access token")
+	cli.saveCredentials(ctx)
+	return nil
+}
+
+func (cli *Client) refreshWithMatrixAPI(ctx context.Context, refreshToken string) (resp *RespRefresh, err error) {
+	_, err = cli.MakeFullRequest(context.WithValue(ctx, unauthenticatedContextKey, true), FullRequest{
+		Method:           http.MethodPost,
+		URL:              cli.BuildClientURL("v3", "refresh"),
+		RequestJSON:      &ReqRefresh{RefreshToken: refreshToken},
+		ResponseJSON:     &resp,
+		SensitiveContent: true,
+	})
+	return
+}
+
+func expiryFromMS(expiresInMS int64) time.Time {
+	if expiresInMS <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(expiresInMS) * time.Millisecond)
+}
+
+// isSoftLogout checks if the error is an M_UNKNOWN_TOKEN error with soft_logout set,
+// which means the session can be recovered by refreshing the access token.
+func isSoftLogout(err error) bool {
+	var httpErr HTTPError
+	if !errors.As(err, &httpErr) || httpErr.RespError == nil || !errors.Is(*httpErr.RespError, MUnknownToken) {
+		return false
+	}
+	softLogout, _ := httpErr.RespError.ExtraData["soft_logout"].(bool)
+	return softLogout
+}
@@ -209,6 +209,7 @@ func (helper *CryptoHelper) Init(ctx context.Context) error {
 		syncer.OnEventType(event.StateMember, helper.mach.HandleMemberEvent)
 		if _, ok = helper.client.Syncer.(mautrix.DispatchableSyncer); ok {
 			syncer.OnEventType(event.EventEncrypted, helper.HandleEncrypted)
+			helper.mach.DecryptedToDeviceReceived = helper.postDecrypt
 		} else {
 			helper.log.Warn().Msg("Client syncer does not implement DispatchableSyncer. Events will not be decrypted automatically.")
 		}
@@ -218,6 +219,7 @@ func (helper *CryptoHelper) Init(ctx context.Context) error {
 	} else if helper.ASEventProcessor != nil {
 		helper.mach.AddAppserviceListener(helper.ASEventProcessor)
 		helper.ASEventProcessor.On(event.EventEncrypted, helper.HandleEncrypted)
+		helper.mach.DecryptedToDeviceReceived = helper.postDecrypt
 	}
 
 	if helper.client.SetAppServiceDeviceID {
@@ -400,6 +402,17 @@ func (helper *CryptoHelper) Encrypt(ctx context.Context, roomID id.RoomID, evtTy
 	return helper.EncryptWithStateKey(ctx, roomID, evtType, nil, content)
 }
 
+// EncryptToUserDevices encrypts a to-device event with Olm for the given
+// devices of a user. See [crypto.OlmMachine.EncryptToUserDevices] for details.
+func (helper *CryptoHelper) EncryptToUserDevices(ctx context.Context, userID id.UserID, deviceIDs []id.DeviceID, evtType event.Type, content event.Content) (map[id.DeviceID]*event.Content, error) {
+	if helper == nil {
+		return nil, fmt.Errorf("crypto helper is nil")
+	}
+	helper.lock.RLock()
+	defer helper.lock.RUnlock()
+	return helper.mach.EncryptToUserDevices(ctx, userID, deviceIDs, evtType, content)
+}
+
 func (helper *CryptoHelper) EncryptWithStateKey(ctx context.Context, roomID id.RoomID, evtType event.Type, stateKey *string, content any) (encrypted *event.EncryptedEventContent, err error) {
 	if helper == nil {
 		return nil, fmt.Errorf("crypto helper is nil")
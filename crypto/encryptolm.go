@@ -57,6 +57,66 @@ func (mach *OlmMachine) encryptOlmEvent(ctx context.Context, session *OlmSession
 	}
 }
 
+// EncryptToUserDevices encrypts the given event with Olm for the given devices
+// of the user. If no device IDs are given, the event is encrypted for all known
+// devices of the user except the current device. The returned map can be used
+// directly as the messages of a m.room.encrypted to-device request.
+//
+// Devices that no Olm session could be established with are skipped.
+func (mach *OlmMachine) EncryptToUserDevices(ctx context.Context, userID id.UserID, deviceIDs []id.DeviceID, evtType event.Type, content event.Content) (map[id.DeviceID]*event.Content, error) {
+	devices, err := mach.CryptoStore.GetDevices(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get devices of %s: %w", userID, err)
+	} else if len(devices) == 0 {
+		devices = mach.LoadDevices(ctx, userID)
+	}
+	targets := make(map[id.DeviceID]*id.Device)
+	if len(deviceIDs) == 0 {
+		for deviceID, device := range devices {
+			if !device.Deleted && (userID != mach.Client.UserID || deviceID != mach.Client.DeviceID) {
+				targets[deviceID] = device
+			}
+		}
+	} else {
+		for _, deviceID := range deviceIDs {
+			device, ok := devices[deviceID]
+			if !ok || device.Deleted {
+				device, err = mach.GetOrFetchDevice(ctx, userID, deviceID)
+				if err != nil {
+					return nil, err
+				}
+			}
+			targets[deviceID] = device
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("didn't find any devices of %s to encrypt for", userID)
+	}
+	err = mach.createOutboundSessions(ctx, map[id.UserID]map[id.DeviceID]*id.Device{userID: targets})
+	if err != nil {
+		return nil, err
+	}
+
+	mach.olmLock.Lock()
+	defer mach.olmLock.Unlock()
+	log := mach.machOrContextLog(ctx)
+	output := make(map[id.DeviceID]*event.Content, len(targets))
+	for deviceID, device := range targets {
+		olmSess, err := mach.CryptoStore.GetLatestSession(ctx, device.IdentityKey)
+		if err != nil {
+			return nil, err
+		} else if olmSess == nil {
+			log.Warn().
+				Str("target_user_id", userID.String()).
+				Str("target_device_id", deviceID.String()).
+				Msg("No olm session with device, skipping it")
+			continue
+		}
+		output[deviceID] = &event.Content{Parsed: mach.encryptOlmEvent(ctx, olmSess, device, evtType, content)}
+	}
+	return output, nil
+}
+
 func (mach *OlmMachine) shouldCreateNewSession(ctx context.Context, identityKey id.IdentityKey) bool {
 	if !mach.CryptoStore.HasSession(ctx, identityKey) {
 		return true
@@ -56,6 +56,9 @@ type OlmMachine struct {
 
 	// Optional callback which is called when we save a session to store
 	SessionReceived func(context.Context, id.RoomID, id.SessionID, uint32)
+	// Optional callback which is called with decrypted to-device events that the
+	// machine doesn't handle itself, such as ephemeral messages.
+	DecryptedToDeviceReceived func(context.Context, *event.Event)
 
 	devicesToUnwedge     map[id.IdentityKey]bool
 	devicesToUnwedgeLock sync.Mutex
@@ -307,7 +310,9 @@ func (mach *OlmMachine) ProcessSyncResponse(ctx context.Context, resp *mautrix.R
 		mach.HandleToDeviceEvent(ctx, evt)
 	}
 
-	mach.HandleOTKCounts(ctx, &resp.DeviceOTKCount)
+	if !resp.NoOTKCount {
+		mach.HandleOTKCounts(ctx, &resp.DeviceOTKCount)
+	}
 	return true
 }
 
@@ -391,7 +396,29 @@ func (mach *OlmMachine) HandleEncryptedEvent(ctx context.Context, evt *event.Eve
 		mach.receiveSecret(ctx, decryptedEvt, decryptedContent)
 		log.Trace().Msg("Handled secret send event")
 	default:
-		log.Debug().Msg("Unhandled encrypted to-device event")
+		if mach.DecryptedToDeviceReceived != nil {
+			// The Olm session identifies the sending device, unlike the sender_device field
+			senderDevice, err := mach.CryptoStore.FindDeviceByKey(ctx, decryptedEvt.Sender, decryptedEvt.SenderKey)
+			if err != nil {
+				log.Warn().Err(err).Msg("Failed to find sender device of decrypted to-device event")
+			}
+			mach.DecryptedToDeviceReceived(ctx, &event.Event{
+				Sender:     decryptedEvt.Sender,
+				Type:       decryptedEvt.Type,
+				Content:    decryptedEvt.Content,
+				ToUserID:   evt.ToUserID,
+				ToDeviceID: evt.ToDeviceID,
+				Mautrix: event.MautrixInfo{
+					EventSource:  evt.Mautrix.EventSource | event.SourceDecrypted,
+					WasEncrypted: true,
+					TrustSource:  senderDevice,
+					ReceivedAt:   evt.Mautrix.ReceivedAt,
+				},
+			})
+			log.Trace().Msg("Passed decrypted to-device event to handler")
+		} else {
+			log.Debug().Msg("Unhandled encrypted to-device event")
+		}
 	}
 }
 
@@ -0,0 +1,101 @@
+package verificationhelper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/De-IM/mautrix/id"
+)
+
+var (
+	ErrInvalidQRCodeHeader  = errors.New("invalid QR code header")
+	ErrUnknownQRCodeVersion = errors.New("invalid QR code version")
+	ErrInvalidQRCodeMode    = errors.New("invalid QR code mode")
+)
+
+type QRCodeMode byte
+
+const (
+	QRCodeModeCrossSigning                    QRCodeMode = 0x00
+	QRCodeModeSelfVerifyingMasterKeyTrusted   QRCodeMode = 0x01
+	QRCodeModeSelfVerifyingMasterKeyUntrusted QRCodeMode = 0x02
+)
+
+const qrCodeHeader = "MATRIX"
+const qrCodeVersion = 0x02
+
+// QRCode represents the data of a QR code used for verification as described
+// in [Section 11.12.2.4.1] of the Spec.
+//
+// [Section 11.12.2.4.1]: https://spec.matrix.org/v1.9/client-server-api/#qr-code-format
+type QRCode struct {
+	Mode          QRCodeMode
+	TransactionID id.VerificationTransactionID
+	Key1, Key2    [32]byte
+	SharedSecret  []byte
+}
+
+// NewQRCode creates a new [QRCode] with the given data.
+func NewQRCode(mode QRCodeMode, txnID id.VerificationTransactionID, key1, key2 [32]byte, sharedSecret []byte) *QRCode {
+	return &QRCode{
+		Mode:          mode,
+		TransactionID: txnID,
+		Key1:          key1,
+		Key2:          key2,
+		SharedSecret:  sharedSecret,
+	}
+}
+
+// NewQRCodeFromBytes parses the bytes from a QR code scan as defined in
+// [Section 11.12.2.4.1] of the Spec.
+//
+// [Section 11.12.2.4.1]: https://spec.matrix.org/v1.9/client-server-api/#qr-code-format
+func NewQRCodeFromBytes(data []byte) (*QRCode, error) {
+	if !bytes.HasPrefix(data, []byte(qrCodeHeader)) {
+		return nil, ErrInvalidQRCodeHeader
+	}
+	data = data[len(qrCodeHeader):]
+	if len(data) < 4 {
+		return nil, fmt.Errorf("%w: data is too short", ErrInvalidQRCodeHeader)
+	} else if data[0] != qrCodeVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownQRCodeVersion, data[0])
+	}
+	mode := QRCodeMode(data[1])
+	if mode > QRCodeModeSelfVerifyingMasterKeyUntrusted {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidQRCodeMode, mode)
+	}
+	txnIDLength := int(binary.BigEndian.Uint16(data[2:4]))
+	data = data[4:]
+	// The transaction ID is followed by two 32 byte keys and the shared
+	// secret, which must be at least 8 bytes long.
+	if len(data) < txnIDLength+64+8 {
+		return nil, fmt.Errorf("%w: data is too short", ErrInvalidQRCodeHeader)
+	}
+	qrCode := &QRCode{
+		Mode:          mode,
+		TransactionID: id.VerificationTransactionID(data[:txnIDLength]),
+		SharedSecret:  bytes.Clone(data[txnIDLength+64:]),
+	}
+	copy(qrCode.Key1[:], data[txnIDLength:txnIDLength+32])
+	copy(qrCode.Key2[:], data[txnIDLength+32:txnIDLength+64])
+	return qrCode, nil
+}
+
+// Bytes returns the bytes that should be encoded into the QR code image as
+// defined in [Section 11.12.2.4.1] of the Spec.
+//
+// [Section 11.12.2.4.1]: https://spec.matrix.org/v1.9/client-server-api/#qr-code-format
+func (q *QRCode) Bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(qrCodeHeader)
+	buf.WriteByte(qrCodeVersion)
+	buf.WriteByte(byte(q.Mode))
+	_ = binary.Write(&buf, binary.BigEndian, uint16(len(q.TransactionID)))
+	buf.WriteString(q.TransactionID.String())
+	buf.Write(q.Key1[:])
+	buf.Write(q.Key2[:])
+	buf.Write(q.SharedSecret)
+	return buf.Bytes()
+}
@@ -0,0 +1,239 @@
+package verificationhelper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mau.fi/util/random"
+
+	"github.com/De-IM/mautrix/event"
+	"github.com/De-IM/mautrix/id"
+)
+
+var ErrCrossSigningKeysNotFound = errors.New("cross-signing keys not found")
+
+// HandleScannedQRData verifies the keys from a scanned QR code and if they
+// are valid, sends the m.key.verification.start event to the other device
+// and trusts the keys that were verified.
+func (vh *VerificationHelper) HandleScannedQRData(ctx context.Context, data []byte) error {
+	qrCode, err := NewQRCodeFromBytes(data)
+	if err != nil {
+		return err
+	}
+	log := vh.getLog(ctx).With().
+		Str("verification_action", "handle scanned QR data").
+		Stringer("transaction_id", qrCode.TransactionID).
+		Int("mode", int(qrCode.Mode)).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	vh.activeTransactionsLock.Lock()
+	defer vh.unlockTransactions()
+	txn, ok := vh.activeTransactions[qrCode.TransactionID]
+	if !ok {
+		return ErrUnknownTransaction
+	} else if txn.VerificationState != verificationStateReady {
+		return fmt.Errorf("%w: %s", ErrUnexpectedState, txn.VerificationState)
+	}
+
+	ownKeys := vh.mach.GetOwnCrossSigningPublicKeys(ctx)
+	if ownKeys == nil {
+		return ErrCrossSigningKeysNotFound
+	}
+
+	// Verify the keys that the other device encoded into the QR code.
+	switch qrCode.Mode {
+	case QRCodeModeCrossSigning:
+		theirKeys, err := vh.mach.GetCrossSigningPublicKeys(ctx, txn.TheirUser)
+		if err != nil {
+			return fmt.Errorf("failed to get cross-signing keys of %s: %w", txn.TheirUser, err)
+		} else if theirKeys == nil {
+			return fmt.Errorf("%w for %s", ErrCrossSigningKeysNotFound, txn.TheirUser)
+		}
+		if !bytes.Equal(qrCode.Key1[:], theirKeys.MasterKey.Bytes()) {
+			vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeKeyMismatch, "the other user's master key in the QR code doesn't match")
+			return fmt.Errorf("their master key doesn't match")
+		} else if !bytes.Equal(qrCode.Key2[:], ownKeys.MasterKey.Bytes()) {
+			vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeKeyMismatch, "our master key in the QR code doesn't match")
+			return fmt.Errorf("our master key doesn't match")
+		}
+	case QRCodeModeSelfVerifyingMasterKeyTrusted:
+		// The other device trusts the master key, so the QR code contains
+		// the master key and our device key.
+		if txn.TheirUser != vh.client.UserID {
+			vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeUserMismatch, "self-verification QR code used to verify another user")
+			return fmt.Errorf("self-verification QR code used to verify %s", txn.TheirUser)
+		} else if !bytes.Equal(qrCode.Key1[:], ownKeys.MasterKey.Bytes()) {
+			vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeKeyMismatch, "the master key in the QR code doesn't match")
+			return fmt.Errorf("master key doesn't match")
+		} else if !bytes.Equal(qrCode.Key2[:], vh.mach.OwnIdentity().SigningKey.Bytes()) {
+			vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeKeyMismatch, "our device key in the QR code doesn't match")
+			return fmt.Errorf("our device key doesn't match")
+		}
+	case QRCodeModeSelfVerifyingMasterKeyUntrusted:
+		// The other device doesn't trust the master key, so the QR code
+		// contains their device key and the master key.
+		if txn.TheirUser != vh.client.UserID {
+			vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeUserMismatch, "self-verification QR code used to verify another user")
+			return fmt.Errorf("self-verification QR code used to verify %s", txn.TheirUser)
+		}
+		theirDevice, err := vh.mach.GetOrFetchDevice(ctx, txn.TheirUser, txn.TheirDevice)
+		if err != nil {
+			return fmt.Errorf("failed to get their device: %w", err)
+		} else if !bytes.Equal(qrCode.Key1[:], theirDevice.SigningKey.Bytes()) {
+			vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeKeyMismatch, "the other device's key in the QR code doesn't match")
+			return fmt.Errorf("their device key doesn't match")
+		} else if !bytes.Equal(qrCode.Key2[:], ownKeys.MasterKey.Bytes()) {
+			vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeKeyMismatch, "the master key in the QR code doesn't match")
+			return fmt.Errorf("master key doesn't match")
+		}
+	}
+
+	log.Info().Msg("Keys in QR code match, sending reciprocate start event")
+	startEvt := &event.VerificationStartEventContent{
+		FromDevice: vh.client.DeviceID,
+		Method:     event.VerificationMethodReciprocate,
+		Secret:     qrCode.SharedSecret,
+	}
+	if err = vh.sendVerificationEvent(ctx, txn, event.InRoomVerificationStart, startEvt); err != nil {
+		return err
+	}
+	txn.StartedByUs = true
+	txn.VerificationState = verificationStateTheirQRScanned
+
+	switch qrCode.Mode {
+	case QRCodeModeCrossSigning:
+		err = vh.trustTheirMasterKey(ctx, txn)
+	case QRCodeModeSelfVerifyingMasterKeyTrusted:
+		err = vh.mach.SignOwnMasterKey(ctx)
+	case QRCodeModeSelfVerifyingMasterKeyUntrusted:
+		err = vh.trustTheirDevice(ctx, txn)
+	}
+	if err != nil {
+		vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeInternalError, "failed to trust keys: %v", err)
+		return fmt.Errorf("failed to trust keys: %w", err)
+	}
+	return vh.sendDone(ctx, txn)
+}
+
+// ConfirmQRCodeScanned confirms that our QR code has been scanned and trusts
+// the keys of the other device or user accordingly. This should be called
+// after the QRCodeScanned callback in [ShowQRCodeCallbacks] once the user has
+// confirmed that the other device shows a success message.
+func (vh *VerificationHelper) ConfirmQRCodeScanned(ctx context.Context, txnID id.VerificationTransactionID) error {
+	log := vh.getLog(ctx).With().
+		Str("verification_action", "confirm QR code scanned").
+		Stringer("transaction_id", txnID).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	vh.activeTransactionsLock.Lock()
+	defer vh.unlockTransactions()
+	txn, ok := vh.activeTransactions[txnID]
+	if !ok {
+		return ErrUnknownTransaction
+	} else if txn.VerificationState != verificationStateOurQRScanned {
+		return fmt.Errorf("%w: %s", ErrUnexpectedState, txn.VerificationState)
+	}
+
+	log.Info().Msg("Confirming QR code scanned")
+	var err error
+	switch txn.QRCodeMode {
+	case QRCodeModeCrossSigning:
+		err = vh.trustTheirMasterKey(ctx, txn)
+	case QRCodeModeSelfVerifyingMasterKeyTrusted:
+		err = vh.trustTheirDevice(ctx, txn)
+	case QRCodeModeSelfVerifyingMasterKeyUntrusted:
+		err = vh.mach.SignOwnMasterKey(ctx)
+	}
+	if err != nil {
+		vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeInternalError, "failed to trust keys: %v", err)
+		return fmt.Errorf("failed to trust keys: %w", err)
+	}
+	return vh.sendDone(ctx, txn)
+}
+
+// generateQRCode generates the QR code that we should show to the other
+// device. It returns nil if we don't have the cross-signing keys required to
+// show a QR code.
+//
+// Must always be called with the activeTransactionsLock held.
+func (vh *VerificationHelper) generateQRCode(ctx context.Context, txn *verificationTransaction) (*QRCode, error) {
+	ownKeys := vh.mach.GetOwnCrossSigningPublicKeys(ctx)
+	if ownKeys == nil {
+		vh.getLog(ctx).Info().Msg("Not showing QR code because we don't have cross-signing keys")
+		return nil, nil
+	}
+
+	var mode QRCodeMode
+	var key1, key2 []byte
+	if txn.TheirUser != vh.client.UserID {
+		theirKeys, err := vh.mach.GetCrossSigningPublicKeys(ctx, txn.TheirUser)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get cross-signing keys of %s: %w", txn.TheirUser, err)
+		} else if theirKeys == nil {
+			return nil, fmt.Errorf("%w for %s", ErrCrossSigningKeysNotFound, txn.TheirUser)
+		}
+		mode = QRCodeModeCrossSigning
+		key1 = ownKeys.MasterKey.Bytes()
+		key2 = theirKeys.MasterKey.Bytes()
+	} else {
+		ownDevice := vh.mach.OwnIdentity()
+		masterKeyTrusted := vh.mach.CrossSigningKeys != nil
+		if !masterKeyTrusted {
+			var err error
+			masterKeyTrusted, err = vh.mach.CryptoStore.IsKeySignedBy(ctx, vh.client.UserID, ownKeys.MasterKey, vh.client.UserID, ownDevice.SigningKey)
+			if err != nil {
+				return nil, fmt.Errorf("failed to check if master key is trusted: %w", err)
+			}
+		}
+		if masterKeyTrusted {
+			theirDevice, err := vh.mach.GetOrFetchDevice(ctx, txn.TheirUser, txn.TheirDevice)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get their device: %w", err)
+			}
+			mode = QRCodeModeSelfVerifyingMasterKeyTrusted
+			key1 = ownKeys.MasterKey.Bytes()
+			key2 = theirDevice.SigningKey.Bytes()
+		} else {
+			mode = QRCodeModeSelfVerifyingMasterKeyUntrusted
+			key1 = ownDevice.SigningKey.Bytes()
+			key2 = ownKeys.MasterKey.Bytes()
+		}
+	}
+
+	txn.QRCodeMode = mode
+	txn.QRCodeSharedSecret = random.Bytes(16)
+	copy(txn.QRCodeKey1[:], key1)
+	copy(txn.QRCodeKey2[:], key2)
+	return NewQRCode(mode, txn.TransactionID, txn.QRCodeKey1, txn.QRCodeKey2, txn.QRCodeSharedSecret), nil
+}
+
+// trustTheirMasterKey signs the other user's master key with our
+// user-signing key.
+func (vh *VerificationHelper) trustTheirMasterKey(ctx context.Context, txn *verificationTransaction) error {
+	theirKeys, err := vh.mach.GetCrossSigningPublicKeys(ctx, txn.TheirUser)
+	if err != nil {
+		return fmt.Errorf("failed to get cross-signing keys of %s: %w", txn.TheirUser, err)
+	} else if theirKeys == nil {
+		return fmt.Errorf("%w for %s", ErrCrossSigningKeysNotFound, txn.TheirUser)
+	}
+	return vh.mach.SignUser(ctx, txn.TheirUser, theirKeys.MasterKey)
+}
+
+// trustTheirDevice signs the other device of our own user with our
+// self-signing key. If we don't have the private self-signing key, the device
+// can't be signed and this is a no-op.
+func (vh *VerificationHelper) trustTheirDevice(ctx context.Context, txn *verificationTransaction) error {
+	if vh.mach.CrossSigningKeys == nil || vh.mach.CrossSigningKeys.SelfSigningKey == nil {
+		vh.getLog(ctx).Warn().Msg("Not signing their device because we don't have the self-signing key")
+		return nil
+	}
+	theirDevice, err := vh.mach.GetOrFetchDevice(ctx, txn.TheirUser, txn.TheirDevice)
+	if err != nil {
+		return fmt.Errorf("failed to get their device: %w", err)
+	}
+	return vh.mach.SignOwnDevice(ctx, theirDevice)
+}
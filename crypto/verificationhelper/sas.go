@@ -0,0 +1,535 @@
+package verificationhelper
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"go.mau.fi/util/jsonbytes"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/De-IM/mautrix/crypto/canonicaljson"
+	"github.com/De-IM/mautrix/event"
+	"github.com/De-IM/mautrix/id"
+)
+
+// supportedSASMethods are the short authentication string methods that we
+// support, in order of preference.
+var supportedSASMethods = []event.SASMethod{event.SASMethodDecimal, event.SASMethodEmoji}
+
+// StartSAS starts a SAS verification flow. The transaction ID should be the
+// transaction ID of a verification request that was received via the
+// VerificationRequested callback in [RequiredCallbacks] and accepted, or one
+// returned by [StartVerification] or [StartInRoomVerification].
+func (vh *VerificationHelper) StartSAS(ctx context.Context, txnID id.VerificationTransactionID) error {
+	log := vh.getLog(ctx).With().
+		Str("verification_action", "start SAS").
+		Stringer("transaction_id", txnID).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	vh.activeTransactionsLock.Lock()
+	defer vh.unlockTransactions()
+	txn, ok := vh.activeTransactions[txnID]
+	if !ok {
+		return ErrUnknownTransaction
+	} else if txn.VerificationState != verificationStateReady {
+		return fmt.Errorf("%w: %s", ErrUnexpectedState, txn.VerificationState)
+	} else if !slices.Contains(vh.supportedMethods, event.VerificationMethodSAS) ||
+		!slices.Contains(txn.SupportedMethods, event.VerificationMethodSAS) {
+		return ErrNotSupported
+	}
+
+	ephemeralKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+
+	log.Info().Msg("Sending start event")
+	startEvt := &event.VerificationStartEventContent{
+		FromDevice:                 vh.client.DeviceID,
+		Method:                     event.VerificationMethodSAS,
+		Hashes:                     []event.VerificationHashMethod{event.VerificationHashMethodSHA256},
+		KeyAgreementProtocols:      []event.KeyAgreementProtocol{event.KeyAgreementProtocolCurve25519HKDFSHA256},
+		MessageAuthenticationCodes: []event.MACMethod{event.MACMethodHKDFHMACSHA256V2},
+		ShortAuthenticationString:  supportedSASMethods,
+	}
+	if err = vh.sendVerificationEvent(ctx, txn, event.InRoomVerificationStart, startEvt); err != nil {
+		return err
+	}
+	// sendVerificationEvent fills the transaction ID or relation, so the JSON
+	// used for the commitment must be generated afterwards.
+	txn.StartEventJSON, err = json.Marshal(startEvt)
+	if err != nil {
+		return fmt.Errorf("failed to marshal start event: %w", err)
+	}
+	txn.StartEventContent = startEvt
+	txn.EphemeralKey = ephemeralKey
+	txn.StartedByUs = true
+	txn.VerificationState = verificationStateSASStarted
+	return nil
+}
+
+// ConfirmSAS indicates that the user has confirmed that the SAS matches the
+// SAS shown on the other user's device. This sends our MAC and, once the MAC
+// of the other device has been received and verified, trusts the keys.
+func (vh *VerificationHelper) ConfirmSAS(ctx context.Context, txnID id.VerificationTransactionID) error {
+	log := vh.getLog(ctx).With().
+		Str("verification_action", "confirm SAS").
+		Stringer("transaction_id", txnID).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	vh.activeTransactionsLock.Lock()
+	defer vh.unlockTransactions()
+	txn, ok := vh.activeTransactions[txnID]
+	if !ok {
+		return ErrUnknownTransaction
+	} else if txn.VerificationState != verificationStateSASKeysExchanged || txn.SASConfirmed {
+		return fmt.Errorf("%w: %s", ErrUnexpectedState, txn.VerificationState)
+	}
+
+	macEvt, err := vh.generateOurMAC(ctx, txn)
+	if err != nil {
+		return err
+	}
+	log.Info().Msg("Sending MAC event")
+	if err = vh.sendVerificationEvent(ctx, txn, event.InRoomVerificationMAC, macEvt); err != nil {
+		return err
+	}
+	txn.SASConfirmed = true
+	txn.SentOurMAC = true
+
+	if txn.ReceivedTheirMAC {
+		return vh.verifyTheirMAC(ctx, txn)
+	}
+	return nil
+}
+
+// onVerificationStartSAS handles the m.key.verification.start event with the
+// SAS method, which means that we're the accepting side.
+//
+// Must always be called with the activeTransactionsLock held.
+func (vh *VerificationHelper) onVerificationStartSAS(ctx context.Context, txn *verificationTransaction, evt *event.Event) error {
+	startEvt := evt.Content.AsVerificationStart()
+	log := vh.getLog(ctx).With().
+		Str("verification_action", "start SAS").
+		Logger()
+	ctx = log.WithContext(ctx)
+	log.Info().
+		Any("hashes", startEvt.Hashes).
+		Any("key_agreement_protocols", startEvt.KeyAgreementProtocols).
+		Any("message_authentication_codes", startEvt.MessageAuthenticationCodes).
+		Any("short_authentication_string", startEvt.ShortAuthenticationString).
+		Msg("Received SAS verification start event")
+
+	if !slices.Contains(vh.supportedMethods, event.VerificationMethodSAS) {
+		vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeUnknownMethod, "SAS verification is not supported")
+		return nil
+	} else if !slices.Contains(startEvt.Hashes, event.VerificationHashMethodSHA256) {
+		vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeUnknownMethod, "no supported hash method")
+		return nil
+	} else if !slices.Contains(startEvt.KeyAgreementProtocols, event.KeyAgreementProtocolCurve25519HKDFSHA256) {
+		vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeUnknownMethod, "no supported key agreement protocol")
+		return nil
+	} else if !slices.Contains(startEvt.MessageAuthenticationCodes, event.MACMethodHKDFHMACSHA256V2) {
+		vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeUnknownMethod, "no supported message authentication code")
+		return nil
+	}
+	var sasMethods []event.SASMethod
+	for _, method := range supportedSASMethods {
+		if slices.Contains(startEvt.ShortAuthenticationString, method) {
+			sasMethods = append(sasMethods, method)
+		}
+	}
+	if !slices.Contains(sasMethods, event.SASMethodDecimal) {
+		// Decimal is mandatory according to the spec.
+		vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeUnknownMethod, "decimal SAS method not supported")
+		return nil
+	}
+
+	ephemeralKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	commitment, err := calculateCommitment(ephemeralKey.PublicKey(), txn.StartEventJSON)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msg("Sending accept event")
+	acceptEvt := &event.VerificationAcceptEventContent{
+		Commitment:                commitment,
+		Hash:                      event.VerificationHashMethodSHA256,
+		KeyAgreementProtocol:      event.KeyAgreementProtocolCurve25519HKDFSHA256,
+		MessageAuthenticationCode: event.MACMethodHKDFHMACSHA256V2,
+		ShortAuthenticationString: sasMethods,
+	}
+	if err = vh.sendVerificationEvent(ctx, txn, event.InRoomVerificationAccept, acceptEvt); err != nil {
+		return err
+	}
+	txn.StartEventContent = startEvt
+	txn.SASMethods = sasMethods
+	txn.MACMethod = event.MACMethodHKDFHMACSHA256V2
+	txn.EphemeralKey = ephemeralKey
+	txn.VerificationState = verificationStateSASAccepted
+	return nil
+}
+
+// calculateCommitment calculates the commitment for the accept event, which is
+// the SHA-256 hash of the unpadded base64 public key concatenated with the
+// canonical JSON of the start event content.
+func calculateCommitment(publicKey *ecdh.PublicKey, startEventJSON []byte) ([]byte, error) {
+	canonical, err := canonicaljson.CanonicalJSON(startEventJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to canonicalize start event: %w", err)
+	}
+	hash := sha256.New()
+	hash.Write([]byte(base64.RawStdEncoding.EncodeToString(publicKey.Bytes())))
+	hash.Write(canonical)
+	return hash.Sum(nil), nil
+}
+
+func (vh *VerificationHelper) onVerificationAccept(ctx context.Context, txn *verificationTransaction, evt *event.Event) {
+	acceptEvt := evt.Content.AsVerificationAccept()
+	log := vh.getLog(ctx).With().
+		Str("verification_action", "accept").
+		Str("hash", string(acceptEvt.Hash)).
+		Str("key_agreement_protocol", string(acceptEvt.KeyAgreementProtocol)).
+		Str("message_authentication_code", string(acceptEvt.MessageAuthenticationCode)).
+		Any("short_authentication_string", acceptEvt.ShortAuthenticationString).
+		Logger()
+	ctx = log.WithContext(ctx)
+	log.Info().Msg("Received SAS verification accept event")
+
+	vh.activeTransactionsLock.Lock()
+	defer vh.unlockTransactions()
+	if txn.VerificationState != verificationStateSASStarted || !txn.StartedByUs {
+		vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeUnexpectedMessage, "received accept event for a transaction that is not in the started state")
+		return
+	} else if offered := txn.StartEventContent; !slices.Contains(offered.Hashes, acceptEvt.Hash) ||
+		!slices.Contains(offered.KeyAgreementProtocols, acceptEvt.KeyAgreementProtocol) ||
+		!slices.Contains(offered.MessageAuthenticationCodes, acceptEvt.MessageAuthenticationCode) ||
+		len(acceptEvt.ShortAuthenticationString) == 0 ||
+		slices.ContainsFunc(acceptEvt.ShortAuthenticationString, func(method event.SASMethod) bool {
+			return !slices.Contains(offered.ShortAuthenticationString, method)
+		}) {
+		vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeUnknownMethod, "the accept event chose a method that wasn't offered")
+		return
+	}
+
+	log.Info().Msg("Sending key event")
+	keyEvt := &event.VerificationKeyEventContent{Key: txn.EphemeralKey.PublicKey().Bytes()}
+	if err := vh.sendVerificationEvent(ctx, txn, event.InRoomVerificationKey, keyEvt); err != nil {
+		log.Err(err).Msg("Failed to send key event")
+		return
+	}
+	txn.Commitment = acceptEvt.Commitment
+	txn.SASMethods = acceptEvt.ShortAuthenticationString
+	txn.MACMethod = acceptEvt.MessageAuthenticationCode
+	txn.EphemeralPublicKeyShared = true
+	txn.VerificationState = verificationStateSASAccepted
+}
+
+func (vh *VerificationHelper) onVerificationKey(ctx context.Context, txn *verificationTransaction, evt *event.Event) {
+	log := vh.getLog(ctx).With().
+		Str("verification_action", "key").
+		Logger()
+	ctx = log.WithContext(ctx)
+	log.Info().Msg("Received SAS verification key event")
+
+	vh.activeTransactionsLock.Lock()
+	defer vh.unlockTransactions()
+	if txn.VerificationState != verificationStateSASAccepted {
+		vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeUnexpectedMessage, "received key event for a transaction that is not in the accepted state")
+		return
+	}
+
+	keyEvt := evt.Content.AsVerificationKey()
+	publicKey, err := ecdh.X25519().NewPublicKey(keyEvt.Key)
+	if err != nil {
+		vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeInvalidMessage, "invalid ephemeral key: %v", err)
+		return
+	}
+
+	if txn.StartedByUs {
+		// Verify that the key matches the commitment that was sent in the
+		// accept event.
+		commitment, err := calculateCommitment(publicKey, txn.StartEventJSON)
+		if err != nil {
+			vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeInternalError, "failed to calculate commitment: %v", err)
+			return
+		} else if !hmac.Equal(commitment, txn.Commitment) {
+			vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeCommitmentMismatch, "the key doesn't match the commitment")
+			return
+		}
+	} else {
+		log.Info().Msg("Sending key event")
+		keyEvt := &event.VerificationKeyEventContent{Key: txn.EphemeralKey.PublicKey().Bytes()}
+		if err = vh.sendVerificationEvent(ctx, txn, event.InRoomVerificationKey, keyEvt); err != nil {
+			log.Err(err).Msg("Failed to send key event")
+			return
+		}
+		txn.EphemeralPublicKeyShared = true
+	}
+	txn.OtherPublicKey = publicKey
+	txn.VerificationState = verificationStateSASKeysExchanged
+
+	sasBytes, err := vh.deriveSASBytes(txn)
+	if err != nil {
+		vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeInternalError, "failed to derive SAS: %v", err)
+		return
+	}
+	var emojis []rune
+	var emojiDescriptions []string
+	if slices.Contains(txn.SASMethods, event.SASMethodEmoji) {
+		emojis, emojiDescriptions = sasEmojis(sasBytes)
+	}
+	txnID, decimals := txn.TransactionID, sasDecimals(sasBytes)
+	vh.queueCallback(func() { vh.showSAS(ctx, txnID, emojis, emojiDescriptions, decimals) })
+}
+
+// deriveSASBytes derives the 6 bytes used for generating the short
+// authentication string as described in [Section 11.12.2.2.2] of the Spec.
+//
+// [Section 11.12.2.2.2]: https://spec.matrix.org/v1.9/client-server-api/#hkdf-calculation
+func (vh *VerificationHelper) deriveSASBytes(txn *verificationTransaction) ([]byte, error) {
+	sharedSecret, err := txn.EphemeralKey.ECDH(txn.OtherPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate shared secret: %w", err)
+	}
+	ourKey := base64.RawStdEncoding.EncodeToString(txn.EphemeralKey.PublicKey().Bytes())
+	theirKey := base64.RawStdEncoding.EncodeToString(txn.OtherPublicKey.Bytes())
+	ourInfo := fmt.Sprintf("%s|%s|%s", vh.client.UserID, vh.client.DeviceID, ourKey)
+	theirInfo := fmt.Sprintf("%s|%s|%s", txn.TheirUser, txn.TheirDevice, theirKey)
+
+	var info string
+	if txn.StartedByUs {
+		info = fmt.Sprintf("MATRIX_KEY_VERIFICATION_SAS|%s|%s|%s", ourInfo, theirInfo, txn.TransactionID)
+	} else {
+		info = fmt.Sprintf("MATRIX_KEY_VERIFICATION_SAS|%s|%s|%s", theirInfo, ourInfo, txn.TransactionID)
+	}
+
+	sasBytes := make([]byte, 6)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, sharedSecret, nil, []byte(info)), sasBytes); err != nil {
+		return nil, fmt.Errorf("failed to derive SAS bytes: %w", err)
+	}
+	return sasBytes, nil
+}
+
+// sasDecimals converts the SAS bytes to three 4-digit numbers as described in
+// [Section 11.12.2.2.2] of the Spec.
+//
+// [Section 11.12.2.2.2]: https://spec.matrix.org/v1.9/client-server-api/#sas-method-decimal
+func sasDecimals(sasBytes []byte) []int {
+	return []int{
+		(int(sasBytes[0])<<5 | int(sasBytes[1])>>3) + 1000,
+		(int(sasBytes[1]&0x7)<<10 | int(sasBytes[2])<<2 | int(sasBytes[3])>>6) + 1000,
+		(int(sasBytes[3]&0x3f)<<7 | int(sasBytes[4])>>1) + 1000,
+	}
+}
+
+// sasEmojis converts the SAS bytes to seven emojis as described in [Section
+// 11.12.2.2.2] of the Spec.
+//
+// [Section 11.12.2.2.2]: https://spec.matrix.org/v1.9/client-server-api/#sas-method-emoji
+func sasEmojis(sasBytes []byte) ([]rune, []string) {
+	var bits uint64
+	for _, b := range sasBytes {
+		bits = bits<<8 | uint64(b)
+	}
+	emojis := make([]rune, 7)
+	descriptions := make([]string, 7)
+	for i := 0; i < 7; i++ {
+		// The first 42 bits of the 48 are split into 7 groups of 6 bits.
+		idx := (bits >> (42 - 6*i)) & 0x3f
+		emojis[i] = allEmojis[idx]
+		descriptions[i] = allEmojiDescriptions[idx]
+	}
+	return emojis, descriptions
+}
+
+// generateOurMAC generates the m.key.verification.mac event content for our
+// device key and our master key (if we have one).
+//
+// Must always be called with the activeTransactionsLock held.
+func (vh *VerificationHelper) generateOurMAC(ctx context.Context, txn *verificationTransaction) (*event.VerificationMACEventContent, error) {
+	sharedSecret, err := txn.EphemeralKey.ECDH(txn.OtherPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate shared secret: %w", err)
+	}
+	baseInfo := fmt.Sprintf("MATRIX_KEY_VERIFICATION_MAC%s%s%s%s%s", vh.client.UserID, vh.client.DeviceID, txn.TheirUser, txn.TheirDevice, txn.TransactionID)
+
+	keys := map[id.KeyID]string{
+		id.NewKeyID(id.KeyAlgorithmEd25519, vh.client.DeviceID.String()): vh.mach.OwnIdentity().SigningKey.String(),
+	}
+	if ownKeys := vh.mach.GetOwnCrossSigningPublicKeys(ctx); ownKeys != nil {
+		keys[id.NewKeyID(id.KeyAlgorithmEd25519, ownKeys.MasterKey.String())] = ownKeys.MasterKey.String()
+	}
+
+	macEvt := &event.VerificationMACEventContent{MAC: map[id.KeyID]jsonbytes.UnpaddedBytes{}}
+	keyIDs := make([]string, 0, len(keys))
+	for keyID, key := range keys {
+		macEvt.MAC[keyID], err = calculateMAC(sharedSecret, baseInfo+keyID.String(), key)
+		if err != nil {
+			return nil, err
+		}
+		keyIDs = append(keyIDs, keyID.String())
+	}
+	slices.Sort(keyIDs)
+	macEvt.Keys, err = calculateMAC(sharedSecret, baseInfo+"KEY_IDS", strings.Join(keyIDs, ","))
+	if err != nil {
+		return nil, err
+	}
+	return macEvt, nil
+}
+
+// calculateMAC calculates the MAC of the given input using the
+// hkdf-hmac-sha256.v2 method.
+func calculateMAC(sharedSecret []byte, info, input string) ([]byte, error) {
+	macKey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, sharedSecret, nil, []byte(info)), macKey); err != nil {
+		return nil, fmt.Errorf("failed to derive MAC key: %w", err)
+	}
+	hash := hmac.New(sha256.New, macKey)
+	hash.Write([]byte(input))
+	return hash.Sum(nil), nil
+}
+
+func (vh *VerificationHelper) onVerificationMAC(ctx context.Context, txn *verificationTransaction, evt *event.Event) {
+	log := vh.getLog(ctx).With().
+		Str("verification_action", "mac").
+		Logger()
+	ctx = log.WithContext(ctx)
+	log.Info().Msg("Received SAS verification MAC event")
+
+	vh.activeTransactionsLock.Lock()
+	defer vh.unlockTransactions()
+	if txn.VerificationState != verificationStateSASKeysExchanged || txn.ReceivedTheirMAC {
+		vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeUnexpectedMessage, "received MAC event for a transaction that is not in the keys exchanged state")
+		return
+	}
+	txn.TheirMAC = evt.Content.AsVerificationMAC()
+	txn.ReceivedTheirMAC = true
+
+	// The MAC is only verified after the user has confirmed that the SAS
+	// matches, because trusting the keys must not happen before that.
+	if txn.SentOurMAC {
+		if err := vh.verifyTheirMAC(ctx, txn); err != nil {
+			log.Err(err).Msg("Failed to verify MAC")
+		}
+	}
+}
+
+// verifyTheirMAC verifies the MAC received from the other device, trusts the
+// keys that were verified and sends the done event.
+//
+// Must always be called with the activeTransactionsLock held.
+func (vh *VerificationHelper) verifyTheirMAC(ctx context.Context, txn *verificationTransaction) error {
+	log := vh.getLog(ctx)
+	sharedSecret, err := txn.EphemeralKey.ECDH(txn.OtherPublicKey)
+	if err != nil {
+		return fmt.Errorf("failed to calculate shared secret: %w", err)
+	}
+	baseInfo := fmt.Sprintf("MATRIX_KEY_VERIFICATION_MAC%s%s%s%s%s", txn.TheirUser, txn.TheirDevice, vh.client.UserID, vh.client.DeviceID, txn.TransactionID)
+
+	keyIDs := make([]string, 0, len(txn.TheirMAC.MAC))
+	for keyID := range txn.TheirMAC.MAC {
+		keyIDs = append(keyIDs, keyID.String())
+	}
+	slices.Sort(keyIDs)
+	expectedKeyMAC, err := calculateMAC(sharedSecret, baseInfo+"KEY_IDS", strings.Join(keyIDs, ","))
+	if err != nil {
+		return err
+	} else if !hmac.Equal(expectedKeyMAC, txn.TheirMAC.Keys) {
+		vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeKeyMismatch, "the key list MAC doesn't match")
+		return fmt.Errorf("key list MAC mismatch")
+	}
+
+	theirDevice, err := vh.mach.GetOrFetchDevice(ctx, txn.TheirUser, txn.TheirDevice)
+	if err != nil {
+		vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeInternalError, "failed to get their device: %v", err)
+		return fmt.Errorf("failed to get their device: %w", err)
+	}
+	theirKeys, err := vh.mach.GetCrossSigningPublicKeys(ctx, txn.TheirUser)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to get cross-signing keys of the other user")
+	}
+
+	var deviceKeyVerified, masterKeyVerified bool
+	for keyID, mac := range txn.TheirMAC.MAC {
+		var key string
+		_, keyName := keyID.Parse()
+		if keyName == txn.TheirDevice.String() {
+			key = theirDevice.SigningKey.String()
+			deviceKeyVerified = true
+		} else if theirKeys != nil && keyName == theirKeys.MasterKey.String() {
+			key = theirKeys.MasterKey.String()
+			masterKeyVerified = true
+		} else {
+			log.Warn().Stringer("key_id", keyID).Msg("Ignoring MAC for unknown key")
+			continue
+		}
+		expectedMAC, err := calculateMAC(sharedSecret, baseInfo+keyID.String(), key)
+		if err != nil {
+			return err
+		} else if !hmac.Equal(expectedMAC, mac) {
+			vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeKeyMismatch, "the MAC for %s doesn't match", keyID)
+			return fmt.Errorf("MAC mismatch for key %s", keyID)
+		}
+	}
+	if !deviceKeyVerified {
+		vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeKeyMismatch, "the MAC event didn't contain the device key")
+		return fmt.Errorf("device key MAC missing")
+	}
+	log.Info().Bool("master_key_verified", masterKeyVerified).Msg("MAC verified, trusting keys")
+	txn.VerificationState = verificationStateSASMACExchanged
+
+	if txn.TheirUser == vh.client.UserID {
+		err = vh.trustTheirDevice(ctx, txn)
+		if err == nil && masterKeyVerified && vh.mach.CrossSigningKeys == nil {
+			err = vh.mach.SignOwnMasterKey(ctx)
+		}
+	} else if masterKeyVerified {
+		err = vh.trustTheirMasterKey(ctx, txn)
+	}
+	if err != nil {
+		vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeInternalError, "failed to trust keys: %v", err)
+		return fmt.Errorf("failed to trust keys: %w", err)
+	}
+	return vh.sendDone(ctx, txn)
+}
+
+// allEmojis and allEmojiDescriptions are the emojis and their English
+// descriptions from the table in [Section 11.12.2.2.2] of the Spec.
+//
+// [Section 11.12.2.2.2]: https://spec.matrix.org/v1.9/client-server-api/#sas-method-emoji
+var allEmojis = []rune{
+	'🐶', '🐱', '🦁', '🐎', '🦄', '🐷', '🐘', '🐰',
+	'🐼', '🐓', '🐧', '🐢', '🐟', '🐙', '🦋', '🌷',
+	'🌳', '🌵', '🍄', '🌏', '🌙', '☁', '🔥', '🍌',
+	'🍎', '🍓', '🌽', '🍕', '🎂', '❤', '😀', '🤖',
+	'🎩', '👓', '🔧', '🎅', '👍', '☂', '⌛', '⏰',
+	'🎁', '💡', '📕', '✏', '📎', '✂', '🔒', '🔑',
+	'🔨', '☎', '🏁', '🚂', '🚲', '✈', '🚀', '🏆',
+	'⚽', '🎸', '🎺', '🔔', '⚓', '🎧', '📁', '📌',
+}
+
+var allEmojiDescriptions = []string{
+	"Dog", "Cat", "Lion", "Horse", "Unicorn", "Pig", "Elephant", "Rabbit",
+	"Panda", "Rooster", "Penguin", "Turtle", "Fish", "Octopus", "Butterfly", "Flower",
+	"Tree", "Cactus", "Mushroom", "Globe", "Moon", "Cloud", "Fire", "Banana",
+	"Apple", "Strawberry", "Corn", "Pizza", "Cake", "Heart", "Smiley", "Robot",
+	"Hat", "Glasses", "Spanner", "Santa", "Thumbs Up", "Umbrella", "Hourglass", "Clock",
+	"Gift", "Light Bulb", "Book", "Pencil", "Paperclip", "Scissors", "Lock", "Key",
+	"Hammer", "Telephone", "Flag", "Train", "Bicycle", "Aeroplane", "Rocket", "Trophy",
+	"Ball", "Guitar", "Trumpet", "Bell", "Anchor", "Headphones", "Folder", "Pin",
+}
@@ -0,0 +1,996 @@
+package verificationhelper
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/jsontime"
+
+	"github.com/De-IM/mautrix"
+	"github.com/De-IM/mautrix/crypto"
+	"github.com/De-IM/mautrix/event"
+	"github.com/De-IM/mautrix/id"
+)
+
+var (
+	ErrUnknownTransaction = errors.New("unknown verification transaction")
+	ErrUnexpectedState    = errors.New("verification transaction is not in the expected state")
+	ErrNotSupported       = errors.New("verification method is not supported by both devices")
+)
+
+type verificationState int
+
+const (
+	verificationStateRequested verificationState = iota
+	verificationStateReady
+	verificationStateCancelled
+	verificationStateDone
+
+	verificationStateTheirQRScanned // We scanned their QR code
+	verificationStateOurQRScanned   // They scanned our QR code
+
+	verificationStateSASStarted       // An SAS verification has been started
+	verificationStateSASAccepted      // An SAS verification has been accepted
+	verificationStateSASKeysExchanged // An SAS verification has exchanged keys
+	verificationStateSASMACExchanged  // An SAS verification has exchanged MACs
+)
+
+func (step verificationState) String() string {
+	switch step {
+	case verificationStateRequested:
+		return "requested"
+	case verificationStateReady:
+		return "ready"
+	case verificationStateCancelled:
+		return "cancelled"
+	case verificationStateDone:
+		return "done"
+	case verificationStateTheirQRScanned:
+		return "their_qr_scanned"
+	case verificationStateOurQRScanned:
+		return "our_qr_scanned"
+	case verificationStateSASStarted:
+		return "sas_started"
+	case verificationStateSASAccepted:
+		return "sas_accepted"
+	case verificationStateSASKeysExchanged:
+		return "sas_keys_exchanged"
+	case verificationStateSASMACExchanged:
+		return "sas_mac_exchanged"
+	default:
+		return fmt.Sprintf("verificationStep(%d)", step)
+	}
+}
+
+// verificationTransaction holds all of the state for a single verification
+// flow, regardless of whether it happens over to-device or in-room events.
+type verificationTransaction struct {
+	// RoomID is the room ID if the verification is happening in a room or
+	// empty if it is a to-device verification.
+	RoomID id.RoomID
+
+	// VerificationState is the current step of the verification flow.
+	VerificationState verificationState
+	// TransactionID is the ID of the verification transaction. For in-room
+	// verifications, this is the event ID of the request event.
+	TransactionID id.VerificationTransactionID
+
+	// TheirDevice is the device ID of the device that either made the
+	// initial request or accepted our request.
+	TheirDevice id.DeviceID
+	// TheirUser is the user ID of the other user.
+	TheirUser id.UserID
+	// SentToDeviceIDs is a list of devices which the initial request was
+	// sent to. This is only used for to-device verification requests.
+	SentToDeviceIDs []id.DeviceID
+
+	// SupportedMethods is a list of the methods supported by the other device.
+	SupportedMethods []event.VerificationMethod
+
+	// QRCodeSharedSecret is the shared secret that was encoded in the QR code
+	// that we showed.
+	QRCodeSharedSecret []byte
+	// QRCodeMode is the mode of the QR code that we showed.
+	QRCodeMode QRCodeMode
+	// QRCodeKey1 and QRCodeKey2 are the keys that were encoded in the QR code
+	// that we showed or scanned.
+	QRCodeKey1, QRCodeKey2 [32]byte
+
+	// StartedByUs is true if we sent the m.key.verification.start event.
+	StartedByUs bool
+	// StartEventContent is the content of the start event, which is kept so
+	// that the commitment can be calculated from the exact JSON.
+	StartEventContent *event.VerificationStartEventContent
+	// StartEventJSON is the raw JSON of the start event content.
+	StartEventJSON []byte
+	// Commitment is the commitment received in the accept event.
+	Commitment []byte
+	// SASMethods are the short authentication string methods that were
+	// agreed on in the accept event.
+	SASMethods []event.SASMethod
+	// MACMethod is the MAC method that was agreed on in the accept event.
+	MACMethod event.MACMethod
+	// EphemeralKey is the ephemeral key used for the SAS key agreement.
+	EphemeralKey *ecdh.PrivateKey
+	// EphemeralPublicKeyShared is true if we have sent our ephemeral public key.
+	EphemeralPublicKeyShared bool
+	// OtherPublicKey is the other device's ephemeral public key.
+	OtherPublicKey *ecdh.PublicKey
+	// TheirMAC is the MAC event received from the other device. It's stored
+	// until the user has confirmed that the SAS matches.
+	TheirMAC *event.VerificationMACEventContent
+	// SASConfirmed is true if the user has confirmed that the SAS matches.
+	SASConfirmed bool
+
+	ReceivedTheirMAC  bool
+	SentOurMAC        bool
+	ReceivedTheirDone bool
+	SentOurDone       bool
+}
+
+// RequiredCallbacks is an interface representing the callbacks required for
+// the [VerificationHelper]. Callbacks are never called while the helper holds
+// its locks, so they may call the methods of the helper synchronously.
+type RequiredCallbacks interface {
+	// VerificationRequested is called when a verification request is received
+	// from another device.
+	VerificationRequested(ctx context.Context, txnID id.VerificationTransactionID, from id.UserID, fromDevice id.DeviceID)
+
+	// VerificationCancelled is called when the verification is cancelled.
+	VerificationCancelled(ctx context.Context, txnID id.VerificationTransactionID, code event.VerificationCancelCode, reason string)
+
+	// VerificationDone is called when the verification is done.
+	VerificationDone(ctx context.Context, txnID id.VerificationTransactionID)
+}
+
+// ShowSASCallbacks must be implemented by the callbacks object to enable the
+// SAS verification method.
+type ShowSASCallbacks interface {
+	// ShowSAS is called when the SAS verification has generated a short
+	// authentication string to show. It is guaranteed that either the emojis
+	// and emoji descriptions lists, or the decimals list, or both will be
+	// present.
+	ShowSAS(ctx context.Context, txnID id.VerificationTransactionID, emojis []rune, emojiDescriptions []string, decimals []int)
+}
+
+// ShowQRCodeCallbacks must be implemented by the callbacks object to enable
+// showing and scanning QR codes.
+type ShowQRCodeCallbacks interface {
+	// ScanQRCode is called when another device has sent a
+	// m.key.verification.ready event and indicated that they are capable of
+	// showing a QR code.
+	ScanQRCode(ctx context.Context, txnID id.VerificationTransactionID)
+
+	// ShowQRCode is called when the verification has been accepted and a QR
+	// code should be shown to the user.
+	ShowQRCode(ctx context.Context, txnID id.VerificationTransactionID, qrCode *QRCode)
+
+	// QRCodeScanned is called when the other user has scanned the QR code and
+	// sent the m.key.verification.start event. The user should then be asked
+	// to confirm it with ConfirmQRCodeScanned.
+	QRCodeScanned(ctx context.Context, txnID id.VerificationTransactionID)
+}
+
+// VerificationHelper implements interactive device and user verification as
+// described in [Section 11.12.2] of the Spec. It supports the SAS (emoji and
+// decimal) and QR code (m.reciprocate.v1) methods over both to-device and
+// in-room transports.
+//
+// [Section 11.12.2]: https://spec.matrix.org/v1.9/client-server-api/#device-verification
+type VerificationHelper struct {
+	client *mautrix.Client
+	mach   *crypto.OlmMachine
+
+	activeTransactions     map[id.VerificationTransactionID]*verificationTransaction
+	activeTransactionsLock sync.Mutex
+	// pendingCallbacks are the user callbacks queued while the
+	// activeTransactionsLock is held, see queueCallback.
+	pendingCallbacks []func()
+
+	// supportedMethods are the methods that *we* support
+	supportedMethods []event.VerificationMethod
+
+	verificationRequested func(ctx context.Context, txnID id.VerificationTransactionID, from id.UserID, fromDevice id.DeviceID)
+	verificationCancelled func(ctx context.Context, txnID id.VerificationTransactionID, code event.VerificationCancelCode, reason string)
+	verificationDone      func(ctx context.Context, txnID id.VerificationTransactionID)
+
+	showSAS func(ctx context.Context, txnID id.VerificationTransactionID, emojis []rune, emojiDescriptions []string, decimals []int)
+
+	scanQRCode    func(ctx context.Context, txnID id.VerificationTransactionID)
+	showQRCode    func(ctx context.Context, txnID id.VerificationTransactionID, qrCode *QRCode)
+	qrCodeScanned func(ctx context.Context, txnID id.VerificationTransactionID)
+}
+
+var _ mautrix.VerificationHelper = (*VerificationHelper)(nil)
+
+// NewVerificationHelper creates a new verification helper for the given client
+// and Olm machine.
+//
+// The callbacks object must implement [RequiredCallbacks]. The SAS method is
+// enabled if it implements [ShowSASCallbacks] and showing QR codes is enabled
+// if it implements [ShowQRCodeCallbacks]. supportsScan indicates whether the
+// client is capable of scanning QR codes.
+func NewVerificationHelper(client *mautrix.Client, mach *crypto.OlmMachine, callbacks any, supportsScan bool) *VerificationHelper {
+	if client.Crypto == nil {
+		panic("client.Crypto is nil")
+	}
+
+	helper := VerificationHelper{
+		client:             client,
+		mach:               mach,
+		activeTransactions: map[id.VerificationTransactionID]*verificationTransaction{},
+	}
+
+	if c, ok := callbacks.(RequiredCallbacks); !ok {
+		panic("callbacks must implement VerificationRequested")
+	} else {
+		helper.verificationRequested = c.VerificationRequested
+		helper.verificationCancelled = c.VerificationCancelled
+		helper.verificationDone = c.VerificationDone
+	}
+
+	if c, ok := callbacks.(ShowSASCallbacks); ok {
+		helper.supportedMethods = append(helper.supportedMethods, event.VerificationMethodSAS)
+		helper.showSAS = c.ShowSAS
+	}
+	if c, ok := callbacks.(ShowQRCodeCallbacks); ok {
+		helper.supportedMethods = append(helper.supportedMethods,
+			event.VerificationMethodQRCodeShow, event.VerificationMethodReciprocate)
+		helper.scanQRCode = c.ScanQRCode
+		helper.showQRCode = c.ShowQRCode
+		helper.qrCodeScanned = c.QRCodeScanned
+	}
+	if supportsScan {
+		helper.supportedMethods = append(helper.supportedMethods,
+			event.VerificationMethodQRCodeScan, event.VerificationMethodReciprocate)
+	}
+
+	slices.Sort(helper.supportedMethods)
+	helper.supportedMethods = slices.Compact(helper.supportedMethods)
+	return &helper
+}
+
+func (vh *VerificationHelper) getLog(ctx context.Context) *zerolog.Logger {
+	logger := zerolog.Ctx(ctx).With().
+		Any("supported_methods", vh.supportedMethods).
+		Str("component", "verification").
+		Logger()
+	return &logger
+}
+
+// queueCallback queues a user callback to be called once the
+// activeTransactionsLock is released, so that callbacks can call back into
+// the helper (e.g. ConfirmSAS or CancelVerification) without deadlocking.
+//
+// Must always be called with the activeTransactionsLock held.
+func (vh *VerificationHelper) queueCallback(callback func()) {
+	vh.pendingCallbacks = append(vh.pendingCallbacks, callback)
+}
+
+// unlockTransactions releases the activeTransactionsLock and then calls the
+// callbacks that were queued while it was held.
+func (vh *VerificationHelper) unlockTransactions() {
+	callbacks := vh.pendingCallbacks
+	vh.pendingCallbacks = nil
+	vh.activeTransactionsLock.Unlock()
+	for _, callback := range callbacks {
+		callback()
+	}
+}
+
+// getToDeviceSenderDevice returns the device that sent the given to-device
+// verification event. The device is taken from the Olm session the event was
+// decrypted with if known, and otherwise from the from_device field, which
+// only some verification events have. An empty device ID is returned if the
+// device can't be determined.
+func getToDeviceSenderDevice(evt *event.Event) id.DeviceID {
+	if evt.Mautrix.TrustSource != nil && evt.Mautrix.TrustSource.DeviceID != "" {
+		return evt.Mautrix.TrustSource.DeviceID
+	}
+	fromDevice, _ := evt.Content.Raw["from_device"].(string)
+	return id.DeviceID(fromDevice)
+}
+
+// Init initializes the verification helper by adding the necessary event
+// handlers to the syncer.
+func (vh *VerificationHelper) Init(ctx context.Context) error {
+	if vh == nil {
+		return fmt.Errorf("verification helper is nil")
+	}
+	syncer, ok := vh.client.Syncer.(mautrix.ExtensibleSyncer)
+	if !ok {
+		return fmt.Errorf("the client syncer must implement ExtensibleSyncer")
+	}
+
+	// Event handlers for verification requests. These are special since we do
+	// not need to check that the transaction ID is known.
+	syncer.OnEventType(event.ToDeviceVerificationRequest, vh.onVerificationRequest)
+	syncer.OnEventType(event.EventMessage, func(ctx context.Context, evt *event.Event) {
+		if evt.Content.AsMessage().MsgType == event.MsgVerificationRequest {
+			vh.onVerificationRequest(ctx, evt)
+		}
+	})
+
+	// Wrapper for the event handlers to check that the transaction ID is known
+	// and ignore the event if it isn't.
+	wrapHandler := func(callback func(context.Context, *verificationTransaction, *event.Event)) func(context.Context, *event.Event) {
+		return func(ctx context.Context, evt *event.Event) {
+			log := vh.getLog(ctx).With().
+				Str("verification_action", "check transaction ID").
+				Stringer("sender", evt.Sender).
+				Stringer("room_id", evt.RoomID).
+				Stringer("event_id", evt.ID).
+				Str("event_type", evt.Type.Type).
+				Logger()
+
+			var transactionID id.VerificationTransactionID
+			if evt.RoomID != "" {
+				if evt.Sender == vh.client.UserID {
+					// Ignore the echoes of our own in-room events.
+					return
+				}
+				relatable, ok := evt.Content.Parsed.(event.Relatable)
+				if !ok || relatable.OptionalGetRelatesTo().GetReferenceID() == "" {
+					log.Warn().Msg("Ignoring in-room verification event without a reference to the request")
+					return
+				}
+				transactionID = id.VerificationTransactionID(relatable.OptionalGetRelatesTo().GetReferenceID())
+			} else if txnable, ok := evt.Content.Parsed.(event.VerificationTransactionable); !ok {
+				log.Warn().Msg("Ignoring verification event without a transaction ID")
+				return
+			} else {
+				transactionID = txnable.GetTransactionID()
+			}
+			log = log.With().Stringer("transaction_id", transactionID).Logger()
+
+			vh.activeTransactionsLock.Lock()
+			txn, ok := vh.activeTransactions[transactionID]
+			var theirDevice id.DeviceID
+			if ok {
+				theirDevice = txn.TheirDevice
+			}
+			vh.activeTransactionsLock.Unlock()
+			if !ok {
+				if evt.Type.Type == event.ToDeviceVerificationCancel.Type {
+					// Never respond to a cancellation with another cancellation,
+					// otherwise two devices could keep cancelling each other.
+					log.Debug().Msg("Ignoring cancellation for an unknown transaction")
+					return
+				} else if evt.RoomID != "" {
+					// In-room verifications in shared rooms may be between
+					// other users, so they must not be cancelled.
+					log.Debug().Msg("Ignoring in-room verification event for an unknown transaction")
+					return
+				}
+				fromDevice, _ := evt.Content.Raw["from_device"].(string)
+				if fromDevice == "" {
+					// There's no device to send the cancellation to.
+					log.Warn().Msg("Ignoring verification event for an unknown transaction")
+					return
+				}
+				log.Warn().Msg("Ignoring verification event for an unknown transaction and sending cancellation")
+
+				// We have to create a fake transaction so that the call to
+				// sendVerificationEvent works.
+				txn = &verificationTransaction{
+					TheirUser:     evt.Sender,
+					TheirDevice:   id.DeviceID(fromDevice),
+					TransactionID: transactionID,
+				}
+				if err := vh.sendVerificationEvent(ctx, txn, event.InRoomVerificationCancel, &event.VerificationCancelEventContent{
+					Code:   event.VerificationCancelCodeUnknownTransaction,
+					Reason: "The transaction ID was not recognized.",
+				}); err != nil {
+					log.Err(err).Msg("Failed to send cancellation event")
+				}
+				return
+			} else if txn.TheirUser != evt.Sender {
+				log.Warn().
+					Stringer("expected_sender", txn.TheirUser).
+					Msg("Ignoring verification event from unexpected sender")
+				return
+			} else if senderDevice := getToDeviceSenderDevice(evt); evt.RoomID == "" && theirDevice != "" && senderDevice != "" && senderDevice != theirDevice {
+				log.Warn().
+					Stringer("expected_device", theirDevice).
+					Stringer("sender_device", senderDevice).
+					Msg("Ignoring verification event from unexpected device")
+				return
+			}
+
+			logCtx := vh.getLog(ctx).With().
+				Stringer("transaction_step", txn.VerificationState).
+				Stringer("sender", evt.Sender)
+			if evt.RoomID != "" {
+				logCtx = logCtx.
+					Stringer("room_id", evt.RoomID).
+					Stringer("event_id", evt.ID)
+			}
+			callback(logCtx.Logger().WithContext(ctx), txn, evt)
+		}
+	}
+
+	// Use the wrapper for the rest of the event types, both for to-device
+	// and in-room verification.
+	syncer.OnEventType(event.ToDeviceVerificationCancel, wrapHandler(vh.onVerificationCancel))
+	syncer.OnEventType(event.InRoomVerificationCancel, wrapHandler(vh.onVerificationCancel))
+	syncer.OnEventType(event.ToDeviceVerificationReady, wrapHandler(vh.onVerificationReady))
+	syncer.OnEventType(event.InRoomVerificationReady, wrapHandler(vh.onVerificationReady))
+	syncer.OnEventType(event.ToDeviceVerificationStart, wrapHandler(vh.onVerificationStart))
+	syncer.OnEventType(event.InRoomVerificationStart, wrapHandler(vh.onVerificationStart))
+	syncer.OnEventType(event.ToDeviceVerificationDone, wrapHandler(vh.onVerificationDone))
+	syncer.OnEventType(event.InRoomVerificationDone, wrapHandler(vh.onVerificationDone))
+	syncer.OnEventType(event.ToDeviceVerificationKey, wrapHandler(vh.onVerificationKey))
+	syncer.OnEventType(event.InRoomVerificationKey, wrapHandler(vh.onVerificationKey))
+	syncer.OnEventType(event.ToDeviceVerificationMAC, wrapHandler(vh.onVerificationMAC))
+	syncer.OnEventType(event.InRoomVerificationMAC, wrapHandler(vh.onVerificationMAC))
+	syncer.OnEventType(event.ToDeviceVerificationAccept, wrapHandler(vh.onVerificationAccept))
+	syncer.OnEventType(event.InRoomVerificationAccept, wrapHandler(vh.onVerificationAccept))
+
+	return nil
+}
+
+// StartVerification starts an interactive verification flow with the given
+// user via a to-device event. The request is sent to all of the user's
+// devices (except our own device if verifying ourselves).
+func (vh *VerificationHelper) StartVerification(ctx context.Context, to id.UserID) (id.VerificationTransactionID, error) {
+	if len(vh.supportedMethods) == 0 {
+		return "", fmt.Errorf("no supported verification methods")
+	}
+
+	txnID := id.NewVerificationTransactionID()
+	log := vh.getLog(ctx).With().
+		Str("verification_action", "start verification").
+		Stringer("transaction_id", txnID).
+		Stringer("to", to).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	devices, err := vh.mach.FetchKeys(ctx, []id.UserID{to}, true)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch devices of %s: %w", to, err)
+	}
+	content := &event.Content{
+		Parsed: &event.VerificationRequestEventContent{
+			ToDeviceVerificationEvent: event.ToDeviceVerificationEvent{TransactionID: txnID},
+			FromDevice:                vh.client.DeviceID,
+			Methods:                   vh.supportedMethods,
+			Timestamp:                 jsontime.UnixMilliNow(),
+		},
+	}
+	req := mautrix.ReqSendToDevice{Messages: map[id.UserID]map[id.DeviceID]*event.Content{to: {}}}
+	var sentTo []id.DeviceID
+	for deviceID := range devices[to] {
+		if to == vh.client.UserID && deviceID == vh.client.DeviceID {
+			// Don't ask ourselves to verify.
+			continue
+		}
+		req.Messages[to][deviceID] = content
+		sentTo = append(sentTo, deviceID)
+	}
+	if len(sentTo) == 0 {
+		return "", fmt.Errorf("no devices found for %s", to)
+	}
+	log.Info().Any("device_ids", sentTo).Msg("Sending verification request")
+	_, err = vh.client.SendToDevice(ctx, event.ToDeviceVerificationRequest, &req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send verification request: %w", err)
+	}
+
+	vh.activeTransactionsLock.Lock()
+	defer vh.unlockTransactions()
+	vh.activeTransactions[txnID] = &verificationTransaction{
+		VerificationState: verificationStateRequested,
+		TransactionID:     txnID,
+		TheirUser:         to,
+		SentToDeviceIDs:   sentTo,
+	}
+	return txnID, nil
+}
+
+// StartInRoomVerification starts an interactive verification flow with the
+// given user in the given room. The transaction ID is the event ID of the
+// request event.
+func (vh *VerificationHelper) StartInRoomVerification(ctx context.Context, roomID id.RoomID, to id.UserID) (id.VerificationTransactionID, error) {
+	if len(vh.supportedMethods) == 0 {
+		return "", fmt.Errorf("no supported verification methods")
+	}
+
+	log := vh.getLog(ctx).With().
+		Str("verification_action", "start in-room verification").
+		Stringer("room_id", roomID).
+		Stringer("to", to).
+		Logger()
+
+	log.Info().Msg("Sending verification request")
+	content := event.MessageEventContent{
+		MsgType:    event.MsgVerificationRequest,
+		Body:       fmt.Sprintf("%s is requesting to verify your key, but your client does not support in-chat key verification.", vh.client.UserID),
+		FromDevice: vh.client.DeviceID,
+		Methods:    vh.supportedMethods,
+		To:         to,
+	}
+	resp, err := vh.client.SendMessageEvent(ctx, roomID, event.EventMessage, &content)
+	if err != nil {
+		return "", fmt.Errorf("failed to send verification request: %w", err)
+	}
+
+	txnID := id.VerificationTransactionID(resp.EventID)
+	log.Info().Stringer("transaction_id", txnID).Msg("Got a transaction ID for the verification request")
+
+	vh.activeTransactionsLock.Lock()
+	defer vh.unlockTransactions()
+	vh.activeTransactions[txnID] = &verificationTransaction{
+		RoomID:            roomID,
+		VerificationState: verificationStateRequested,
+		TransactionID:     txnID,
+		TheirUser:         to,
+	}
+	return txnID, nil
+}
+
+// AcceptVerification accepts a verification request. The transaction ID
+// should be the transaction ID of a verification request that was received
+// via the VerificationRequested callback in [RequiredCallbacks].
+func (vh *VerificationHelper) AcceptVerification(ctx context.Context, txnID id.VerificationTransactionID) error {
+	vh.activeTransactionsLock.Lock()
+	defer vh.unlockTransactions()
+
+	log := vh.getLog(ctx).With().
+		Str("verification_action", "accept verification").
+		Stringer("transaction_id", txnID).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	txn, ok := vh.activeTransactions[txnID]
+	if !ok {
+		return ErrUnknownTransaction
+	} else if txn.VerificationState != verificationStateRequested {
+		return fmt.Errorf("%w: %s", ErrUnexpectedState, txn.VerificationState)
+	}
+
+	log.Info().Msg("Sending ready event")
+	readyEvt := &event.VerificationReadyEventContent{
+		FromDevice: vh.client.DeviceID,
+		Methods:    vh.supportedMethods,
+	}
+	err := vh.sendVerificationEvent(ctx, txn, event.InRoomVerificationReady, readyEvt)
+	if err != nil {
+		return err
+	}
+	txn.VerificationState = verificationStateReady
+
+	vh.showQRCodeIfSupported(ctx, txn)
+	return nil
+}
+
+// DismissVerification dismisses the verification request with the given
+// transaction ID. The transaction ID should be one received via the
+// VerificationRequested callback in [RequiredCallbacks] or the
+// [StartVerification] or [StartInRoomVerification] functions.
+//
+// Dismissing does not send a cancellation to the other device, so it's only
+// allowed before the request has been accepted.
+func (vh *VerificationHelper) DismissVerification(ctx context.Context, txnID id.VerificationTransactionID) error {
+	vh.activeTransactionsLock.Lock()
+	defer vh.unlockTransactions()
+	txn, ok := vh.activeTransactions[txnID]
+	if !ok {
+		return ErrUnknownTransaction
+	} else if txn.VerificationState != verificationStateRequested {
+		return fmt.Errorf("%w: can't dismiss a verification in state %s", ErrUnexpectedState, txn.VerificationState)
+	}
+	delete(vh.activeTransactions, txnID)
+	return nil
+}
+
+// CancelVerification cancels a verification request. The transaction ID
+// should be the transaction ID of a verification request that was received
+// via the VerificationRequested callback in [RequiredCallbacks].
+func (vh *VerificationHelper) CancelVerification(ctx context.Context, txnID id.VerificationTransactionID, code event.VerificationCancelCode, reason string) error {
+	vh.activeTransactionsLock.Lock()
+	defer vh.unlockTransactions()
+	txn, ok := vh.activeTransactions[txnID]
+	if !ok {
+		return ErrUnknownTransaction
+	}
+	log := vh.getLog(ctx).With().
+		Str("verification_action", "cancel verification").
+		Stringer("transaction_id", txnID).
+		Str("code", string(code)).
+		Str("reason", reason).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	log.Info().Msg("Sending cancellation event")
+	cancelEvt := &event.VerificationCancelEventContent{Code: code, Reason: reason}
+	if len(txn.SentToDeviceIDs) > 0 && txn.TheirDevice == "" {
+		// The request hasn't been accepted by any device yet, so cancel it
+		// on all of the devices it was sent to.
+		err := vh.sendToDevices(ctx, txn, txn.SentToDeviceIDs, event.ToDeviceVerificationCancel, cancelEvt)
+		if err != nil {
+			return err
+		}
+	} else if err := vh.sendVerificationEvent(ctx, txn, event.InRoomVerificationCancel, cancelEvt); err != nil {
+		return err
+	}
+	txn.VerificationState = verificationStateCancelled
+	delete(vh.activeTransactions, txnID)
+	return nil
+}
+
+// sendVerificationEvent sends a verification event to the other device of the
+// transaction. It handles both to-device and in-room transports: the given
+// event type is only used for its name, the class is determined by the
+// transaction.
+//
+// Must always be called with the activeTransactionsLock held.
+func (vh *VerificationHelper) sendVerificationEvent(ctx context.Context, txn *verificationTransaction, evtType event.Type, content any) error {
+	log := vh.getLog(ctx).With().
+		Stringer("transaction_id", txn.TransactionID).
+		Str("event_type", evtType.Type).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	if txn.RoomID != "" {
+		content.(event.Relatable).SetRelatesTo(&event.RelatesTo{Type: event.RelReference, EventID: id.EventID(txn.TransactionID)})
+		evtType = event.Type{Type: evtType.Type, Class: event.MessageEventType}
+		_, err := vh.client.SendMessageEvent(ctx, txn.RoomID, evtType, content)
+		if err != nil {
+			return fmt.Errorf("failed to send %s event to %s: %w", evtType.Type, txn.RoomID, err)
+		}
+	} else {
+		evtType = event.Type{Type: evtType.Type, Class: event.ToDeviceEventType}
+		if err := vh.sendToDevices(ctx, txn, []id.DeviceID{txn.TheirDevice}, evtType, content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendToDevices sends a to-device verification event to the given devices of
+// the other user.
+func (vh *VerificationHelper) sendToDevices(ctx context.Context, txn *verificationTransaction, deviceIDs []id.DeviceID, evtType event.Type, content any) error {
+	content.(event.VerificationTransactionable).SetTransactionID(txn.TransactionID)
+	req := mautrix.ReqSendToDevice{Messages: map[id.UserID]map[id.DeviceID]*event.Content{txn.TheirUser: {}}}
+	for _, deviceID := range deviceIDs {
+		req.Messages[txn.TheirUser][deviceID] = &event.Content{Parsed: content}
+	}
+	_, err := vh.client.SendToDevice(ctx, evtType, &req)
+	if err != nil {
+		return fmt.Errorf("failed to send %s event to %s: %w", evtType.Type, txn.TheirUser, err)
+	}
+	return nil
+}
+
+// cancelVerificationTxn sends a cancellation event to the other device,
+// removes the transaction and queues the VerificationCancelled callback.
+//
+// Must always be called with the activeTransactionsLock held.
+func (vh *VerificationHelper) cancelVerificationTxn(ctx context.Context, txn *verificationTransaction, code event.VerificationCancelCode, reasonFmtStr string, fmtArgs ...any) {
+	reason := fmt.Sprintf(reasonFmtStr, fmtArgs...)
+	log := vh.getLog(ctx).With().
+		Stringer("transaction_id", txn.TransactionID).
+		Str("code", string(code)).
+		Str("reason", reason).
+		Logger()
+	ctx = log.WithContext(ctx)
+	log.Info().Msg("Sending cancellation event")
+	cancelEvt := &event.VerificationCancelEventContent{Code: code, Reason: reason}
+	if err := vh.sendVerificationEvent(ctx, txn, event.InRoomVerificationCancel, cancelEvt); err != nil {
+		log.Err(err).Msg("Failed to send cancellation event")
+	}
+	txn.VerificationState = verificationStateCancelled
+	delete(vh.activeTransactions, txn.TransactionID)
+	txnID := txn.TransactionID
+	vh.queueCallback(func() { vh.verificationCancelled(ctx, txnID, code, reason) })
+}
+
+func (vh *VerificationHelper) onVerificationRequest(ctx context.Context, evt *event.Event) {
+	logCtx := vh.getLog(ctx).With().
+		Str("verification_action", "verification request").
+		Stringer("sender", evt.Sender)
+	if evt.RoomID != "" {
+		logCtx = logCtx.
+			Stringer("room_id", evt.RoomID).
+			Stringer("event_id", evt.ID)
+	}
+	log := logCtx.Logger()
+
+	var verificationRequest *event.VerificationRequestEventContent
+	switch evt.Type.Class {
+	case event.ToDeviceEventType:
+		var ok bool
+		verificationRequest, ok = evt.Content.Parsed.(*event.VerificationRequestEventContent)
+		if !ok {
+			log.Warn().Type("content_type", evt.Content.Parsed).Msg("Ignoring verification request event with unexpected content type")
+			return
+		}
+	case event.MessageEventType:
+		if evt.Sender == vh.client.UserID {
+			// Ignore the echo of our own in-room request.
+			return
+		} else if to := evt.Content.AsMessage().To; to != vh.client.UserID {
+			log.Info().Stringer("to", to).Msg("Ignoring verification request for another user")
+			return
+		}
+		verificationRequest = event.VerificationRequestEventContentFromMessage(evt)
+	default:
+		log.Warn().Str("type_class", evt.Type.Class.Name()).Msg("Ignoring verification request event with unexpected type class")
+		return
+	}
+
+	if verificationRequest.FromDevice == vh.client.DeviceID && evt.Sender == vh.client.UserID {
+		log.Debug().Msg("Ignoring verification request from our own device")
+		return
+	} else if verificationRequest.TransactionID == "" {
+		log.Warn().Msg("Ignoring verification request without a transaction ID")
+		return
+	}
+	log = log.With().
+		Stringer("transaction_id", verificationRequest.TransactionID).
+		Stringer("from_device", verificationRequest.FromDevice).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	// The spec says that requests older than 10 minutes or more than 5
+	// minutes in the future should be ignored.
+	ts := verificationRequest.Timestamp.Time
+	if !verificationRequest.Timestamp.IsZero() && (time.Since(ts) > 10*time.Minute || time.Until(ts) > 5*time.Minute) {
+		log.Warn().Time("timestamp", ts).Msg("Ignoring verification request with timestamp too far in the past or future")
+		return
+	}
+
+	log.Info().Any("methods", verificationRequest.Methods).Msg("Received verification request")
+	vh.activeTransactionsLock.Lock()
+	existing, ok := vh.activeTransactions[verificationRequest.TransactionID]
+	if ok {
+		vh.activeTransactionsLock.Unlock()
+		log.Warn().Stringer("state", existing.VerificationState).Msg("Ignoring verification request for an already active transaction")
+		return
+	}
+	vh.activeTransactions[verificationRequest.TransactionID] = &verificationTransaction{
+		RoomID:            evt.RoomID,
+		VerificationState: verificationStateRequested,
+		TransactionID:     verificationRequest.TransactionID,
+		TheirDevice:       verificationRequest.FromDevice,
+		TheirUser:         evt.Sender,
+		SupportedMethods:  verificationRequest.Methods,
+	}
+	vh.activeTransactionsLock.Unlock()
+
+	vh.verificationRequested(ctx, verificationRequest.TransactionID, evt.Sender, verificationRequest.FromDevice)
+}
+
+func (vh *VerificationHelper) onVerificationReady(ctx context.Context, txn *verificationTransaction, evt *event.Event) {
+	log := vh.getLog(ctx).With().
+		Str("verification_action", "verification ready").
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	vh.activeTransactionsLock.Lock()
+	defer vh.unlockTransactions()
+
+	if txn.VerificationState != verificationStateRequested {
+		log.Warn().Msg("Ignoring verification ready event for a transaction that is not in the requested state")
+		return
+	}
+
+	readyEvt := evt.Content.AsVerificationReady()
+
+	// Cancel the request on all of the other devices that it was sent to.
+	if txn.RoomID == "" {
+		var otherDevices []id.DeviceID
+		for _, deviceID := range txn.SentToDeviceIDs {
+			if deviceID != readyEvt.FromDevice {
+				otherDevices = append(otherDevices, deviceID)
+			}
+		}
+		if len(otherDevices) > 0 {
+			err := vh.sendToDevices(ctx, txn, otherDevices, event.ToDeviceVerificationCancel, &event.VerificationCancelEventContent{
+				Code:   event.VerificationCancelCodeAccepted,
+				Reason: "The verification was accepted on another device.",
+			})
+			if err != nil {
+				log.Warn().Err(err).Msg("Failed to send cancellation requests to other devices")
+			}
+		}
+	}
+
+	txn.VerificationState = verificationStateReady
+	txn.TheirDevice = readyEvt.FromDevice
+	txn.SupportedMethods = readyEvt.Methods
+
+	log.Info().Any("methods", txn.SupportedMethods).Msg("Verification request was accepted")
+	if vh.scanQRCode != nil && slices.Contains(vh.supportedMethods, event.VerificationMethodQRCodeScan) &&
+		slices.Contains(txn.SupportedMethods, event.VerificationMethodQRCodeShow) {
+		txnID := txn.TransactionID
+		vh.queueCallback(func() { vh.scanQRCode(ctx, txnID) })
+	}
+	vh.showQRCodeIfSupported(ctx, txn)
+}
+
+// showQRCodeIfSupported generates our QR code and queues the ShowQRCode
+// callback if both sides support QR code verification in our direction.
+//
+// Must always be called with the activeTransactionsLock held.
+func (vh *VerificationHelper) showQRCodeIfSupported(ctx context.Context, txn *verificationTransaction) {
+	if vh.showQRCode == nil || !slices.Contains(txn.SupportedMethods, event.VerificationMethodQRCodeScan) {
+		return
+	}
+	qrCode, err := vh.generateQRCode(ctx, txn)
+	if err != nil {
+		vh.getLog(ctx).Err(err).Msg("Failed to generate QR code")
+		return
+	} else if qrCode != nil {
+		txnID := txn.TransactionID
+		vh.queueCallback(func() { vh.showQRCode(ctx, txnID, qrCode) })
+	}
+}
+
+func (vh *VerificationHelper) onVerificationStart(ctx context.Context, txn *verificationTransaction, evt *event.Event) {
+	startEvt := evt.Content.AsVerificationStart()
+	log := vh.getLog(ctx).With().
+		Str("verification_action", "verification start").
+		Str("method", string(startEvt.Method)).
+		Logger()
+	ctx = log.WithContext(ctx)
+	log.Info().Msg("Received verification start event")
+
+	vh.activeTransactionsLock.Lock()
+	defer vh.unlockTransactions()
+
+	if txn.VerificationState == verificationStateSASStarted || txn.VerificationState == verificationStateOurQRScanned || txn.VerificationState == verificationStateTheirQRScanned {
+		// We might have sent the event, and they also sent an event. The spec
+		// says that the user or device with the lexicographically smaller ID
+		// wins and the other start event is ignored.
+		if txn.TheirUser < vh.client.UserID || (txn.TheirUser == vh.client.UserID && txn.TheirDevice < vh.client.DeviceID) {
+			log.Debug().Msg("Using their start event instead of ours because they are lexicographically smaller")
+			txn.StartedByUs = false
+			txn.VerificationState = verificationStateReady
+		} else {
+			log.Debug().Msg("Ignoring their start event because we are lexicographically smaller")
+			return
+		}
+	} else if txn.VerificationState != verificationStateReady {
+		vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeUnexpectedMessage, "got start event for transaction that is not in ready state")
+		return
+	}
+
+	switch startEvt.Method {
+	case event.VerificationMethodSAS:
+		txn.StartEventJSON = evt.Content.VeryRaw
+		if err := vh.onVerificationStartSAS(ctx, txn, evt); err != nil {
+			vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeUser, "failed to handle SAS verification start: %v", err)
+		}
+	case event.VerificationMethodReciprocate:
+		log.Info().Msg("Received reciprocate start event")
+		if vh.qrCodeScanned == nil || len(txn.QRCodeSharedSecret) == 0 {
+			vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeUnknownMethod, "we did not show a QR code")
+			return
+		} else if !bytes.Equal(txn.QRCodeSharedSecret, startEvt.Secret) {
+			vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeKeyMismatch, "reciprocated shared secret does not match")
+			return
+		}
+		txn.VerificationState = verificationStateOurQRScanned
+		txnID := txn.TransactionID
+		vh.queueCallback(func() { vh.qrCodeScanned(ctx, txnID) })
+	default:
+		// Note that we should never get m.qr_code.show.v1 or
+		// m.qr_code.scan.v1 here, since the start command for scanning and
+		// showing QR codes should be of type m.reciprocate.v1.
+		log.Error().Str("method", string(startEvt.Method)).Msg("Unsupported verification method in start event")
+		vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeUnknownMethod, "unknown method %s", startEvt.Method)
+	}
+}
+
+func (vh *VerificationHelper) onVerificationDone(ctx context.Context, txn *verificationTransaction, evt *event.Event) {
+	log := vh.getLog(ctx).With().
+		Str("verification_action", "done").
+		Logger()
+	ctx = log.WithContext(ctx)
+	log.Info().Msg("Verification done")
+
+	vh.activeTransactionsLock.Lock()
+	defer vh.unlockTransactions()
+
+	if txn.VerificationState != verificationStateTheirQRScanned &&
+		txn.VerificationState != verificationStateOurQRScanned &&
+		txn.VerificationState != verificationStateSASMACExchanged &&
+		txn.VerificationState != verificationStateSASKeysExchanged {
+		vh.cancelVerificationTxn(ctx, txn, event.VerificationCancelCodeUnexpectedMessage, "got done event for transaction that is not in QR-scanned or MAC-exchanged state")
+		return
+	}
+
+	txn.ReceivedTheirDone = true
+	if txn.SentOurDone {
+		vh.finishTransaction(ctx, txn)
+	}
+}
+
+func (vh *VerificationHelper) onVerificationCancel(ctx context.Context, txn *verificationTransaction, evt *event.Event) {
+	cancelEvt := evt.Content.AsVerificationCancel()
+	log := vh.getLog(ctx).With().
+		Str("verification_action", "cancel").
+		Stringer("transaction_id", txn.TransactionID).
+		Str("cancel_code", string(cancelEvt.Code)).
+		Str("reason", cancelEvt.Reason).
+		Logger()
+	ctx = log.WithContext(ctx)
+	log.Info().Msg("Verification was cancelled")
+
+	vh.activeTransactionsLock.Lock()
+	defer vh.unlockTransactions()
+
+	// Element (and at least the old desktop client) send cancellation events
+	// when the user rejects the verification request. This is really dumb,
+	// because they should just instead ignore the request and not send a
+	// cancellation.
+	//
+	// The above behavior causes a problem with the other devices that we sent
+	// the verification request to because they don't know that the request
+	// was cancelled.
+	//
+	// As a workaround, if we receive a cancellation event to a transaction
+	// that is currently in the REQUESTED state, then we will send
+	// cancellations to all of the devices that we sent the request to. This
+	// will ensure that all of the clients know that the request was
+	// cancelled.
+	if txn.VerificationState == verificationStateRequested && len(txn.SentToDeviceIDs) > 0 {
+		fromDevice, _ := evt.Content.Raw["from_device"].(string)
+		var otherDevices []id.DeviceID
+		for _, deviceID := range txn.SentToDeviceIDs {
+			if deviceID != txn.TheirDevice && deviceID != id.DeviceID(fromDevice) {
+				otherDevices = append(otherDevices, deviceID)
+			}
+		}
+		if len(otherDevices) > 0 {
+			err := vh.sendToDevices(ctx, txn, otherDevices, event.ToDeviceVerificationCancel, &event.VerificationCancelEventContent{
+				Code:   event.VerificationCancelCodeUser,
+				Reason: "The verification was rejected from another device.",
+			})
+			if err != nil {
+				log.Warn().Err(err).Msg("Failed to send cancellation requests to other devices")
+			}
+		}
+	}
+
+	txn.VerificationState = verificationStateCancelled
+	delete(vh.activeTransactions, txn.TransactionID)
+	txnID := txn.TransactionID
+	vh.queueCallback(func() { vh.verificationCancelled(ctx, txnID, cancelEvt.Code, cancelEvt.Reason) })
+}
+
+// sendDone sends the m.key.verification.done event and finishes the
+// transaction if the other device has already sent theirs.
+//
+// Must always be called with the activeTransactionsLock held.
+func (vh *VerificationHelper) sendDone(ctx context.Context, txn *verificationTransaction) error {
+	err := vh.sendVerificationEvent(ctx, txn, event.InRoomVerificationDone, &event.VerificationDoneEventContent{})
+	if err != nil {
+		return err
+	}
+	txn.SentOurDone = true
+	if txn.ReceivedTheirDone {
+		vh.finishTransaction(ctx, txn)
+	}
+	return nil
+}
+
+// finishTransaction marks the transaction as done, removes it and queues
+// the VerificationDone callback.
+//
+// Must always be called with the activeTransactionsLock held.
+func (vh *VerificationHelper) finishTransaction(ctx context.Context, txn *verificationTransaction) {
+	vh.getLog(ctx).Info().Stringer("transaction_id", txn.TransactionID).Msg("Verification transaction is done")
+	txn.VerificationState = verificationStateDone
+	delete(vh.activeTransactions, txn.TransactionID)
+	txnID := txn.TransactionID
+	vh.queueCallback(func() { vh.verificationDone(ctx, txnID) })
+}
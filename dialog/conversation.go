@@ -0,0 +1,166 @@
+package dialog
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/De-IM/mautrix"
+	"github.com/De-IM/mautrix/event"
+)
+
+// inputBufferSize is the number of inputs that are buffered for a dialog while
+// its handler isn't waiting for input.
+const inputBufferSize = 8
+
+// allInputTypes are the input types that Await waits for if no types are given.
+var allInputTypes = []InputType{InputMessage, InputButton, InputSelectMenu, InputCommand}
+
+// Conversation is a single running dialog with a user in a room.
+type Conversation struct {
+	// State is the persisted state of the dialog. Changes to it are saved by
+	// Save, SetStep and Await.
+	State *State
+
+	mgr    *Manager
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	inputs chan *Input
+
+	awaiting     []InputType
+	awaitingLock sync.Mutex
+}
+
+func (mgr *Manager) newConversation(ctx context.Context, state *State) *Conversation {
+	log := zerolog.Ctx(ctx).With().
+		Str("dialog", state.Dialog).
+		Stringer("room_id", state.RoomID).
+		Stringer("user_id", state.UserID).
+		Logger()
+	ctx, cancel := context.WithCancelCause(log.WithContext(context.WithoutCancel(ctx)))
+	if state.Data == nil {
+		state.Data = make(map[string]string)
+	}
+	return &Conversation{
+		State:  state,
+		mgr:    mgr,
+		ctx:    ctx,
+		cancel: cancel,
+		inputs: make(chan *Input, inputBufferSize),
+
+		awaiting: state.Awaiting,
+	}
+}
+
+// accepts returns whether the dialog is waiting for input of the given type.
+func (conv *Conversation) accepts(inputType InputType) bool {
+	conv.awaitingLock.Lock()
+	defer conv.awaitingLock.Unlock()
+	return slices.Contains(conv.awaiting, inputType)
+}
+
+func (conv *Conversation) key() stateKey {
+	return stateKey{conv.State.RoomID, conv.State.UserID}
+}
+
+// Save persists the current state of the dialog.
+func (conv *Conversation) Save(ctx context.Context) error {
+	if conv.ctx.Err() != nil {
+		// Don't resurrect the state of a cancelled dialog
+		return context.Cause(conv.ctx)
+	}
+	err := conv.mgr.Store.PutDialogState(ctx, conv.State)
+	if err != nil {
+		return fmt.Errorf("failed to save dialog state: %w", err)
+	}
+	return nil
+}
+
+// SetStep records how far the dialog has progressed and saves the state.
+func (conv *Conversation) SetStep(ctx context.Context, step string) error {
+	conv.State.Step = step
+	return conv.Save(ctx)
+}
+
+// Get returns a value stored in the dialog state.
+func (conv *Conversation) Get(key string) string {
+	return conv.State.Data[key]
+}
+
+// Set stores a value in the dialog state. The value is persisted on the next
+// call to Save, SetStep or Await.
+func (conv *Conversation) Set(key, value string) {
+	conv.State.Data[key] = value
+}
+
+// Await waits for the next input of one of the given types from the user. If
+// no types are given, any input is accepted. Inputs of other types aren't
+// consumed by the dialog, so [Manager.Middleware] passes them on to the next
+// handler.
+//
+// If no input arrives within the manager's timeout, [ErrTimeout] is returned.
+// If the dialog is cancelled, [ErrCancelled] is returned.
+func (conv *Conversation) Await(ctx context.Context, types ...InputType) (*Input, error) {
+	if len(types) == 0 {
+		types = allInputTypes
+	}
+	conv.awaitingLock.Lock()
+	conv.awaiting = types
+	conv.awaitingLock.Unlock()
+	timeout := conv.mgr.timeout()
+	conv.State.Awaiting = types
+	conv.State.ExpiresAt = time.Now().Add(timeout)
+	if err := conv.Save(ctx); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case input := <-conv.inputs:
+			if slices.Contains(types, input.Type) {
+				return input, nil
+			}
+			// The input was buffered while an earlier Await was waiting for different types
+			zerolog.Ctx(ctx).Debug().
+				Str("input_type", string(input.Type)).
+				Msg("Ignoring dialog input of unexpected type")
+		case <-timer.C:
+			return nil, ErrTimeout
+		case <-conv.ctx.Done():
+			return nil, context.Cause(conv.ctx)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// AwaitText waits for the next plain message from the user and returns its body.
+func (conv *Conversation) AwaitText(ctx context.Context) (string, error) {
+	input, err := conv.Await(ctx, InputMessage)
+	if err != nil {
+		return "", err
+	}
+	return input.Text, nil
+}
+
+// Send sends a message to the room of the conversation. The manager must have
+// a client.
+func (conv *Conversation) Send(ctx context.Context, content *event.MessageEventContent) (*mautrix.RespSendEvent, error) {
+	if conv.mgr.Client == nil {
+		return nil, fmt.Errorf("dialog manager doesn't have a client to send messages with")
+	}
+	return conv.mgr.Client.SendMessageEvent(ctx, conv.State.RoomID, event.EventMessage, content)
+}
+
+// SendText sends a plain text notice to the room of the conversation.
+func (conv *Conversation) SendText(ctx context.Context, text string) (*mautrix.RespSendEvent, error) {
+	return conv.Send(ctx, &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    text,
+	})
+}
@@ -0,0 +1,128 @@
+package dialog
+
+import (
+	"strings"
+
+	"github.com/De-IM/mautrix/event"
+	"github.com/De-IM/mautrix/id"
+)
+
+// InputType is the type of user input that a dialog can wait for.
+type InputType string
+
+const (
+	InputMessage    InputType = "message"
+	InputButton     InputType = "button"
+	InputSelectMenu InputType = "select_menu"
+	InputCommand    InputType = "command"
+)
+
+// Input is a single message, button click, select menu choice or command sent
+// by the user that a dialog is talking to.
+type Input struct {
+	Type   InputType
+	Event  *event.Event
+	RoomID id.RoomID
+	Sender id.UserID
+
+	// Text is the body of the message for InputMessage.
+	Text string
+	// Message is the parsed content for InputMessage and InputCommand.
+	Message *event.MessageEventContent
+	// Command is the received command for InputCommand.
+	Command *event.BotCommand
+	// Interaction is the parsed content for InputButton and InputSelectMenu.
+	Interaction *event.InteractionEventContent
+	// CallbackData is the callback data of the clicked button for InputButton.
+	CallbackData string
+	// CustomID and Values are the custom ID and the selected values for InputSelectMenu.
+	CustomID string
+	Values   []string
+}
+
+// Option returns the value of the given command option. It's only useful for
+// InputCommand.
+func (input *Input) Option(name string) (string, bool) {
+	if input.Command == nil {
+		return "", false
+	}
+	for _, opt := range input.Command.Options {
+		if opt.Name == name {
+			return opt.Value, true
+		}
+	}
+	return "", false
+}
+
+func (input *Input) isCancel(cancelCommands []string) bool {
+	var name string
+	switch input.Type {
+	case InputCommand:
+		name = input.Command.Command
+	case InputMessage:
+		if !strings.HasPrefix(input.Text, "/") {
+			return false
+		}
+		name = strings.Fields(input.Text + " ")[0]
+	default:
+		return false
+	}
+	name = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(name), "/"))
+	for _, cancelCommand := range cancelCommands {
+		if name == cancelCommand {
+			return true
+		}
+	}
+	return false
+}
+
+// InputFromEvent converts a m.room.message or fi.mau.interaction event into an
+// Input. If the event isn't something a dialog can wait for, nil is returned.
+func InputFromEvent(evt *event.Event) *Input {
+	input := &Input{
+		Event:  evt,
+		RoomID: evt.RoomID,
+		Sender: evt.Sender,
+	}
+	switch evt.Type.Type {
+	case event.EventMessage.Type:
+		content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+		if !ok || content.RelatesTo.GetReplaceID() != "" {
+			return nil
+		}
+		input.Message = content
+		if content.MsgType == event.MsgCommand && content.BotCommand != nil {
+			input.Type = InputCommand
+			input.Command = content.BotCommand
+		} else {
+			input.Type = InputMessage
+			input.Text = content.Body
+		}
+	case event.EventInteraction.Type:
+		content, ok := evt.Content.Parsed.(*event.InteractionEventContent)
+		if !ok {
+			return nil
+		}
+		input.Interaction = content
+		if input.RoomID == "" {
+			input.RoomID = content.RoomID
+		}
+		switch content.Type {
+		case event.InteractionTypeButton:
+			input.Type = InputButton
+			input.CallbackData = content.CallbackData
+		case event.InteractionTypeSelectMenu:
+			input.Type = InputSelectMenu
+			input.CustomID = content.CustomID
+			input.Values = content.Values
+		default:
+			return nil
+		}
+	default:
+		return nil
+	}
+	if input.RoomID == "" {
+		return nil
+	}
+	return input
+}
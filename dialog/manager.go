@@ -0,0 +1,331 @@
+// Package dialog implements multi-step conversations between bots and users,
+// such as "ask for X, then Y, then confirm" flows.
+//
+// Each dialog is keyed on a room and a user. A dialog handler can wait for the
+// next message, button click, select menu choice or command from that user with
+// [Conversation.Await]. The state of active dialogs is persisted in a [Store]
+// so that dialogs can be resumed after a restart.
+package dialog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/De-IM/mautrix"
+	"github.com/De-IM/mautrix/event"
+	"github.com/De-IM/mautrix/id"
+)
+
+var (
+	ErrTimeout       = errors.New("timed out waiting for input")
+	ErrCancelled     = errors.New("dialog was cancelled")
+	ErrUnknownDialog = errors.New("unknown dialog")
+)
+
+// DefaultTimeout is the default time that [Conversation.Await] waits for input.
+const DefaultTimeout = 5 * time.Minute
+
+// Handler runs a dialog. It's called when the dialog is started, and again if
+// the dialog is resumed after a restart. In the latter case, the input that
+// resumed the dialog is returned by the first call to [Conversation.Await],
+// and the handler should use the step stored in the conversation state to
+// know where to continue.
+//
+// If the handler returns [ErrTimeout] (e.g. by passing through the error from
+// Await), [Manager.OnTimeout] is called.
+type Handler func(ctx context.Context, conv *Conversation) error
+
+// Manager keeps track of active dialogs and passes user input to them.
+type Manager struct {
+	// Client is used for sending messages in conversations and for ignoring
+	// events sent by the bot itself. It may be nil.
+	Client *mautrix.Client
+	Store  Store
+
+	// Timeout is the time that Await waits for input. Defaults to DefaultTimeout.
+	Timeout time.Duration
+	// CancelCommands are the command names (without the slash) that cancel the
+	// active dialog. Defaults to "cancel".
+	CancelCommands []string
+
+	// OnTimeout is called when a dialog times out waiting for input.
+	OnTimeout func(ctx context.Context, state *State)
+	// OnCancel is called when a dialog is cancelled by the user or by Cancel.
+	OnCancel func(ctx context.Context, state *State)
+	// OnError is called when a dialog handler returns an error. If nil, the
+	// error is only logged.
+	OnError func(ctx context.Context, state *State, err error)
+
+	handlers map[string]Handler
+	active   map[stateKey]*Conversation
+	lock     sync.Mutex
+}
+
+// NewManager creates a new dialog manager. If store is nil, dialogs are only
+// kept in memory.
+func NewManager(client *mautrix.Client, store Store) *Manager {
+	if store == nil {
+		store = NewMemoryStore()
+	}
+	return &Manager{
+		Client:   client,
+		Store:    store,
+		handlers: make(map[string]Handler),
+		active:   make(map[stateKey]*Conversation),
+	}
+}
+
+// Register adds a dialog handler with the given name. The name is persisted in
+// the dialog state, so it should stay the same across restarts.
+func (mgr *Manager) Register(name string, handler Handler) {
+	if handler == nil {
+		panic("dialog: handler must not be nil")
+	}
+	mgr.lock.Lock()
+	mgr.handlers[name] = handler
+	mgr.lock.Unlock()
+}
+
+func (mgr *Manager) timeout() time.Duration {
+	if mgr.Timeout > 0 {
+		return mgr.Timeout
+	}
+	return DefaultTimeout
+}
+
+func (mgr *Manager) cancelCommands() []string {
+	if mgr.CancelCommands != nil {
+		return mgr.CancelCommands
+	}
+	return []string{"cancel"}
+}
+
+// Start starts the dialog with the given name with the given user in the given
+// room. Any previously active dialog with the user in the room is replaced.
+// The handler is run in a new goroutine.
+func (mgr *Manager) Start(ctx context.Context, name string, roomID id.RoomID, userID id.UserID) error {
+	mgr.lock.Lock()
+	handler, ok := mgr.handlers[name]
+	mgr.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownDialog, name)
+	}
+	state := &State{
+		RoomID: roomID,
+		UserID: userID,
+		Dialog: name,
+		Data:   make(map[string]string),
+	}
+	err := mgr.Store.PutDialogState(ctx, state)
+	if err != nil {
+		return fmt.Errorf("failed to save dialog state: %w", err)
+	}
+	conv := mgr.newConversation(ctx, state)
+	mgr.lock.Lock()
+	if previous, ok := mgr.active[conv.key()]; ok {
+		previous.cancel(ErrCancelled)
+	}
+	mgr.active[conv.key()] = conv
+	mgr.lock.Unlock()
+	go mgr.run(conv, handler)
+	return nil
+}
+
+// Cancel cancels the active dialog with the given user in the given room and
+// calls OnCancel. It does nothing if there's no active dialog.
+func (mgr *Manager) Cancel(ctx context.Context, roomID id.RoomID, userID id.UserID) error {
+	key := stateKey{roomID, userID}
+	mgr.lock.Lock()
+	conv, ok := mgr.active[key]
+	delete(mgr.active, key)
+	mgr.lock.Unlock()
+	var state *State
+	if ok {
+		conv.cancel(ErrCancelled)
+		state = conv.State.clone()
+	} else {
+		var err error
+		state, err = mgr.Store.GetDialogState(ctx, roomID, userID)
+		if err != nil {
+			return fmt.Errorf("failed to get dialog state: %w", err)
+		} else if state == nil {
+			return nil
+		}
+	}
+	err := mgr.Store.DeleteDialogState(ctx, roomID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete dialog state: %w", err)
+	}
+	if mgr.OnCancel != nil {
+		mgr.OnCancel(ctx, state)
+	}
+	return nil
+}
+
+// ExpireDialogs removes the persisted state of dialogs that timed out while
+// the program wasn't running and calls OnTimeout for each of them. Dialogs
+// that are running are timed out by Await instead.
+func (mgr *Manager) ExpireDialogs(ctx context.Context) error {
+	expired, err := mgr.Store.GetExpiredDialogStates(ctx, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to get expired dialog states: %w", err)
+	}
+	for _, state := range expired {
+		mgr.lock.Lock()
+		_, isActive := mgr.active[stateKey{state.RoomID, state.UserID}]
+		mgr.lock.Unlock()
+		if !isActive {
+			mgr.expire(ctx, state)
+		}
+	}
+	return nil
+}
+
+func (mgr *Manager) expire(ctx context.Context, state *State) {
+	err := mgr.Store.DeleteDialogState(ctx, state.RoomID, state.UserID)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).
+			Stringer("room_id", state.RoomID).
+			Stringer("user_id", state.UserID).
+			Msg("Failed to delete expired dialog state")
+	}
+	if mgr.OnTimeout != nil {
+		mgr.OnTimeout(ctx, state)
+	}
+}
+
+// HandleEvent passes the given m.room.message or fi.mau.interaction event to the
+// active dialog of the sender in the room, resuming the dialog from the store
+// if necessary. It returns true if the event was consumed by a dialog. Events
+// of a type that the dialog isn't waiting for aren't consumed.
+func (mgr *Manager) HandleEvent(ctx context.Context, evt *event.Event) bool {
+	input := InputFromEvent(evt)
+	if input == nil || (mgr.Client != nil && input.Sender == mgr.Client.UserID) {
+		return false
+	}
+	key := stateKey{input.RoomID, input.Sender}
+	mgr.lock.Lock()
+	conv, isActive := mgr.active[key]
+	mgr.lock.Unlock()
+	if input.isCancel(mgr.cancelCommands()) {
+		if !isActive {
+			state, err := mgr.Store.GetDialogState(ctx, input.RoomID, input.Sender)
+			if err != nil || state == nil {
+				return false
+			}
+		}
+		if err := mgr.Cancel(ctx, input.RoomID, input.Sender); err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to cancel dialog")
+		}
+		return true
+	}
+	if !isActive {
+		conv = mgr.resume(ctx, key, input.Type)
+		if conv == nil {
+			return false
+		}
+	} else if !conv.accepts(input.Type) {
+		return false
+	}
+	select {
+	case conv.inputs <- input:
+	default:
+		zerolog.Ctx(ctx).Warn().
+			Stringer("room_id", input.RoomID).
+			Stringer("sender", input.Sender).
+			Str("dialog", conv.State.Dialog).
+			Msg("Dropping dialog input as the input buffer is full")
+	}
+	return true
+}
+
+func (mgr *Manager) resume(ctx context.Context, key stateKey, inputType InputType) *Conversation {
+	log := zerolog.Ctx(ctx).With().
+		Stringer("room_id", key.roomID).
+		Stringer("user_id", key.userID).
+		Logger()
+	state, err := mgr.Store.GetDialogState(ctx, key.roomID, key.userID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get dialog state")
+		return nil
+	} else if state == nil {
+		return nil
+	} else if !state.ExpiresAt.IsZero() && state.ExpiresAt.Before(time.Now()) {
+		mgr.expire(ctx, state)
+		return nil
+	} else if !slices.Contains(state.Awaiting, inputType) {
+		return nil
+	}
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+	if conv, ok := mgr.active[key]; ok {
+		// Another event resumed the dialog concurrently
+		return conv
+	}
+	handler, ok := mgr.handlers[state.Dialog]
+	if !ok {
+		log.Warn().Str("dialog", state.Dialog).Msg("Dropping state of unknown dialog")
+		err = mgr.Store.DeleteDialogState(ctx, key.roomID, key.userID)
+		if err != nil {
+			log.Err(err).Msg("Failed to delete dialog state")
+		}
+		return nil
+	}
+	log.Debug().Str("dialog", state.Dialog).Str("step", state.Step).Msg("Resuming dialog")
+	conv := mgr.newConversation(ctx, state)
+	mgr.active[key] = conv
+	go mgr.run(conv, handler)
+	return conv
+}
+
+// Middleware wraps the given event handler so that events consumed by a
+// dialog aren't passed to it. For example, to give dialogs precedence over
+// bot commands:
+//
+//	syncer.OnEventType(event.EventMessage, mgr.Middleware(proc.Handle))
+func (mgr *Manager) Middleware(next mautrix.EventHandler) mautrix.EventHandler {
+	return func(ctx context.Context, evt *event.Event) {
+		if !mgr.HandleEvent(ctx, evt) {
+			next(ctx, evt)
+		}
+	}
+}
+
+func (mgr *Manager) run(conv *Conversation, handler Handler) {
+	log := zerolog.Ctx(conv.ctx)
+	err := handler(conv.ctx, conv)
+
+	mgr.lock.Lock()
+	isCurrent := mgr.active[conv.key()] == conv
+	if isCurrent {
+		delete(mgr.active, conv.key())
+	}
+	mgr.lock.Unlock()
+	conv.cancel(nil)
+	if !isCurrent {
+		// The dialog was cancelled or replaced, so the state belongs to someone else now.
+		return
+	}
+
+	ctx := context.WithoutCancel(conv.ctx)
+	if errors.Is(err, ErrTimeout) {
+		mgr.expire(ctx, conv.State)
+		return
+	}
+	if delErr := mgr.Store.DeleteDialogState(ctx, conv.State.RoomID, conv.State.UserID); delErr != nil {
+		log.Err(delErr).Msg("Failed to delete state of finished dialog")
+	}
+	if err == nil || errors.Is(err, ErrCancelled) {
+		return
+	} else if mgr.OnError != nil {
+		mgr.OnError(ctx, conv.State, err)
+	} else {
+		log.Err(err).Msg("Dialog handler returned error")
+	}
+}
@@ -0,0 +1,108 @@
+// Package sqldialogstore implements a [dialog.Store] using a SQL database.
+package sqldialogstore
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+
+	"github.com/De-IM/mautrix/dialog"
+	"github.com/De-IM/mautrix/id"
+)
+
+//go:embed *.sql
+var rawUpgrades embed.FS
+
+var UpgradeTable dbutil.UpgradeTable
+
+func init() {
+	UpgradeTable.RegisterFS(rawUpgrades)
+}
+
+const VersionTableName = "mx_dialog_version"
+
+// SQLDialogStore stores the state of active dialogs in a SQL database.
+type SQLDialogStore struct {
+	*dbutil.Database
+}
+
+var _ dialog.Store = (*SQLDialogStore)(nil)
+
+// NewSQLDialogStore creates a new dialog store. The database must be upgraded
+// with Upgrade before use.
+func NewSQLDialogStore(db *dbutil.Database, log dbutil.DatabaseLogger) *SQLDialogStore {
+	return &SQLDialogStore{
+		Database: db.Child(VersionTableName, UpgradeTable, log),
+	}
+}
+
+const (
+	getDialogStateQuery = `
+		SELECT room_id, user_id, dialog, step, data, awaiting, expires_at FROM mx_dialog_state WHERE room_id=$1 AND user_id=$2
+	`
+	putDialogStateQuery = `
+		INSERT INTO mx_dialog_state (room_id, user_id, dialog, step, data, awaiting, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (room_id, user_id) DO UPDATE
+			SET dialog=excluded.dialog, step=excluded.step, data=excluded.data, awaiting=excluded.awaiting, expires_at=excluded.expires_at
+	`
+	deleteDialogStateQuery = `
+		DELETE FROM mx_dialog_state WHERE room_id=$1 AND user_id=$2
+	`
+	getExpiredDialogStatesQuery = `
+		SELECT room_id, user_id, dialog, step, data, awaiting, expires_at FROM mx_dialog_state
+		WHERE expires_at IS NOT NULL AND expires_at<$1
+	`
+)
+
+func scanDialogState(row dbutil.Scannable) (*dialog.State, error) {
+	var state dialog.State
+	var expiresAt sql.NullInt64
+	err := row.Scan(&state.RoomID, &state.UserID, &state.Dialog, &state.Step, &dbutil.JSON{Data: &state.Data}, &dbutil.JSON{Data: &state.Awaiting}, &expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		state.ExpiresAt = time.UnixMilli(expiresAt.Int64)
+	}
+	return &state, nil
+}
+
+func (store *SQLDialogStore) GetDialogState(ctx context.Context, roomID id.RoomID, userID id.UserID) (*dialog.State, error) {
+	state, err := scanDialogState(store.QueryRow(ctx, getDialogStateQuery, roomID, userID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return state, err
+}
+
+func (store *SQLDialogStore) PutDialogState(ctx context.Context, state *dialog.State) error {
+	var expiresAt sql.NullInt64
+	if !state.ExpiresAt.IsZero() {
+		expiresAt = sql.NullInt64{Int64: state.ExpiresAt.UnixMilli(), Valid: true}
+	}
+	data := state.Data
+	if data == nil {
+		data = make(map[string]string)
+	}
+	awaiting := state.Awaiting
+	if awaiting == nil {
+		awaiting = []dialog.InputType{}
+	}
+	_, err := store.Exec(ctx, putDialogStateQuery, state.RoomID, state.UserID, state.Dialog, state.Step, dbutil.JSON{Data: data}, dbutil.JSON{Data: awaiting}, expiresAt)
+	return err
+}
+
+func (store *SQLDialogStore) DeleteDialogState(ctx context.Context, roomID id.RoomID, userID id.UserID) error {
+	_, err := store.Exec(ctx, deleteDialogStateQuery, roomID, userID)
+	return err
+}
+
+func (store *SQLDialogStore) GetExpiredDialogStates(ctx context.Context, before time.Time) ([]*dialog.State, error) {
+	rows, err := store.Query(ctx, getExpiredDialogStatesQuery, before.UnixMilli())
+	return dbutil.NewRowIterWithError(rows, scanDialogState, err).AsList()
+}
@@ -0,0 +1,15 @@
+-- v0 -> v1: Latest revision
+
+CREATE TABLE mx_dialog_state (
+	room_id    TEXT   NOT NULL,
+	user_id    TEXT   NOT NULL,
+	dialog     TEXT   NOT NULL,
+	step       TEXT   NOT NULL DEFAULT '',
+	data       jsonb  NOT NULL,
+	awaiting   jsonb  NOT NULL DEFAULT '[]',
+	expires_at BIGINT,
+
+	PRIMARY KEY (room_id, user_id)
+);
+
+CREATE INDEX mx_dialog_state_expires_at_idx ON mx_dialog_state (expires_at);
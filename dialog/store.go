@@ -0,0 +1,106 @@
+package dialog
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/De-IM/mautrix/id"
+)
+
+// State is the persisted state of a dialog with a single user in a single
+// room. It's used to resume the dialog after a restart.
+type State struct {
+	RoomID id.RoomID `json:"room_id"`
+	UserID id.UserID `json:"user_id"`
+	// Dialog is the name of the dialog handler registered in the [Manager].
+	Dialog string `json:"dialog"`
+	// Step is set by the dialog handler to record how far the dialog has
+	// progressed, so that it knows where to continue when resumed.
+	Step string `json:"step"`
+	// Data contains arbitrary values collected by the dialog so far.
+	Data map[string]string `json:"data"`
+	// Awaiting are the input types that the dialog is waiting for. Other
+	// inputs from the user aren't passed to the dialog.
+	Awaiting []InputType `json:"awaiting"`
+	// ExpiresAt is the time when the input the dialog is waiting for times out.
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (state *State) clone() *State {
+	cloned := *state
+	cloned.Data = maps.Clone(state.Data)
+	cloned.Awaiting = slices.Clone(state.Awaiting)
+	return &cloned
+}
+
+// Store persists the state of active dialogs.
+type Store interface {
+	// GetDialogState returns the state of the active dialog with the given user
+	// in the given room, or nil if there is none.
+	GetDialogState(ctx context.Context, roomID id.RoomID, userID id.UserID) (*State, error)
+	// PutDialogState inserts or replaces the state of a dialog.
+	PutDialogState(ctx context.Context, state *State) error
+	// DeleteDialogState removes the state of a dialog.
+	DeleteDialogState(ctx context.Context, roomID id.RoomID, userID id.UserID) error
+	// GetExpiredDialogStates returns the states of all dialogs that expired
+	// before the given time.
+	GetExpiredDialogStates(ctx context.Context, before time.Time) ([]*State, error)
+}
+
+type stateKey struct {
+	roomID id.RoomID
+	userID id.UserID
+}
+
+// MemoryStore is a [Store] that keeps dialog states in memory. Dialogs are
+// lost when the program restarts.
+type MemoryStore struct {
+	states map[stateKey]*State
+	lock   sync.RWMutex
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// NewMemoryStore creates a new in-memory dialog state store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{states: make(map[stateKey]*State)}
+}
+
+func (ms *MemoryStore) GetDialogState(_ context.Context, roomID id.RoomID, userID id.UserID) (*State, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	state, ok := ms.states[stateKey{roomID, userID}]
+	if !ok {
+		return nil, nil
+	}
+	return state.clone(), nil
+}
+
+func (ms *MemoryStore) PutDialogState(_ context.Context, state *State) error {
+	ms.lock.Lock()
+	ms.states[stateKey{state.RoomID, state.UserID}] = state.clone()
+	ms.lock.Unlock()
+	return nil
+}
+
+func (ms *MemoryStore) DeleteDialogState(_ context.Context, roomID id.RoomID, userID id.UserID) error {
+	ms.lock.Lock()
+	delete(ms.states, stateKey{roomID, userID})
+	ms.lock.Unlock()
+	return nil
+}
+
+func (ms *MemoryStore) GetExpiredDialogStates(_ context.Context, before time.Time) ([]*State, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	var expired []*State
+	for _, state := range ms.states {
+		if !state.ExpiresAt.IsZero() && state.ExpiresAt.Before(before) {
+			expired = append(expired, state.clone())
+		}
+	}
+	return expired, nil
+}
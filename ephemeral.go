@@ -0,0 +1,154 @@
+package mautrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/De-IM/mautrix/event"
+	"github.com/De-IM/mautrix/id"
+)
+
+// ToDeviceCryptoHelper is an optional extension of [CryptoHelper] for
+// encrypting to-device events with Olm. It's required for sending ephemeral
+// messages in encrypted rooms.
+type ToDeviceCryptoHelper interface {
+	EncryptToUserDevices(ctx context.Context, userID id.UserID, deviceIDs []id.DeviceID, evtType event.Type, content event.Content) (map[id.DeviceID]*event.Content, error)
+}
+
+var (
+	ErrToDeviceEncryptionNotSupported = errors.New("crypto helper doesn't support encrypting to-device events")
+	ErrEphemeralNoStateStore          = errors.New("client doesn't have a state store to check room encryption with")
+)
+
+// SendEphemeralMessage sends a message that is only visible to the given user
+// in the given room. The message is delivered to the user's devices as a
+// m.room.command to-device event with the ephemeral flag set instead of being
+// sent to the room timeline. If no device IDs are given, the message is sent
+// to all devices of the user.
+//
+// If the room is encrypted, the message is encrypted with Olm, which requires
+// the crypto helper to implement [ToDeviceCryptoHelper]. Messages to encrypted
+// rooms are never sent unencrypted, so ErrToDeviceEncryptionNotSupported is
+// returned if the client doesn't have a suitable crypto helper. The client
+// must have a state store to check whether the room is encrypted.
+func (cli *Client) SendEphemeralMessage(ctx context.Context, roomID id.RoomID, userID id.UserID, content *event.MessageEventContent, deviceIDs ...id.DeviceID) error {
+	if cli.StateStore == nil {
+		return ErrEphemeralNoStateStore
+	}
+	contentCopy := *content
+	contentCopy.Flags |= event.MessageFlagsEphemeral
+	wrapped := event.Content{
+		Parsed: &contentCopy,
+		Raw:    map[string]any{"room_id": roomID.String()},
+	}
+	isEncrypted, err := cli.StateStore.IsEncrypted(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("failed to check if room is encrypted: %w", err)
+	}
+	if !isEncrypted {
+		messages := make(map[id.DeviceID]*event.Content)
+		if len(deviceIDs) == 0 {
+			messages["*"] = &wrapped
+		}
+		for _, deviceID := range deviceIDs {
+			messages[deviceID] = &wrapped
+		}
+		_, err = cli.SendToDevice(ctx, event.ToDeviceCommandReply, &ReqSendToDevice{
+			Messages: map[id.UserID]map[id.DeviceID]*event.Content{userID: messages},
+		})
+		return err
+	}
+	// A nil crypto helper doesn't implement the interface either
+	encrypter, ok := cli.Crypto.(ToDeviceCryptoHelper)
+	if !ok {
+		return ErrToDeviceEncryptionNotSupported
+	}
+	messages, err := encrypter.EncryptToUserDevices(ctx, userID, deviceIDs, event.ToDeviceCommandReply, wrapped)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt ephemeral message: %w", err)
+	} else if len(messages) == 0 {
+		return fmt.Errorf("couldn't encrypt ephemeral message for any device of %s", userID)
+	}
+	_, err = cli.SendToDevice(ctx, event.ToDeviceEncrypted, &ReqSendToDevice{
+		Messages: map[id.UserID]map[id.DeviceID]*event.Content{userID: messages},
+	})
+	return err
+}
+
+// EphemeralToTimelineEvent converts an ephemeral message received as a
+// m.room.command to-device event into a pseudo m.room.message event in the
+// room the message was sent to. The returned event has no event ID, and
+// ToUserID and ToDeviceID tell which user it's visible to. The event source is
+// [event.SourceToDevice] rather than the timeline, so handlers can tell it
+// apart from real room events.
+//
+// If the event isn't an ephemeral message, if the sender isn't a member of
+// the room according to the state store, or if the event wasn't encrypted but
+// the room is, nil is returned. Events are always dropped if the client
+// doesn't have a state store.
+func (cli *Client) EphemeralToTimelineEvent(ctx context.Context, evt *event.Event) *event.Event {
+	if evt.Type.Type != event.ToDeviceCommandReply.Type {
+		return nil
+	}
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	if !ok || content.Flags&event.MessageFlagsEphemeral == 0 {
+		return nil
+	}
+	roomID, _ := evt.Content.Raw["room_id"].(string)
+	if roomID == "" || cli.StateStore == nil {
+		return nil
+	}
+	log := cli.cliOrContextLog(ctx).With().
+		Str("room_id", roomID).
+		Stringer("sender", evt.Sender).
+		Logger()
+	if !cli.StateStore.IsInRoom(ctx, id.RoomID(roomID), evt.Sender) {
+		log.Debug().Msg("Dropping ephemeral message from user who isn't in the room")
+		return nil
+	} else if evt.Mautrix.EventSource&event.SourceDecrypted == 0 {
+		isEncrypted, err := cli.StateStore.IsEncrypted(ctx, id.RoomID(roomID))
+		if err != nil {
+			log.Err(err).Msg("Failed to check if room is encrypted, dropping ephemeral message")
+			return nil
+		} else if isEncrypted {
+			log.Warn().Msg("Dropping unencrypted ephemeral message for encrypted room")
+			return nil
+		}
+	}
+	receivedAt := evt.Mautrix.ReceivedAt
+	if receivedAt.IsZero() {
+		receivedAt = time.Now()
+	}
+	return &event.Event{
+		Sender:     evt.Sender,
+		Type:       event.EventMessage,
+		Timestamp:  receivedAt.UnixMilli(),
+		RoomID:     id.RoomID(roomID),
+		Content:    evt.Content,
+		ToUserID:   evt.ToUserID,
+		ToDeviceID: evt.ToDeviceID,
+		Mautrix: event.MautrixInfo{
+			EventSource:  event.SourceToDevice | (evt.Mautrix.EventSource & event.SourceDecrypted),
+			WasEncrypted: evt.Mautrix.WasEncrypted,
+			ReceivedAt:   receivedAt,
+		},
+	}
+}
+
+// EphemeralMessageHandler wraps the given handler so that it receives
+// ephemeral messages as pseudo room events (see [Client.EphemeralToTimelineEvent]).
+// The returned handler should be registered for [event.ToDeviceCommandReply]:
+//
+//	syncer.OnEventType(event.ToDeviceCommandReply, client.EphemeralMessageHandler(handleMessage))
+//
+// Encrypted ephemeral messages are dispatched with the same type after
+// decryption when using the cryptohelper package.
+func (cli *Client) EphemeralMessageHandler(handler EventHandler) EventHandler {
+	return func(ctx context.Context, evt *event.Event) {
+		if pseudoEvt := cli.EphemeralToTimelineEvent(ctx, evt); pseudoEvt != nil {
+			handler(ctx, pseudoEvt)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package event
+
+import (
+	"strings"
+)
+
+// CardMessageBuilder builds a m.card message containing one or more cards.
+type CardMessageBuilder struct {
+	cards []*CardV2
+	body  string
+}
+
+// NewCardMessage creates a builder for a m.card message with the given cards.
+func NewCardMessage(cards ...*CardBuilder) *CardMessageBuilder {
+	mb := &CardMessageBuilder{}
+	for _, card := range cards {
+		mb.AddCard(card)
+	}
+	return mb
+}
+
+// AddCard appends a card to the message.
+func (mb *CardMessageBuilder) AddCard(card *CardBuilder) *CardMessageBuilder {
+	mb.cards = append(mb.cards, card.Build())
+	return mb
+}
+
+// Body overrides the plain text fallback body. By default, the fallback is
+// generated from the contents of the cards.
+func (mb *CardMessageBuilder) Body(body string) *CardMessageBuilder {
+	mb.body = body
+	return mb
+}
+
+// Build validates the cards and returns the message content. The returned
+// error is a [*ValidationError] if the cards aren't well-formed.
+func (mb *CardMessageBuilder) Build() (*MessageEventContent, error) {
+	cards := &MsgCardV2{CardsV2: mb.cards}
+	if err := cards.Validate(); err != nil {
+		return nil, err
+	}
+	body := mb.body
+	if body == "" {
+		body = cards.PlainText()
+	}
+	return &MessageEventContent{
+		MsgType:   MsgCard,
+		Body:      body,
+		MsgCardV2: cards,
+	}, nil
+}
+
+// CardBuilder builds a single card.
+type CardBuilder struct {
+	card *CardV2
+}
+
+// NewCard creates a builder for a card with the given ID. The ID must be
+// unique within the message.
+func NewCard(cardID string) *CardBuilder {
+	return &CardBuilder{card: &CardV2{CardId: cardID, Card: &Card{}}}
+}
+
+// Type sets the type of the card, e.g. [CardTypeApp].
+func (cb *CardBuilder) Type(cardType string) *CardBuilder {
+	cb.card.Card.Type = cardType
+	return cb
+}
+
+func (cb *CardBuilder) header() *CardHeader {
+	if cb.card.Card.Header == nil {
+		cb.card.Card.Header = &CardHeader{}
+	}
+	return cb.card.Card.Header
+}
+
+// Header sets the title and subtitle of the card header.
+func (cb *CardBuilder) Header(title, subtitle string) *CardBuilder {
+	header := cb.header()
+	header.Title = title
+	header.Subtitle = subtitle
+	return cb
+}
+
+// HeaderType sets the type of the card header, e.g. [CardHeaderTypeCard].
+func (cb *CardBuilder) HeaderType(headerType string) *CardBuilder {
+	cb.header().Type = headerType
+	return cb
+}
+
+// HeaderImage sets the image shown in the card header.
+func (cb *CardBuilder) HeaderImage(url, altText string) *CardBuilder {
+	header := cb.header()
+	header.ImageUrl = url
+	header.ImageAltText = altText
+	return cb
+}
+
+// HeaderSubtitleAction sets what happens when the header subtitle is clicked.
+func (cb *CardBuilder) HeaderSubtitleAction(onClick *OnClick) *CardBuilder {
+	cb.header().SubtitleAction = onClick
+	return cb
+}
+
+// Title sets the title line of the card with optional icons on either side.
+func (cb *CardBuilder) Title(title string, startIcon, endIcon *CardIcon) *CardBuilder {
+	cb.card.Card.Title = &CardTitle{Title: title, StartIcon: startIcon, EndIcon: endIcon}
+	return cb
+}
+
+// Body sets the description and the optional big image of the card.
+func (cb *CardBuilder) Body(description, bigImageURL string) *CardBuilder {
+	cb.card.Card.Body = &CardBody{Description: description, BigImageUrl: bigImageURL}
+	return cb
+}
+
+// OnClick sets what happens when the card itself is clicked.
+func (cb *CardBuilder) OnClick(onClick *OnClick) *CardBuilder {
+	cb.card.Card.OnClick = onClick
+	return cb
+}
+
+// Footer sets the footer icon of the card.
+func (cb *CardBuilder) Footer(icon *CardIcon) *CardBuilder {
+	cb.card.Card.Footer = icon
+	return cb
+}
+
+// Section adds a section with the given header to the card. The build
+// function is called immediately to fill in the section.
+func (cb *CardBuilder) Section(header string, build func(sb *SectionBuilder)) *CardBuilder {
+	sb := &SectionBuilder{section: &Section{Header: header}}
+	if build != nil {
+		build(sb)
+	}
+	cb.card.Card.Sections = append(cb.card.Card.Sections, sb.section)
+	return cb
+}
+
+// Build returns the card without validating it.
+func (cb *CardBuilder) Build() *CardV2 {
+	return cb.card
+}
+
+// SectionBuilder builds a single section of a card.
+type SectionBuilder struct {
+	section *Section
+}
+
+// Type sets the type of the section, e.g. [CardSectionTypeTable].
+func (sb *SectionBuilder) Type(sectionType string) *SectionBuilder {
+	sb.section.Type = sectionType
+	return sb
+}
+
+// Footer sets the footer text of the section.
+func (sb *SectionBuilder) Footer(footer string) *SectionBuilder {
+	sb.section.Footer = footer
+	return sb
+}
+
+// Collapsible makes the section collapsible so that only the first
+// uncollapsibleCount widgets are shown by default.
+func (sb *SectionBuilder) Collapsible(uncollapsibleCount int) *SectionBuilder {
+	sb.section.Collapsible = true
+	sb.section.UncollapsibleWidgetsCount = uncollapsibleCount
+	return sb
+}
+
+// Text adds a text widget with an optional icon.
+func (sb *SectionBuilder) Text(text string, icon *CardIcon) *SectionBuilder {
+	sb.section.Widgets = append(sb.section.Widgets, &Widget{
+		DecoratedText: &DecoratedText{Text: text, StartIcon: icon},
+	})
+	return sb
+}
+
+// Texts adds a text widget with multiple lines, such as a table row.
+func (sb *SectionBuilder) Texts(texts ...string) *SectionBuilder {
+	sb.section.Widgets = append(sb.section.Widgets, &Widget{
+		DecoratedText: &DecoratedText{Texts: texts},
+	})
+	return sb
+}
+
+// Buttons adds a widget containing the given buttons.
+func (sb *SectionBuilder) Buttons(buttons ...*CardButton) *SectionBuilder {
+	sb.section.Widgets = append(sb.section.Widgets, &Widget{
+		ButtonList: &ButtonList{Buttons: buttons},
+	})
+	return sb
+}
+
+// Grid adds a grid widget with the given number of columns.
+func (sb *SectionBuilder) Grid(title string, columnCount int, items ...GridItem) *SectionBuilder {
+	sb.section.Widgets = append(sb.section.Widgets, &Widget{
+		Grid: &Grid{Title: title, ColumnCount: columnCount, Items: items},
+	})
+	return sb
+}
+
+// OpenLinkOnClick returns an OnClick that opens the given URL.
+func OpenLinkOnClick(url string) *OnClick {
+	return &OnClick{OpenLink: &OpenLink{URL: url}}
+}
+
+// ActionOnClick returns an OnClick that calls the given function with the
+// parameters given as alternating keys and values.
+func ActionOnClick(function string, keyValues ...string) *OnClick {
+	action := &Action{Function: function}
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		action.Parameters = append(action.Parameters, &Parameter{Key: keyValues[i], Value: keyValues[i+1]})
+	}
+	return &OnClick{Action: action}
+}
+
+// CardLinkButton returns a card button that opens the given URL.
+func CardLinkButton(text, url string) *CardButton {
+	return &CardButton{Text: text, OnClick: OpenLinkOnClick(url)}
+}
+
+// CardActionButton returns a card button that calls the given function. See
+// [ActionOnClick] for the parameter format.
+func CardActionButton(text, function string, keyValues ...string) *CardButton {
+	return &CardButton{Text: text, OnClick: ActionOnClick(function, keyValues...)}
+}
+
+// ImageGridItem returns a grid item with the given title and image.
+func ImageGridItem(title, imageURI string) GridItem {
+	return GridItem{Title: title, Image: &Image{ImageURI: imageURI}}
+}
+
+// PlainText returns a plain text representation of the cards, which is
+// suitable as the fallback body for clients that don't support cards.
+func (m *MsgCardV2) PlainText() string {
+	if m == nil {
+		return ""
+	}
+	var lines []string
+	add := func(parts ...string) {
+		var nonEmpty []string
+		for _, part := range parts {
+			if part = strings.TrimSpace(part); part != "" {
+				nonEmpty = append(nonEmpty, part)
+			}
+		}
+		if len(nonEmpty) > 0 {
+			lines = append(lines, strings.Join(nonEmpty, " - "))
+		}
+	}
+	for i, cardV2 := range m.CardsV2 {
+		if cardV2 == nil || cardV2.Card == nil {
+			continue
+		}
+		if i > 0 && len(lines) > 0 {
+			lines = append(lines, "")
+		}
+		card := cardV2.Card
+		if card.Header != nil {
+			add(card.Header.Title, card.Header.Subtitle)
+		}
+		if card.Title != nil {
+			add(card.Title.Title)
+		}
+		if card.Body != nil {
+			add(card.Body.Description)
+		}
+		for _, section := range card.Sections {
+			if section == nil {
+				continue
+			}
+			add(section.Header)
+			for _, widget := range section.Widgets {
+				switch {
+				case widget == nil:
+				case widget.DecoratedText != nil:
+					if widget.DecoratedText.Text != "" {
+						add(widget.DecoratedText.Text)
+					} else {
+						add(strings.Join(widget.DecoratedText.Texts, " | "))
+					}
+				case widget.ButtonList != nil:
+					for _, button := range widget.ButtonList.Buttons {
+						if button == nil {
+							continue
+						} else if button.OnClick != nil && button.OnClick.OpenLink != nil {
+							add("[" + button.Text + "](" + button.OnClick.OpenLink.URL + ")")
+						} else {
+							add("[" + button.Text + "]")
+						}
+					}
+				case widget.Grid != nil:
+					add(widget.Grid.Title)
+					for _, item := range widget.Grid.Items {
+						if item.Title != "" {
+							add("• " + item.Title)
+						}
+					}
+				}
+			}
+			add(section.Footer)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
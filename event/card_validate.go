@@ -0,0 +1,205 @@
+package event
+
+import (
+	"fmt"
+)
+
+// Validate checks that the cards are well-formed: required fields are
+// present, enum values are known, grid column counts match the items and
+// URLs use allowed schemes. The returned error is a [*ValidationError].
+func (m *MsgCardV2) Validate() error {
+	if m == nil || len(m.CardsV2) == 0 {
+		return validationErr("cardsV2", ErrMissingField, "at least one card is required")
+	}
+	seenIDs := make(map[string]struct{}, len(m.CardsV2))
+	for i, card := range m.CardsV2 {
+		path := indexPath("cardsV2", i)
+		if card == nil {
+			return validationErr(path, ErrMissingField, "card must not be null")
+		} else if card.CardId == "" {
+			return validationErr(joinPath(path, "cardId"), ErrMissingField, "")
+		} else if _, seen := seenIDs[card.CardId]; seen {
+			return validationErr(joinPath(path, "cardId"), ErrConflictingFields, "duplicate card ID %q", card.CardId)
+		}
+		seenIDs[card.CardId] = struct{}{}
+		if card.Card == nil {
+			return validationErr(joinPath(path, "card"), ErrMissingField, "")
+		} else if err := card.Card.validate(joinPath(path, "card")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Card) validate(path string) error {
+	if err := validateEnum(joinPath(path, "type"), c.Type, CardTypeApp, CardTypeTrading); err != nil {
+		return err
+	}
+	if c.Header == nil && c.Title == nil && c.Body == nil && len(c.Sections) == 0 {
+		return validationErr(path, ErrMissingField, "card must have a header, title, body or sections")
+	}
+	if c.Header != nil {
+		if err := c.Header.validate(joinPath(path, "header")); err != nil {
+			return err
+		}
+	}
+	if c.Title != nil {
+		titlePath := joinPath(path, "title")
+		if c.Title.Title == "" {
+			return validationErr(joinPath(titlePath, "title"), ErrMissingField, "")
+		} else if err := c.Title.StartIcon.validate(joinPath(titlePath, "startIcon")); err != nil {
+			return err
+		} else if err = c.Title.EndIcon.validate(joinPath(titlePath, "endIcon")); err != nil {
+			return err
+		}
+	}
+	if c.Body != nil {
+		bodyPath := joinPath(path, "body")
+		if c.Body.Description == "" && c.Body.BigImageUrl == "" {
+			return validationErr(bodyPath, ErrMissingField, "body must have a description or an image")
+		} else if err := validateURL(joinPath(bodyPath, "bigImageUrl"), c.Body.BigImageUrl, imageURLSchemes); err != nil {
+			return err
+		}
+	}
+	for i, section := range c.Sections {
+		sectionPath := indexPath(joinPath(path, "sections"), i)
+		if section == nil {
+			return validationErr(sectionPath, ErrMissingField, "section must not be null")
+		} else if err := section.validate(sectionPath); err != nil {
+			return err
+		}
+	}
+	if err := c.OnClick.validate(joinPath(path, "onClick")); err != nil {
+		return err
+	}
+	return c.Footer.validate(joinPath(path, "footer"))
+}
+
+func (h *CardHeader) validate(path string) error {
+	if h.Title == "" {
+		return validationErr(joinPath(path, "title"), ErrMissingField, "")
+	} else if err := validateEnum(joinPath(path, "type"), h.Type, CardHeaderTypeDefault, CardHeaderTypeCard); err != nil {
+		return err
+	} else if err = validateURL(joinPath(path, "imageUrl"), h.ImageUrl, imageURLSchemes); err != nil {
+		return err
+	} else if h.ImageUrl == "" && (h.ImageType != "" || h.ImageAltText != "") {
+		return validationErr(joinPath(path, "imageUrl"), ErrMissingField, "image type and alt text require an image URL")
+	}
+	return h.SubtitleAction.validate(joinPath(path, "subtitleAction"))
+}
+
+func (s *Section) validate(path string) error {
+	if err := validateEnum(joinPath(path, "type"), s.Type, CardSectionTypeTable, CardSectionTypeDEFAULT); err != nil {
+		return err
+	} else if len(s.Widgets) == 0 {
+		return validationErr(joinPath(path, "widgets"), ErrMissingField, "section must have at least one widget")
+	} else if s.UncollapsibleWidgetsCount < 0 || s.UncollapsibleWidgetsCount > len(s.Widgets) {
+		return validationErr(joinPath(path, "uncollapsibleWidgetsCount"), ErrInvalidCount, "must be between 0 and the number of widgets (%d)", len(s.Widgets))
+	}
+	for i, widget := range s.Widgets {
+		if err := widget.validate(indexPath(joinPath(path, "widgets"), i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Widget) validate(path string) error {
+	if w == nil {
+		return validationErr(path, ErrMissingField, "widget must not be null")
+	}
+	var setCount int
+	for _, isSet := range []bool{w.DecoratedText != nil, w.ButtonList != nil, w.Grid != nil} {
+		if isSet {
+			setCount++
+		}
+	}
+	if setCount != 1 {
+		return validationErr(path, ErrConflictingFields, "widget must have exactly one of decoratedText, buttonList or grid")
+	}
+	switch {
+	case w.DecoratedText != nil:
+		textPath := joinPath(path, "decoratedText")
+		if w.DecoratedText.Text == "" && len(w.DecoratedText.Texts) == 0 {
+			return validationErr(joinPath(textPath, "text"), ErrMissingField, "")
+		}
+		return w.DecoratedText.StartIcon.validate(joinPath(textPath, "startIcon"))
+	case w.ButtonList != nil:
+		listPath := joinPath(path, "buttonList.buttons")
+		if len(w.ButtonList.Buttons) == 0 {
+			return validationErr(listPath, ErrMissingField, "button list must have at least one button")
+		}
+		for i, button := range w.ButtonList.Buttons {
+			if err := button.validate(indexPath(listPath, i)); err != nil {
+				return err
+			}
+		}
+	case w.Grid != nil:
+		return w.Grid.validate(joinPath(path, "grid"))
+	}
+	return nil
+}
+
+func (b *CardButton) validate(path string) error {
+	if b == nil {
+		return validationErr(path, ErrMissingField, "button must not be null")
+	} else if b.Text == "" {
+		return validationErr(joinPath(path, "text"), ErrMissingField, "")
+	} else if b.OnClick == nil {
+		return validationErr(joinPath(path, "onClick"), ErrMissingField, "")
+	}
+	return b.OnClick.validate(joinPath(path, "onClick"))
+}
+
+func (g *Grid) validate(path string) error {
+	if len(g.Items) == 0 {
+		return validationErr(joinPath(path, "items"), ErrMissingField, "grid must have at least one item")
+	} else if g.ColumnCount < 1 || g.ColumnCount > len(g.Items) {
+		return validationErr(joinPath(path, "columnCount"), ErrInvalidCount, "must be between 1 and the number of items (%d), got %d", len(g.Items), g.ColumnCount)
+	}
+	for i, item := range g.Items {
+		itemPath := indexPath(joinPath(path, "items"), i)
+		if item.Title == "" && item.Image == nil {
+			return validationErr(itemPath, ErrMissingField, "grid item must have a title or an image")
+		} else if err := validateEnum(joinPath(itemPath, "textAlignment"), item.TextAlignment, TextAlignmentLeft, TextAlignmentCenter, TextAlignmentRIGHT); err != nil {
+			return err
+		} else if item.Image != nil {
+			if item.Image.ImageURI == "" {
+				return validationErr(joinPath(itemPath, "image.imageUri"), ErrMissingField, "")
+			} else if err = validateURL(joinPath(itemPath, "image.imageUri"), item.Image.ImageURI, imageURLSchemes); err != nil {
+				return err
+			}
+		}
+	}
+	return g.OnClick.validate(joinPath(path, "onClick"))
+}
+
+func (oc *OnClick) validate(path string) error {
+	if oc == nil {
+		return nil
+	} else if (oc.OpenLink == nil) == (oc.Action == nil) {
+		return validationErr(path, ErrConflictingFields, "must have exactly one of openLink or action")
+	} else if oc.OpenLink != nil {
+		if oc.OpenLink.URL == "" {
+			return validationErr(joinPath(path, "openLink.url"), ErrMissingField, "")
+		}
+		return validateURL(joinPath(path, "openLink.url"), oc.OpenLink.URL, linkURLSchemes)
+	} else if oc.Action.Function == "" {
+		return validationErr(joinPath(path, "action.function"), ErrMissingField, "")
+	}
+	for i, param := range oc.Action.Parameters {
+		if param == nil || param.Key == "" {
+			return validationErr(fmt.Sprintf("%s.action.parameters[%d].key", path, i), ErrMissingField, "")
+		}
+	}
+	return nil
+}
+
+func (ci *CardIcon) validate(path string) error {
+	if ci == nil {
+		return nil
+	} else if ci.KnownIcon == "" && ci.Url == "" {
+		return validationErr(path, ErrMissingField, "icon must have a known icon or a URL")
+	}
+	return validateURL(joinPath(path, "url"), ci.Url, imageURLSchemes)
+}
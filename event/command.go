@@ -1,5 +1,30 @@
 package event
 
+// Command types for BotCommand.Type.
+const (
+	BotCommandTypeChat    = "chat"
+	BotCommandTypeUser    = "user"
+	BotCommandTypeMessage = "message"
+)
+
+// Option types for CommandOption.Type.
+const (
+	CommandOptionTypeString  = "string"
+	CommandOptionTypeInteger = "integer"
+	CommandOptionTypeBoolean = "boolean"
+)
+
+// Scope types for BotCommandScope.Type.
+const (
+	BotCommandScopeDefault               = "default"
+	BotCommandScopeAllPrivateChats       = "all_private_chats"
+	BotCommandScopeAllGroupChats         = "all_group_chats"
+	BotCommandScopeAllChatAdministrators = "all_chat_administrators"
+	BotCommandScopeChat                  = "chat"
+	BotCommandScopeChatAdministrators    = "chat_administrators"
+	BotCommandScopeChatMember            = "chat_member"
+)
+
 type BotCommand struct {
 	BotId        string          `json:"bot_id"`
 	Command      string          `json:"command"`
@@ -23,3 +48,18 @@ type BotCommandScope struct {
 	ChatId string `json:"chat_id" form:"chat_id"`
 	UserId string `json:"user_id" form:"user_id"`
 }
+
+// BotCommandsEventContent is the command menu of a single bot. It's published
+// in rooms as the config of a m.room.config state event with the bot's user ID
+// as the state key.
+type BotCommandsEventContent struct {
+	BotID    string       `json:"bot_id"`
+	Commands []BotCommand `json:"commands"`
+}
+
+// BotCommandMenusEventContent represents the content of a fi.mau.bot_commands
+// account data event, which contains the command menus of bots for a user,
+// keyed by the bot's user ID.
+type BotCommandMenusEventContent struct {
+	Menus map[string][]BotCommand `json:"menus"`
+}
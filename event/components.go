@@ -183,7 +183,8 @@ type Button struct {
 	Style ButtonStyle     `json:"style,omitempty"`
 	Emoji *ComponentEmoji `json:"emoji,omitempty"`
 
-	// NOTE: Only button with LinkButton style can have link. Also, URL is mutually exclusive with CustomID.
+	// NOTE: Only button with LinkButton style can have link. Buttons with a URL
+	// and no style default to LinkButton. Also, URL is mutually exclusive with CustomID.
 	URL string `json:"url,omitempty"`
 }
 
@@ -230,6 +231,21 @@ type LoginURL struct {
 	RequestWriteAccess bool `json:"request_write_access,omitempty"`
 }
 
+// GetStyle returns the style of the button. If the style isn't set, buttons
+// with a URL default to LinkButton and other buttons to PrimaryButton.
+//
+// The default is only used for validating and rendering buttons, the JSON
+// output still defaults to PrimaryButton, so link buttons should set their
+// style explicitly before being sent.
+func (b Button) GetStyle() ButtonStyle {
+	if b.Style != 0 {
+		return b.Style
+	} else if b.URL != "" {
+		return LinkButton
+	}
+	return PrimaryButton
+}
+
 // MarshalJSON is a method for marshaling Button to a JSON object.
 func (b Button) MarshalJSON() ([]byte, error) {
 	type button Button
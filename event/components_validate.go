@@ -0,0 +1,333 @@
+package event
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// Limits for message components.
+const (
+	MaxComponentRows           = 5
+	MaxButtonsPerRow           = 5
+	MaxSelectMenuOptions       = 25
+	MaxCallbackDataLength      = 64
+	MaxCustomIDLength          = 100
+	MaxButtonTextLength        = 80
+	MaxSelectPlaceholderLength = 150
+	MaxSelectOptionLength      = 100
+	MaxTextInputLabelLength    = 45
+	MaxTextInputLength         = 4000
+)
+
+// ValidateComponents checks the given component rows against the limits and
+// consistency rules of message components. Unlike the Validate methods of
+// cards, it reports every violation: the returned error is a
+// [ValidationErrors] containing the path of each invalid field, such as
+// `components[0][1].callback_data`.
+func ValidateComponents(rows [][]MessageComponent) error {
+	var errs ValidationErrors
+	validateComponentRows("components", rows, &errs)
+	return errs.orNil()
+}
+
+// Validate checks that the cards and components in the message are valid.
+// See [MsgCardV2.Validate] and [ValidateComponents] for the rules.
+func (content *MessageEventContent) Validate() error {
+	var errs ValidationErrors
+	if content.MsgCardV2 != nil {
+		if err := content.MsgCardV2.Validate(); err != nil {
+			var ve *ValidationError
+			if errors.As(err, &ve) {
+				ve.Path = joinPath("cards", ve.Path)
+			}
+			errs.addErr(err)
+		}
+	} else if content.MsgType == MsgCard {
+		errs.add("cards", ErrMissingField, "m.card messages must have cards")
+	}
+	validateComponentRows("components", content.Components, &errs)
+	return errs.orNil()
+}
+
+func validateComponentRows(path string, rows [][]MessageComponent, errs *ValidationErrors) {
+	if len(rows) > MaxComponentRows {
+		errs.add(path, ErrInvalidCount, "at most %d rows are allowed, got %d", MaxComponentRows, len(rows))
+	}
+	for i, row := range rows {
+		rowPath := indexPath(path, i)
+		// An actions row may be used to wrap the whole row.
+		if len(row) == 1 {
+			switch typed := row[0].(type) {
+			case *ActionsRow:
+				row = typed.Components
+				rowPath = joinPath(indexPath(rowPath, 0), "components")
+			case ActionsRow:
+				row = typed.Components
+				rowPath = joinPath(indexPath(rowPath, 0), "components")
+			}
+		}
+		validateComponentRow(rowPath, i, row, errs)
+	}
+}
+
+func validateComponentRow(path string, rowIndex int, row []MessageComponent, errs *ValidationErrors) {
+	if len(row) == 0 {
+		errs.add(path, ErrMissingField, "row must have at least one component")
+		return
+	}
+	var buttonCount int
+	for i, component := range row {
+		componentPath := indexPath(path, i)
+		switch typed := component.(type) {
+		case *Button:
+			buttonCount++
+			typed.validate(componentPath, rowIndex == 0 && i == 0, errs)
+		case Button:
+			buttonCount++
+			typed.validate(componentPath, rowIndex == 0 && i == 0, errs)
+		case *SelectMenu:
+			typed.validate(componentPath, errs)
+		case SelectMenu:
+			typed.validate(componentPath, errs)
+		case *TextInput:
+			typed.validate(componentPath, errs)
+		case TextInput:
+			typed.validate(componentPath, errs)
+		case *ActionsRow, ActionsRow:
+			errs.add(componentPath, ErrConflictingFields, "actions rows can't be nested inside other rows")
+			continue
+		case nil:
+			errs.add(componentPath, ErrMissingField, "component must not be null")
+			continue
+		}
+		if component.Type() != ButtonComponent && len(row) > 1 {
+			errs.add(componentPath, ErrConflictingFields, "%s components must be alone in their row", componentTypeName(component.Type()))
+		}
+	}
+	if buttonCount > MaxButtonsPerRow {
+		errs.add(path, ErrInvalidCount, "at most %d buttons are allowed per row, got %d", MaxButtonsPerRow, buttonCount)
+	}
+}
+
+func componentTypeName(ct ComponentType) string {
+	switch ct {
+	case ActionsRowComponent:
+		return "actions row"
+	case ButtonComponent:
+		return "button"
+	case TextInputComponent:
+		return "text input"
+	case SelectMenuComponent, UserSelectMenuComponent, RoleSelectMenuComponent,
+		MentionableSelectMenuComponent, ChannelSelectMenuComponent:
+		return "select menu"
+	default:
+		return fmt.Sprintf("type %d", ct)
+	}
+}
+
+func validateMaxLength(path, value string, maxLength int, errs *ValidationErrors) {
+	if length := utf8.RuneCountInString(value); length > maxLength {
+		errs.add(path, ErrInvalidCount, "must be at most %d characters, got %d", maxLength, length)
+	}
+}
+
+// Validate checks the button on its own. Rules that depend on the position of
+// the button, such as Pay buttons having to be first, are only checked by
+// [ValidateComponents].
+func (b Button) Validate() error {
+	var errs ValidationErrors
+	b.validate("", true, &errs)
+	return errs.orNil()
+}
+
+func (b *Button) validate(path string, isFirst bool, errs *ValidationErrors) {
+	if b.Text == "" && (b.Emoji == nil || (b.Emoji.Name == "" && b.Emoji.ID == "")) {
+		errs.add(joinPath(path, "text"), ErrMissingField, "button must have text or an emoji")
+	}
+	validateMaxLength(joinPath(path, "text"), b.Text, MaxButtonTextLength, errs)
+	if b.Style > LinkButton {
+		errs.add(joinPath(path, "style"), ErrInvalidEnumValue, "unknown button style %d", b.Style)
+	}
+	style := b.GetStyle()
+
+	var actions []string
+	if b.URL != "" {
+		actions = append(actions, "url")
+	}
+	if b.CallbackData != nil {
+		actions = append(actions, "callback_data")
+	}
+	if b.LoginURL != nil {
+		actions = append(actions, "login_url")
+	}
+	if b.WebApp != nil {
+		actions = append(actions, "web_app")
+	}
+	if b.SwitchInlineQuery != nil {
+		actions = append(actions, "switch_inline_query")
+	}
+	if b.SwitchInlineQueryCurrentChat != nil {
+		actions = append(actions, "switch_inline_query_current_chat")
+	}
+	if b.CallbackGame != nil {
+		actions = append(actions, "callback_game")
+	}
+	if b.Pay {
+		actions = append(actions, "pay")
+	}
+	if len(actions) == 0 && style != LinkButton {
+		errs.add(path, ErrMissingField, "button must have an action such as callback_data or url")
+	} else if len(actions) > 1 {
+		errs.add(path, ErrConflictingFields, "button must have exactly one action, got %v", actions)
+	}
+
+	if style == LinkButton {
+		if b.URL == "" {
+			errs.add(joinPath(path, "url"), ErrMissingField, "link buttons must have a URL")
+		}
+		if b.CallbackData != nil {
+			errs.add(joinPath(path, "callback_data"), ErrConflictingFields, "link buttons can't have callback data")
+		}
+	} else if b.URL != "" {
+		errs.add(joinPath(path, "url"), ErrConflictingFields, "only link style buttons can have a URL")
+	}
+	errs.addErr(validateURL(joinPath(path, "url"), b.URL, linkURLSchemes))
+
+	if b.CallbackData != nil {
+		if length := len(*b.CallbackData); length < 1 || length > MaxCallbackDataLength {
+			errs.add(joinPath(path, "callback_data"), ErrInvalidCount, "must be 1-%d bytes, got %d", MaxCallbackDataLength, length)
+		}
+	}
+	if b.LoginURL != nil {
+		if b.LoginURL.URL == "" {
+			errs.add(joinPath(path, "login_url.url"), ErrMissingField, "")
+		}
+		errs.addErr(validateURL(joinPath(path, "login_url.url"), b.LoginURL.URL, linkURLSchemes))
+	}
+	if b.WebApp != nil {
+		if b.WebApp.URL == "" {
+			errs.add(joinPath(path, "web_app.url"), ErrMissingField, "")
+		}
+		errs.addErr(validateURL(joinPath(path, "web_app.url"), b.WebApp.URL, []string{"https"}))
+	}
+	if b.Pay && !isFirst {
+		errs.add(joinPath(path, "pay"), ErrConflictingFields, "pay buttons must be the first button in the first row")
+	}
+}
+
+// Validate checks the select menu against the limits of select menus.
+func (s SelectMenu) Validate() error {
+	var errs ValidationErrors
+	s.validate("", &errs)
+	return errs.orNil()
+}
+
+func (s *SelectMenu) validate(path string, errs *ValidationErrors) {
+	if s.CustomID == "" {
+		errs.add(joinPath(path, "custom_id"), ErrMissingField, "")
+	}
+	validateMaxLength(joinPath(path, "custom_id"), s.CustomID, MaxCustomIDLength, errs)
+	validateMaxLength(joinPath(path, "placeholder"), s.Placeholder, MaxSelectPlaceholderLength, errs)
+
+	isStringMenu := s.Type() == SelectMenuComponent
+	switch s.Type() {
+	case SelectMenuComponent, UserSelectMenuComponent, RoleSelectMenuComponent,
+		MentionableSelectMenuComponent, ChannelSelectMenuComponent:
+	default:
+		errs.add(joinPath(path, "type"), ErrInvalidEnumValue, "unknown select menu type %d", s.MenuType)
+	}
+
+	optionsPath := joinPath(path, "options")
+	if isStringMenu && len(s.Options) == 0 {
+		errs.add(optionsPath, ErrMissingField, "string select menus must have options")
+	} else if !isStringMenu && len(s.Options) > 0 {
+		errs.add(optionsPath, ErrConflictingFields, "only string select menus can have options")
+	} else if len(s.Options) > MaxSelectMenuOptions {
+		errs.add(optionsPath, ErrInvalidCount, "at most %d options are allowed, got %d", MaxSelectMenuOptions, len(s.Options))
+	}
+	seenValues := make(map[string]struct{}, len(s.Options))
+	var defaultCount int
+	for i, opt := range s.Options {
+		optPath := indexPath(optionsPath, i)
+		if opt.Label == "" {
+			errs.add(joinPath(optPath, "label"), ErrMissingField, "")
+		}
+		if opt.Value == "" {
+			errs.add(joinPath(optPath, "value"), ErrMissingField, "")
+		} else if _, seen := seenValues[opt.Value]; seen {
+			errs.add(joinPath(optPath, "value"), ErrConflictingFields, "duplicate option value %q", opt.Value)
+		}
+		seenValues[opt.Value] = struct{}{}
+		validateMaxLength(joinPath(optPath, "label"), opt.Label, MaxSelectOptionLength, errs)
+		validateMaxLength(joinPath(optPath, "value"), opt.Value, MaxSelectOptionLength, errs)
+		validateMaxLength(joinPath(optPath, "description"), opt.Description, MaxSelectOptionLength, errs)
+		if opt.Default {
+			defaultCount++
+		}
+	}
+
+	if isStringMenu && len(s.DefaultValues) > 0 {
+		errs.add(joinPath(path, "default_values"), ErrConflictingFields, "string select menus must use option defaults instead")
+	}
+	if len(s.ChannelTypes) > 0 && s.Type() != ChannelSelectMenuComponent {
+		errs.add(joinPath(path, "channel_types"), ErrConflictingFields, "only channel select menus can have channel types")
+	}
+
+	minValues := 1
+	if s.MinValues != nil {
+		minValues = *s.MinValues
+		if minValues < 0 || minValues > MaxSelectMenuOptions {
+			errs.add(joinPath(path, "min_values"), ErrInvalidCount, "must be between 0 and %d, got %d", MaxSelectMenuOptions, minValues)
+		}
+	}
+	maxValues := s.MaxValues
+	if maxValues == 0 {
+		maxValues = 1
+	} else if maxValues < 1 || maxValues > MaxSelectMenuOptions {
+		errs.add(joinPath(path, "max_values"), ErrInvalidCount, "must be between 1 and %d, got %d", MaxSelectMenuOptions, maxValues)
+	}
+	if minValues > maxValues {
+		errs.add(joinPath(path, "min_values"), ErrInvalidCount, "must not be greater than max_values (%d)", maxValues)
+	}
+	if isStringMenu && len(s.Options) > 0 && maxValues > len(s.Options) {
+		errs.add(joinPath(path, "max_values"), ErrInvalidCount, "must not be greater than the number of options (%d)", len(s.Options))
+	}
+	if defaultCount+len(s.DefaultValues) > maxValues {
+		errs.add(optionsPath, ErrInvalidCount, "at most %d options can be selected by default, got %d", maxValues, defaultCount+len(s.DefaultValues))
+	}
+}
+
+// Validate checks the text input against the limits of text inputs.
+func (m TextInput) Validate() error {
+	var errs ValidationErrors
+	m.validate("", &errs)
+	return errs.orNil()
+}
+
+func (m *TextInput) validate(path string, errs *ValidationErrors) {
+	if m.CustomID == "" {
+		errs.add(joinPath(path, "custom_id"), ErrMissingField, "")
+	}
+	validateMaxLength(joinPath(path, "custom_id"), m.CustomID, MaxCustomIDLength, errs)
+	if m.Label == "" {
+		errs.add(joinPath(path, "label"), ErrMissingField, "")
+	}
+	validateMaxLength(joinPath(path, "label"), m.Label, MaxTextInputLabelLength, errs)
+	if m.Style != TextInputShort && m.Style != TextInputParagraph {
+		errs.add(joinPath(path, "style"), ErrInvalidEnumValue, "unknown text input style %d", m.Style)
+	}
+	if m.MinLength < 0 || m.MinLength > MaxTextInputLength {
+		errs.add(joinPath(path, "min_length"), ErrInvalidCount, "must be between 0 and %d, got %d", MaxTextInputLength, m.MinLength)
+	}
+	maxLength := m.MaxLength
+	if maxLength == 0 {
+		maxLength = MaxTextInputLength
+	} else if maxLength < 1 || maxLength > MaxTextInputLength {
+		errs.add(joinPath(path, "max_length"), ErrInvalidCount, "must be between 1 and %d, got %d", MaxTextInputLength, maxLength)
+	}
+	if m.MinLength > maxLength {
+		errs.add(joinPath(path, "min_length"), ErrInvalidCount, "must not be greater than max_length (%d)", maxLength)
+	}
+	validateMaxLength(joinPath(path, "value"), m.Value, maxLength, errs)
+}
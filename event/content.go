@@ -58,6 +58,7 @@ var TypeMap = map[Type]reflect.Type{
 
 	EventUnstablePollStart:    reflect.TypeOf(PollStartEventContent{}),
 	EventUnstablePollResponse: reflect.TypeOf(PollResponseEventContent{}),
+	EventInteraction:          reflect.TypeOf(InteractionEventContent{}),
 
 	BeeperMessageStatus: reflect.TypeOf(BeeperMessageStatusEventContent{}),
 
@@ -67,6 +68,7 @@ var TypeMap = map[Type]reflect.Type{
 	AccountDataIgnoredUserList: reflect.TypeOf(IgnoredUserListEventContent{}),
 	AccountDataMarkedUnread:    reflect.TypeOf(MarkedUnreadEventContent{}),
 	AccountDataBeeperMute:      reflect.TypeOf(BeeperMuteEventContent{}),
+	AccountDataBotCommands:     reflect.TypeOf(BotCommandMenusEventContent{}),
 
 	EphemeralEventTyping:   reflect.TypeOf(TypingEventContent{}),
 	EphemeralEventReceipt:  reflect.TypeOf(ReceiptEventContent{}),
@@ -90,6 +92,7 @@ var TypeMap = map[Type]reflect.Type{
 	ToDeviceSecretSend:       reflect.TypeOf(SecretSendEventContent{}),
 	ToDeviceDummy:            reflect.TypeOf(DummyEventContent{}),
 	ToDeviceCommandReply:     reflect.TypeOf(MessageEventContent{}),
+	ToDeviceInteraction:      reflect.TypeOf(InteractionEventContent{}),
 
 	ToDeviceVerificationRequest: reflect.TypeOf(VerificationRequestEventContent{}),
 	ToDeviceVerificationReady:   reflect.TypeOf(VerificationReadyEventContent{}),
@@ -609,3 +612,10 @@ func (content *Content) AsVerificationMAC() *VerificationMACEventContent {
 	}
 	return casted
 }
+func (content *Content) AsInteraction() *InteractionEventContent {
+	casted, ok := content.Parsed.(*InteractionEventContent)
+	if !ok {
+		return &InteractionEventContent{}
+	}
+	return casted
+}
@@ -24,10 +24,13 @@ const (
 	SourceEphemeral
 	SourceToDevice
 	SourceDecrypted
+	SourceKnock
+	// SourceBackfill is set for timeline events that were missed in a limited sync and fetched afterwards.
+	SourceBackfill
 )
 
 const primaryTypes = SourcePresence | SourceAccountData | SourceToDevice | SourceTimeline | SourceState
-const roomSections = SourceJoin | SourceInvite | SourceLeave
+const roomSections = SourceJoin | SourceInvite | SourceLeave | SourceKnock
 const roomableTypes = SourceAccountData | SourceTimeline | SourceState
 const encryptableTypes = roomableTypes | SourceToDevice
 
@@ -55,6 +58,8 @@ func (es Source) String() string {
 			typeName = "invited room " + typeName
 		case SourceLeave:
 			typeName = "left room " + typeName
+		case SourceKnock:
+			typeName = "knocked room " + typeName
 		default:
 			return fmt.Sprintf("unknown (%s+%d)", typeName, es)
 		}
@@ -64,6 +69,10 @@ func (es Source) String() string {
 		typeName += " (decrypted)"
 		es &^= SourceDecrypted
 	}
+	if es&SourceTimeline != 0 && es&SourceBackfill != 0 {
+		typeName += " (backfilled)"
+		es &^= SourceBackfill
+	}
 	es &^= primaryTypes
 	if es != 0 {
 		return fmt.Sprintf("unknown (%s+%d)", typeName, es)
@@ -0,0 +1,52 @@
+package event
+
+import (
+	"github.com/De-IM/mautrix/id"
+)
+
+// InteractionType is the type of the component that was interacted with.
+type InteractionType string
+
+const (
+	InteractionTypeButton     InteractionType = "button"
+	InteractionTypeSelectMenu InteractionType = "select_menu"
+)
+
+// InteractionEventContent represents the content of a fi.mau.interaction event,
+// which clients send when the user clicks a button or chooses options in a
+// select menu of a message with components.
+//
+// The in-room version references the message containing the component with
+// a m.reference relation. The to-device version additionally includes the
+// room ID.
+type InteractionEventContent struct {
+	Type InteractionType `json:"type"`
+	// CallbackData is the callback data of the clicked button.
+	CallbackData string `json:"callback_data,omitempty"`
+	// CustomID is the custom ID of the select menu.
+	CustomID string `json:"custom_id,omitempty"`
+	// Values are the values of the selected options in a select menu.
+	Values []string `json:"values,omitempty"`
+
+	// RoomID is the room containing the message. Only used for to-device interactions.
+	RoomID id.RoomID `json:"room_id,omitempty"`
+	// FromDevice is the device ID of the user who interacted with the message.
+	FromDevice id.DeviceID `json:"from_device,omitempty"`
+
+	RelatesTo *RelatesTo `json:"m.relates_to,omitempty"`
+}
+
+func (content *InteractionEventContent) GetRelatesTo() *RelatesTo {
+	if content.RelatesTo == nil {
+		content.RelatesTo = &RelatesTo{}
+	}
+	return content.RelatesTo
+}
+
+func (content *InteractionEventContent) OptionalGetRelatesTo() *RelatesTo {
+	return content.RelatesTo
+}
+
+func (content *InteractionEventContent) SetRelatesTo(rel *RelatesTo) {
+	content.RelatesTo = rel
+}
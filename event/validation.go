@@ -0,0 +1,118 @@
+package event
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+var (
+	ErrMissingField      = errors.New("missing required field")
+	ErrInvalidEnumValue  = errors.New("invalid enum value")
+	ErrInvalidURL        = errors.New("invalid URL")
+	ErrInvalidCount      = errors.New("invalid count")
+	ErrConflictingFields = errors.New("conflicting fields")
+)
+
+// ValidationError is returned by the Validate methods of rich message content
+// such as cards. Path is the JSON path of the invalid field, for example
+// `cardsV2[0].card.sections[1].widgets[0].grid.columnCount`.
+type ValidationError struct {
+	Path string
+	Err  error
+	// Reason is an optional human-readable explanation of what's wrong.
+	Reason string
+}
+
+func (ve *ValidationError) Error() string {
+	if ve.Reason != "" {
+		return fmt.Sprintf("%s: %v: %s", ve.Path, ve.Err, ve.Reason)
+	}
+	return fmt.Sprintf("%s: %v", ve.Path, ve.Err)
+}
+
+func (ve *ValidationError) Unwrap() error {
+	return ve.Err
+}
+
+// ValidationErrors is returned by validators that report every violation
+// instead of stopping at the first one.
+type ValidationErrors []*ValidationError
+
+func (ves ValidationErrors) Error() string {
+	msgs := make([]string, len(ves))
+	for i, ve := range ves {
+		msgs[i] = ve.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (ves ValidationErrors) Unwrap() []error {
+	errs := make([]error, len(ves))
+	for i, ve := range ves {
+		errs[i] = ve
+	}
+	return errs
+}
+
+func (ves *ValidationErrors) add(path string, err error, reasonFmt string, args ...any) {
+	*ves = append(*ves, validationErr(path, err, reasonFmt, args...))
+}
+
+func (ves *ValidationErrors) addErr(err error) {
+	var ve *ValidationError
+	if errors.As(err, &ve) {
+		*ves = append(*ves, ve)
+	}
+}
+
+func (ves ValidationErrors) orNil() error {
+	if len(ves) == 0 {
+		return nil
+	}
+	return ves
+}
+
+func validationErr(path string, err error, reasonFmt string, args ...any) *ValidationError {
+	return &ValidationError{Path: path, Err: err, Reason: fmt.Sprintf(reasonFmt, args...)}
+}
+
+func joinPath(parent, field string) string {
+	if parent == "" {
+		return field
+	}
+	return parent + "." + field
+}
+
+func indexPath(parent string, index int) string {
+	return fmt.Sprintf("%s[%d]", parent, index)
+}
+
+func validateEnum(path, value string, allowed ...string) error {
+	if value != "" && !slices.Contains(allowed, value) {
+		return validationErr(path, ErrInvalidEnumValue, "%q is not one of %s", value, strings.Join(allowed, ", "))
+	}
+	return nil
+}
+
+var (
+	linkURLSchemes  = []string{"http", "https"}
+	imageURLSchemes = []string{"http", "https", "mxc"}
+)
+
+func validateURL(path, value string, schemes []string) error {
+	if value == "" {
+		return nil
+	}
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return validationErr(path, ErrInvalidURL, "%v", err)
+	} else if !slices.Contains(schemes, strings.ToLower(parsed.Scheme)) {
+		return validationErr(path, ErrInvalidURL, "scheme must be one of %s", strings.Join(schemes, ", "))
+	} else if parsed.Host == "" {
+		return validationErr(path, ErrInvalidURL, "host is missing")
+	}
+	return nil
+}
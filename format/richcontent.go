@@ -0,0 +1,404 @@
+package format
+
+import (
+	"context"
+	"html"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/De-IM/mautrix/event"
+)
+
+// AllowedLinkSchemes are the URL schemes that are rendered as links in card
+// and component fallbacks. Other URLs are dropped and only the text is kept.
+//
+// https://spec.matrix.org/v1.10/client-server-api/#mroommessage-msgtypes
+var AllowedLinkSchemes = []string{"https", "http", "ftp", "mailto", "magnet", "matrix"}
+
+func isSafeURL(rawURL string, schemes []string) bool {
+	parsed, err := url.Parse(rawURL)
+	return err == nil && slices.Contains(schemes, strings.ToLower(parsed.Scheme))
+}
+
+type richHTMLWriter struct {
+	strings.Builder
+}
+
+func (w *richHTMLWriter) text(text string) {
+	w.WriteString(event.TextToHTML(text))
+}
+
+func (w *richHTMLWriter) tag(tag, text string) {
+	if text == "" {
+		return
+	}
+	w.WriteString("<" + tag + ">")
+	w.text(text)
+	w.WriteString("</" + tag + ">")
+}
+
+func (w *richHTMLWriter) link(text, href string) {
+	if href == "" || !isSafeURL(href, AllowedLinkSchemes) {
+		w.text(text)
+		return
+	}
+	if text == "" {
+		text = href
+	}
+	w.WriteString(`<a href="` + html.EscapeString(href) + `">`)
+	w.text(text)
+	w.WriteString("</a>")
+}
+
+func (w *richHTMLWriter) image(src, alt string) {
+	if strings.HasPrefix(src, "mxc://") {
+		w.WriteString(`<img src="` + html.EscapeString(src) + `" alt="` + html.EscapeString(alt) + `">`)
+	} else if src != "" {
+		if alt == "" {
+			alt = "Image"
+		}
+		w.link(alt, src)
+	}
+}
+
+func (w *richHTMLWriter) onClickLink(text string, onClick *event.OnClick) {
+	if onClick != nil && onClick.OpenLink != nil {
+		w.link(text, onClick.OpenLink.URL)
+	} else {
+		w.text(text)
+	}
+}
+
+// CardsToHTML renders the given cards into Matrix HTML for clients that don't
+// support cards. All text is escaped, only tags allowed by the spec are used
+// and links are only kept if they use one of [AllowedLinkSchemes].
+func CardsToHTML(cards *event.MsgCardV2) string {
+	if cards == nil {
+		return ""
+	}
+	var w richHTMLWriter
+	for _, cardV2 := range cards.CardsV2 {
+		if cardV2 == nil || cardV2.Card == nil {
+			continue
+		}
+		w.WriteString("<div>")
+		w.card(cardV2.Card)
+		w.WriteString("</div>")
+	}
+	return w.String()
+}
+
+func (w *richHTMLWriter) card(card *event.Card) {
+	if card.Header != nil {
+		w.WriteString("<h4>")
+		w.onClickLink(card.Header.Title, card.OnClick)
+		w.WriteString("</h4>")
+		if card.Header.Subtitle != "" {
+			w.WriteString("<p><em>")
+			w.onClickLink(card.Header.Subtitle, card.Header.SubtitleAction)
+			w.WriteString("</em></p>")
+		}
+		if card.Header.ImageUrl != "" {
+			w.WriteString("<p>")
+			w.image(card.Header.ImageUrl, card.Header.ImageAltText)
+			w.WriteString("</p>")
+		}
+	}
+	if card.Title != nil && card.Title.Title != "" {
+		w.WriteString("<p><strong>")
+		w.text(card.Title.Title)
+		w.WriteString("</strong></p>")
+	}
+	if card.Body != nil {
+		w.tag("p", card.Body.Description)
+		if card.Body.BigImageUrl != "" {
+			w.WriteString("<p>")
+			w.image(card.Body.BigImageUrl, "")
+			w.WriteString("</p>")
+		}
+	}
+	for _, section := range card.Sections {
+		if section != nil {
+			w.section(section)
+		}
+	}
+}
+
+func (w *richHTMLWriter) section(section *event.Section) {
+	w.tag("h5", section.Header)
+	for _, widget := range section.Widgets {
+		switch {
+		case widget == nil:
+		case widget.DecoratedText != nil:
+			if widget.DecoratedText.Text != "" {
+				w.tag("p", widget.DecoratedText.Text)
+			} else {
+				w.tag("p", strings.Join(widget.DecoratedText.Texts, " | "))
+			}
+		case widget.ButtonList != nil:
+			w.WriteString("<p>")
+			first := true
+			for _, button := range widget.ButtonList.Buttons {
+				if button == nil {
+					continue
+				} else if !first {
+					w.WriteString(" | ")
+				}
+				first = false
+				if button.OnClick != nil && button.OnClick.OpenLink != nil {
+					w.link(button.Text, button.OnClick.OpenLink.URL)
+				} else {
+					w.text("[" + button.Text + "]")
+				}
+			}
+			w.WriteString("</p>")
+		case widget.Grid != nil:
+			w.grid(widget.Grid)
+		}
+	}
+	if section.Footer != "" {
+		w.WriteString("<p><sub>")
+		w.text(section.Footer)
+		w.WriteString("</sub></p>")
+	}
+}
+
+func (w *richHTMLWriter) grid(grid *event.Grid) {
+	if grid.Title != "" {
+		w.WriteString("<p><strong>")
+		w.onClickLink(grid.Title, grid.OnClick)
+		w.WriteString("</strong></p>")
+	}
+	w.WriteString("<ul>")
+	for _, item := range grid.Items {
+		w.WriteString("<li>")
+		if item.Image != nil && item.Image.ImageURI != "" {
+			w.image(item.Image.ImageURI, item.Title)
+			if strings.HasPrefix(item.Image.ImageURI, "mxc://") {
+				w.WriteString(" ")
+				w.text(item.Title)
+			}
+		} else {
+			w.text(item.Title)
+		}
+		w.WriteString("</li>")
+	}
+	w.WriteString("</ul>")
+}
+
+// ComponentsToHTML renders the given component rows into Matrix HTML for
+// clients that don't support message components. Each row is rendered as a
+// paragraph, link buttons are rendered as links and select menus are rendered
+// as lists of their options.
+func ComponentsToHTML(rows [][]event.MessageComponent) string {
+	var w richHTMLWriter
+	for _, row := range rows {
+		w.componentRow(row)
+	}
+	return w.String()
+}
+
+func (w *richHTMLWriter) componentRow(row []event.MessageComponent) {
+	var inline []event.MessageComponent
+	flushInline := func() {
+		if len(inline) == 0 {
+			return
+		}
+		w.WriteString("<p>")
+		for i, component := range inline {
+			if i > 0 {
+				w.WriteString(" | ")
+			}
+			w.inlineComponent(component)
+		}
+		w.WriteString("</p>")
+		inline = inline[:0]
+	}
+	for _, component := range row {
+		switch typed := component.(type) {
+		case *event.ActionsRow:
+			flushInline()
+			w.componentRow(typed.Components)
+		case event.ActionsRow:
+			flushInline()
+			w.componentRow(typed.Components)
+		case *event.SelectMenu:
+			flushInline()
+			w.selectMenu(typed)
+		case event.SelectMenu:
+			flushInline()
+			w.selectMenu(&typed)
+		case nil:
+		default:
+			inline = append(inline, component)
+		}
+	}
+	flushInline()
+}
+
+func (w *richHTMLWriter) inlineComponent(component event.MessageComponent) {
+	switch typed := component.(type) {
+	case *event.Button:
+		w.button(typed)
+	case event.Button:
+		w.button(&typed)
+	case *event.TextInput:
+		w.textInput(typed)
+	case event.TextInput:
+		w.textInput(&typed)
+	}
+}
+
+func (w *richHTMLWriter) button(button *event.Button) {
+	text := button.Text
+	if button.Emoji != nil && button.Emoji.ID == "" && button.Emoji.Name != "" {
+		text = button.Emoji.Name + " " + text
+	}
+	switch {
+	case button.URL != "" && button.GetStyle() == event.LinkButton:
+		w.link(text, button.URL)
+	case button.LoginURL != nil && button.LoginURL.URL != "":
+		w.link(text, button.LoginURL.URL)
+	case button.WebApp != nil && button.WebApp.URL != "":
+		w.link(text, button.WebApp.URL)
+	default:
+		w.text("[" + text + "]")
+	}
+}
+
+func (w *richHTMLWriter) textInput(input *event.TextInput) {
+	w.WriteString("<em>")
+	w.text(input.Label + ":")
+	w.WriteString("</em> ")
+	if input.Value != "" {
+		w.text(input.Value)
+	} else {
+		w.text(input.Placeholder)
+	}
+}
+
+func (w *richHTMLWriter) selectMenu(menu *event.SelectMenu) {
+	if menu.Placeholder != "" {
+		w.WriteString("<p><em>")
+		w.text(menu.Placeholder)
+		w.WriteString("</em></p>")
+	}
+	if len(menu.Options) == 0 {
+		return
+	}
+	w.WriteString("<ul>")
+	for _, opt := range menu.Options {
+		label := opt.Label
+		if label == "" {
+			label = opt.Value
+		}
+		if opt.Emoji != nil && opt.Emoji.ID == "" && opt.Emoji.Name != "" {
+			label = opt.Emoji.Name + " " + label
+		}
+		w.WriteString("<li>")
+		if opt.Default {
+			w.tag("strong", label)
+		} else {
+			w.text(label)
+		}
+		if opt.Description != "" {
+			w.text(" - " + opt.Description)
+		}
+		w.WriteString("</li>")
+	}
+	w.WriteString("</ul>")
+}
+
+// plainTextParser converts the generated fallback HTML into plain text
+// without any markdown-style formatting markers.
+var plainTextParser = &HTMLParser{
+	TabsToSpaces:           4,
+	Newline:                "\n",
+	HorizontalLine:         "\n---\n",
+	PillConverter:          DefaultPillConverter,
+	BoldConverter:          func(text string, _ Context) string { return text },
+	ItalicConverter:        func(text string, _ Context) string { return text },
+	StrikethroughConverter: func(text string, _ Context) string { return text },
+	MonospaceConverter:     func(text string, _ Context) string { return text },
+}
+
+func htmlToPlainText(htmlBody string) string {
+	return plainTextParser.Parse(htmlBody, NewContext(context.TODO()))
+}
+
+// CardsToText renders the given cards into plain text for the body of
+// messages. It's the plain text equivalent of [CardsToHTML] and the same as
+// the fallback generated by [event.CardMessageBuilder].
+func CardsToText(cards *event.MsgCardV2) string {
+	return cards.PlainText()
+}
+
+// ComponentsToText renders the given component rows into plain text for the
+// body of messages. It's the plain text equivalent of [ComponentsToHTML].
+func ComponentsToText(rows [][]event.MessageComponent) string {
+	return htmlToPlainText(ComponentsToHTML(rows))
+}
+
+// RenderRichFallback fills the body and formatted body of the given content
+// with a fallback representation of its cards and components, so that clients
+// which don't support them still show something useful.
+//
+// If the content has cards, the fallback replaces the body entirely.
+// Otherwise, the components are appended to the existing body, and messages
+// without components are left untouched. A fallback generated by a previous
+// call for the same components is replaced, so this can be safely called
+// again. When changing the components of an existing message, call
+// [StripRichFallback] before replacing the components.
+func RenderRichFallback(content *event.MessageEventContent) {
+	if content.MsgCardV2 != nil && len(content.MsgCardV2.CardsV2) > 0 {
+		htmlBody := CardsToHTML(content.MsgCardV2) + ComponentsToHTML(content.Components)
+		if htmlBody != "" {
+			content.Format = event.FormatHTML
+			content.FormattedBody = htmlBody
+			content.Body = CardsToText(content.MsgCardV2)
+			if componentsText := ComponentsToText(content.Components); componentsText != "" {
+				content.Body = strings.TrimSpace(content.Body + "\n\n" + componentsText)
+			}
+		}
+		return
+	}
+	componentsHTML := ComponentsToHTML(content.Components)
+	if componentsHTML == "" {
+		return
+	}
+	StripRichFallback(content)
+	if content.Format != event.FormatHTML || content.FormattedBody == "" {
+		content.Format = event.FormatHTML
+		content.FormattedBody = event.TextToHTML(content.Body)
+	}
+	content.FormattedBody += componentsHTML
+	if componentsText := htmlToPlainText(componentsHTML); content.Body == "" {
+		content.Body = componentsText
+	} else {
+		content.Body += "\n\n" + componentsText
+	}
+}
+
+// StripRichFallback removes the component fallback generated by
+// [RenderRichFallback] for the current components of the given content. If
+// the message was plain text before the fallback was added, the formatted
+// body is removed too. Card fallbacks replace the whole body, so they're not
+// affected.
+func StripRichFallback(content *event.MessageEventContent) {
+	componentsHTML := ComponentsToHTML(content.Components)
+	if componentsHTML == "" || !strings.HasSuffix(content.FormattedBody, componentsHTML) {
+		return
+	}
+	content.FormattedBody = strings.TrimSuffix(content.FormattedBody, componentsHTML)
+	componentsText := htmlToPlainText(componentsHTML)
+	if content.Body == componentsText {
+		content.Body = ""
+	} else {
+		content.Body = strings.TrimSuffix(content.Body, "\n\n"+componentsText)
+	}
+	if content.FormattedBody == event.TextToHTML(content.Body) {
+		content.Format = ""
+		content.FormattedBody = ""
+	}
+}
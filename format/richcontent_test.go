@@ -0,0 +1,79 @@
+package format_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/De-IM/mautrix/event"
+	"github.com/De-IM/mautrix/format"
+)
+
+func ptr[T any](val T) *T {
+	return &val
+}
+
+func parseHTML(htmlBody string) string {
+	parser := &format.HTMLParser{
+		TabsToSpaces: 4,
+		Newline:      "\n",
+		LinkConverter: func(text, href string, _ format.Context) string {
+			return text + " <" + href + ">"
+		},
+	}
+	return parser.Parse(htmlBody, format.NewContext(context.Background()))
+}
+
+func TestCardsToHTML_RoundTrip(t *testing.T) {
+	cards := &event.MsgCardV2{CardsV2: []*event.CardV2{{
+		CardId: "card",
+		Card: &event.Card{
+			Header: &event.CardHeader{Title: "Build <#42> & co", Subtitle: "main"},
+			Sections: []*event.Section{{
+				Header: "Status",
+				Widgets: []*event.Widget{
+					{DecoratedText: &event.DecoratedText{Text: "Passed in 5 < 6 minutes"}},
+					{ButtonList: &event.ButtonList{Buttons: []*event.CardButton{
+						event.CardLinkButton("Logs", "https://example.com/logs?a=1&b=2"),
+						event.CardLinkButton("Evil", "javascript:alert(1)"),
+						event.CardActionButton("Retry", "retry"),
+					}}},
+					{Grid: &event.Grid{Title: "Artifacts", Items: []event.GridItem{{Title: "linux"}, {Title: "macos"}}}},
+				},
+				Footer: "Footer",
+			}},
+		},
+	}}}
+	expected := "#### Build <#42> & co\n\n" +
+		"_main_\n\n" +
+		"##### Status\n\n" +
+		"Passed in 5 < 6 minutes\n\n" +
+		"Logs <https://example.com/logs?a=1&b=2> | Evil | [Retry]\n\n" +
+		"**Artifacts**\n\n" +
+		"* linux\n* macos\n\n" +
+		"Footer"
+	if parsed := parseHTML(format.CardsToHTML(cards)); parsed != expected {
+		t.Errorf("card HTML didn't parse back cleanly:\nexpected: %q\ngot:      %q", expected, parsed)
+	}
+}
+
+func TestComponentsToHTML_RoundTrip(t *testing.T) {
+	rows := [][]event.MessageComponent{
+		{
+			&event.Button{Text: "Yes & no", CallbackData: ptr("yes")},
+			&event.Button{Text: "Docs", Style: event.LinkButton, URL: "https://example.com/<docs>"},
+		},
+		{&event.SelectMenu{
+			Placeholder: "Pick <one>",
+			Options: []event.SelectMenuOption{
+				{Label: "A", Value: "a", Default: true},
+				{Value: "b", Description: "second"},
+			},
+		}},
+	}
+	expected := "[Yes & no] | Docs <https://example.com/<docs>>\n\n" +
+		"_Pick <one>_\n\n" +
+		"* **A**\n* b - second"
+	if parsed := parseHTML(format.ComponentsToHTML(rows)); parsed != expected {
+		t.Errorf("component HTML didn't parse back cleanly:\nexpected: %q\ngot:      %q", expected, parsed)
+	}
+}
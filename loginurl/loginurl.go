@@ -0,0 +1,265 @@
+// Package loginurl implements signing and verification of the authorization
+// data that is added to the URLs of login buttons ([event.LoginURL]).
+//
+// The bot signs the user ID, room ID, current time and a random nonce with a
+// secret shared with the website. The website verifies the signature and the
+// freshness of the data before trusting the user ID.
+//
+// The signature is computed like Telegram's login widget: the fields except
+// the hash are sorted by key and joined as "key=value" lines, and the hash is
+// the hex-encoded HMAC-SHA256 of that string with the SHA256 of the secret as
+// the key.
+package loginurl
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/util/random"
+
+	"github.com/De-IM/mautrix/event"
+	"github.com/De-IM/mautrix/id"
+)
+
+var (
+	ErrMissingField = errors.New("missing authorization field")
+	ErrInvalidHash  = errors.New("invalid authorization hash")
+	ErrExpired      = errors.New("authorization data is too old")
+	ErrFromFuture   = errors.New("authorization data is from the future")
+	ErrReplayed     = errors.New("authorization nonce was already used")
+)
+
+// Query parameter names of the authorization data.
+const (
+	ParamUserID   = "user_id"
+	ParamRoomID   = "room_id"
+	ParamAuthDate = "auth_date"
+	ParamNonce    = "nonce"
+	ParamHash     = "hash"
+)
+
+// DefaultMaxAge is the default maximum age of authorization data accepted by
+// [Signer.Verify].
+const DefaultMaxAge = 10 * time.Minute
+
+// maxClockSkew is how far in the future the auth date may be.
+const maxClockSkew = time.Minute
+
+// AuthData is the authorization data added to login URLs.
+type AuthData struct {
+	UserID   id.UserID
+	RoomID   id.RoomID
+	AuthDate time.Time
+	Nonce    string
+	Hash     string
+}
+
+func (ad *AuthData) values() url.Values {
+	values := url.Values{}
+	values.Set(ParamUserID, ad.UserID.String())
+	if ad.RoomID != "" {
+		values.Set(ParamRoomID, ad.RoomID.String())
+	}
+	values.Set(ParamAuthDate, strconv.FormatInt(ad.AuthDate.Unix(), 10))
+	values.Set(ParamNonce, ad.Nonce)
+	return values
+}
+
+// dataCheckString returns the fields of the data except the hash sorted by key
+// and joined as key=value lines.
+func dataCheckString(values url.Values) string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		if key != ParamHash {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	lines := make([]string, len(keys))
+	for i, key := range keys {
+		lines[i] = key + "=" + values.Get(key)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// MemoryNonceStore remembers used nonces in memory until they expire.
+type MemoryNonceStore struct {
+	used map[string]time.Time
+	lock sync.Mutex
+}
+
+// NewMemoryNonceStore creates a new in-memory nonce store.
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{used: make(map[string]time.Time)}
+}
+
+// UseNonce marks the nonce as used until the given expiry. It returns false
+// if the nonce was already used. It can be used as [Signer.UseNonce].
+func (mns *MemoryNonceStore) UseNonce(_ context.Context, nonce string, expiry time.Time) bool {
+	mns.lock.Lock()
+	defer mns.lock.Unlock()
+	now := time.Now()
+	for usedNonce, usedExpiry := range mns.used {
+		if usedExpiry.Before(now) {
+			delete(mns.used, usedNonce)
+		}
+	}
+	if _, alreadyUsed := mns.used[nonce]; alreadyUsed {
+		return false
+	}
+	mns.used[nonce] = expiry
+	return true
+}
+
+// Signer signs and verifies login URL authorization data with a per-bot secret.
+type Signer struct {
+	key []byte
+
+	// MaxAge is the maximum age of authorization data accepted by Verify.
+	// Defaults to DefaultMaxAge.
+	MaxAge time.Duration
+	// UseNonce is called by Verify with the nonce of valid authorization data.
+	// If it returns false, the data is rejected as replayed, so each login URL
+	// can only be used once. Defaults to a [MemoryNonceStore], which should be
+	// replaced with a shared store if multiple instances verify the same URLs.
+	UseNonce func(ctx context.Context, nonce string, expiry time.Time) bool
+}
+
+// NewSigner creates a new signer with the given secret. The same secret must
+// be used by the bot and the website.
+func NewSigner(secret []byte) *Signer {
+	key := sha256.Sum256(secret)
+	return &Signer{
+		key:      key[:],
+		UseNonce: NewMemoryNonceStore().UseNonce,
+	}
+}
+
+func (s *Signer) hash(values url.Values) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(dataCheckString(values)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign creates signed authorization data for the given user in the given room.
+// The room ID may be empty.
+func (s *Signer) Sign(userID id.UserID, roomID id.RoomID) *AuthData {
+	data := &AuthData{
+		UserID:   userID,
+		RoomID:   roomID,
+		AuthDate: time.Now(),
+		Nonce:    random.String(16),
+	}
+	data.Hash = s.hash(data.values())
+	return data
+}
+
+// BuildURL adds the signed authorization data to the query of the given URL.
+func (s *Signer) BuildURL(baseURL string, data *AuthData) (string, error) {
+	parsed, err := url.Parse(baseURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse base URL: %w", err)
+	}
+	query := parsed.Query()
+	for key, values := range data.values() {
+		query[key] = values
+	}
+	query.Set(ParamHash, data.Hash)
+	parsed.RawQuery = query.Encode()
+	return parsed.String(), nil
+}
+
+// LoginURL signs authorization data for the given user and returns a login URL
+// that can be used in [event.Button.LoginURL]. Since the URL is specific to
+// the user, it should only be sent to that user, e.g. as an ephemeral message.
+func (s *Signer) LoginURL(baseURL string, userID id.UserID, roomID id.RoomID) (*event.LoginURL, error) {
+	signedURL, err := s.BuildURL(baseURL, s.Sign(userID, roomID))
+	if err != nil {
+		return nil, err
+	}
+	return &event.LoginURL{URL: signedURL}, nil
+}
+
+// Verify checks the hash and freshness of the authorization data in the given
+// query parameters and marks the nonce as used. Other query parameters are
+// ignored.
+func (s *Signer) Verify(ctx context.Context, query url.Values) (*AuthData, error) {
+	for _, key := range []string{ParamUserID, ParamAuthDate, ParamNonce, ParamHash} {
+		if query.Get(key) == "" {
+			return nil, fmt.Errorf("%w %s", ErrMissingField, key)
+		}
+	}
+	authDate, err := strconv.ParseInt(query.Get(ParamAuthDate), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s", ErrMissingField, ParamAuthDate)
+	}
+	data := &AuthData{
+		UserID:   id.UserID(query.Get(ParamUserID)),
+		RoomID:   id.RoomID(query.Get(ParamRoomID)),
+		AuthDate: time.Unix(authDate, 0),
+		Nonce:    query.Get(ParamNonce),
+		Hash:     query.Get(ParamHash),
+	}
+	expectedHash := s.hash(data.values())
+	if !hmac.Equal([]byte(expectedHash), []byte(strings.ToLower(data.Hash))) {
+		return nil, ErrInvalidHash
+	}
+	maxAge := s.MaxAge
+	if maxAge <= 0 {
+		maxAge = DefaultMaxAge
+	}
+	now := time.Now()
+	if data.AuthDate.After(now.Add(maxClockSkew)) {
+		return nil, ErrFromFuture
+	} else if now.Sub(data.AuthDate) > maxAge {
+		return nil, ErrExpired
+	}
+	if s.UseNonce == nil {
+		return nil, fmt.Errorf("signer doesn't have a nonce store")
+	} else if !s.UseNonce(ctx, data.Nonce, data.AuthDate.Add(maxAge)) {
+		return nil, ErrReplayed
+	}
+	return data, nil
+}
+
+// VerifyRequest checks the authorization data in the query of the given request.
+func (s *Signer) VerifyRequest(r *http.Request) (*AuthData, error) {
+	return s.Verify(r.Context(), r.URL.Query())
+}
+
+type contextKey int
+
+const authDataContextKey contextKey = 0
+
+// FromContext returns the verified authorization data stored in the context
+// by [Signer.Middleware], or nil if there is none.
+func FromContext(ctx context.Context) *AuthData {
+	data, _ := ctx.Value(authDataContextKey).(*AuthData)
+	return data
+}
+
+// Middleware returns a HTTP middleware that only lets requests with valid
+// authorization data through. The verified data can be retrieved from the
+// request context with [FromContext]. Invalid requests are rejected with
+// 401 Unauthorized.
+func (s *Signer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := s.VerifyRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authDataContextKey, data)))
+	})
+}
@@ -0,0 +1,71 @@
+package mautrix
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// MediaDownload is a media download whose body hasn't been read yet. It can be
+// used to stream media to another destination without buffering it in memory.
+type MediaDownload struct {
+	// Body is the content of the media. It must be closed by the caller.
+	Body io.ReadCloser
+	// ContentType is the MIME type of the media as reported by the server.
+	ContentType string
+	// ContentLength is the size of the media in bytes, or -1 if unknown.
+	ContentLength int64
+	// ContentDisposition is the raw Content-Disposition header.
+	ContentDisposition string
+	// FileName is the file name from the Content-Disposition header, if any.
+	FileName string
+
+	// Response is the raw HTTP response.
+	Response *http.Response
+}
+
+func newMediaDownload(resp *http.Response) *MediaDownload {
+	md := &MediaDownload{
+		Body:               resp.Body,
+		ContentType:        resp.Header.Get("Content-Type"),
+		ContentLength:      resp.ContentLength,
+		ContentDisposition: resp.Header.Get("Content-Disposition"),
+		Response:           resp,
+	}
+	if md.ContentDisposition != "" {
+		_, params, err := mime.ParseMediaType(md.ContentDisposition)
+		if err == nil {
+			md.FileName = params["filename"]
+		}
+	}
+	return md
+}
+
+// Read reads from the body of the download.
+func (md *MediaDownload) Read(p []byte) (int, error) {
+	return md.Body.Read(p)
+}
+
+// Close closes the body of the download.
+func (md *MediaDownload) Close() error {
+	return md.Body.Close()
+}
+
+// WriteResponse copies the headers and the body of the download to the given
+// HTTP response, e.g. to proxy media to a web client. The body is closed
+// afterwards.
+func (md *MediaDownload) WriteResponse(w http.ResponseWriter) (int64, error) {
+	defer md.Body.Close()
+	if md.ContentType != "" {
+		w.Header().Set("Content-Type", md.ContentType)
+	}
+	if md.ContentDisposition != "" {
+		w.Header().Set("Content-Disposition", md.ContentDisposition)
+	}
+	if md.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(md.ContentLength, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	return io.Copy(w, md.Body)
+}
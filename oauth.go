@@ -0,0 +1,374 @@
+package mautrix
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.mau.fi/util/random"
+
+	"github.com/De-IM/mautrix/id"
+)
+
+// Scope prefixes for the Matrix OAuth 2.0 API, see https://spec.matrix.org/v1.15/client-server-api/#scope
+const (
+	OAuthScopeClientAPI    = "urn:matrix:client:api:*"
+	OAuthScopeDevicePrefix = "urn:matrix:client:device:"
+
+	// Unstable scopes from MSC2967, for authorization servers that don't support the stable ones yet.
+	OAuthScopeUnstableClientAPI    = "urn:matrix:org.matrix.msc2967.client:api:*"
+	OAuthScopeUnstableDevicePrefix = "urn:matrix:org.matrix.msc2967.client:device:"
+)
+
+const oauthFormContentType = "application/x-www-form-urlencoded"
+
+// OAuthServerMetadata is the authorization server metadata from RFC 8414.
+type OAuthServerMetadata struct {
+	Issuer                        string   `json:"issuer"`
+	AuthorizationEndpoint         string   `json:"authorization_endpoint"`
+	TokenEndpoint                 string   `json:"token_endpoint"`
+	RegistrationEndpoint          string   `json:"registration_endpoint,omitempty"`
+	RevocationEndpoint            string   `json:"revocation_endpoint,omitempty"`
+	ResponseTypesSupported        []string `json:"response_types_supported,omitempty"`
+	ResponseModesSupported        []string `json:"response_modes_supported,omitempty"`
+	GrantTypesSupported           []string `json:"grant_types_supported,omitempty"`
+	CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported,omitempty"`
+	PromptValuesSupported         []string `json:"prompt_values_supported,omitempty"`
+	AccountManagementURI          string   `json:"account_management_uri,omitempty"`
+}
+
+// OAuthClientMetadata is the client metadata for dynamic client registration (RFC 7591).
+type OAuthClientMetadata struct {
+	ClientName              string   `json:"client_name,omitempty"`
+	ClientURI               string   `json:"client_uri"`
+	LogoURI                 string   `json:"logo_uri,omitempty"`
+	TOSURI                  string   `json:"tos_uri,omitempty"`
+	PolicyURI               string   `json:"policy_uri,omitempty"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	GrantTypes              []string `json:"grant_types"`
+	ResponseTypes           []string `json:"response_types"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+	ApplicationType         string   `json:"application_type,omitempty"`
+}
+
+// RespOAuthClientRegistration is the response to dynamic client registration.
+type RespOAuthClientRegistration struct {
+	ClientID         string `json:"client_id"`
+	ClientIDIssuedAt int64  `json:"client_id_issued_at,omitempty"`
+}
+
+// RespOAuthToken is the response from the token endpoint.
+type RespOAuthToken struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// OAuthError is an error response from the authorization server (RFC 6749 section 5.2).
+type OAuthError struct {
+	StatusCode  int    `json:"-"`
+	ErrorCode   string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *OAuthError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("%s: %s", e.ErrorCode, e.Description)
+	}
+	return e.ErrorCode
+}
+
+// GetAuthMetadata fetches the metadata of the authorization server that the homeserver delegates
+// authentication to. It returns an error wrapping MUnrecognized if the homeserver doesn't use OAuth.
+//
+// The stable endpoint is tried first. If it's not supported, the issuer is fetched from the
+// unstable MSC2965 endpoint and the metadata is discovered from the issuer.
+//
+// See https://spec.matrix.org/v1.15/client-server-api/#get_matrixclientv1auth_metadata
+func (cli *Client) GetAuthMetadata(ctx context.Context) (resp *OAuthServerMetadata, err error) {
+	_, err = cli.MakeRequest(ctx, http.MethodGet, cli.BuildClientURL("v1", "auth_metadata"), nil, &resp)
+	if !errors.Is(err, MUnrecognized) && !isHTTPStatus(err, http.StatusNotFound) {
+		return
+	}
+	var issuerResp struct {
+		Issuer string `json:"issuer"`
+	}
+	_, err = cli.MakeRequest(ctx, http.MethodGet, cli.BuildClientURL("unstable", "org.matrix.msc2965", "auth_issuer"), nil, &issuerResp)
+	if err != nil {
+		return nil, err
+	}
+	return cli.DiscoverOAuthIssuer(ctx, issuerResp.Issuer)
+}
+
+func isHTTPStatus(err error, status int) bool {
+	var httpErr HTTPError
+	return errors.As(err, &httpErr) && httpErr.IsStatus(status)
+}
+
+// DiscoverOAuthIssuer fetches the OpenID Connect discovery document of the given issuer.
+func (cli *Client) DiscoverOAuthIssuer(ctx context.Context, issuer string) (resp *OAuthServerMetadata, err error) {
+	_, err = cli.MakeFullRequest(context.WithValue(ctx, unauthenticatedContextKey, true), FullRequest{
+		Method:       http.MethodGet,
+		URL:          strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration",
+		ResponseJSON: &resp,
+	})
+	if err == nil && resp.Issuer != issuer {
+		return nil, fmt.Errorf("issuer mismatch in discovery document: expected %q, got %q", issuer, resp.Issuer)
+	}
+	return
+}
+
+// OAuthClient logs in to a homeserver that delegates authentication to an OAuth 2.0 authorization server
+// (the "next-generation auth" from MSC3861), using the authorization code flow with PKCE.
+type OAuthClient struct {
+	// Client is the Matrix client that is logged in.
+	Client *Client
+	// Metadata is the authorization server metadata, see Client.GetAuthMetadata.
+	Metadata *OAuthServerMetadata
+	// ClientID is the ID of this client at the authorization server, see Register.
+	ClientID string
+	// HTTPClient is used for requests to the authorization server. Defaults to the HTTP client of the Matrix client.
+	HTTPClient *http.Client
+	// UseUnstableScopes makes the client request the MSC2967 scopes instead of the stable ones.
+	UseUnstableScopes bool
+}
+
+// NewOAuthClient discovers the authorization server of the homeserver and creates an OAuth client for it.
+// The client must be registered with Register or have ClientID set before logging in.
+func NewOAuthClient(ctx context.Context, cli *Client) (*OAuthClient, error) {
+	metadata, err := cli.GetAuthMetadata(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get authorization server metadata: %w", err)
+	}
+	return &OAuthClient{Client: cli, Metadata: metadata}, nil
+}
+
+func (oc *OAuthClient) makeRequest(ctx context.Context, method, reqURL string, body []byte, contentType string, respJSON any) error {
+	headers := http.Header{}
+	headers.Set("Accept", "application/json")
+	var reqBody []byte
+	if body != nil {
+		headers.Set("Content-Type", contentType)
+		reqBody = body
+	}
+	content, err := oc.Client.MakeFullRequest(context.WithValue(ctx, unauthenticatedContextKey, true), FullRequest{
+		Method:           method,
+		URL:              reqURL,
+		Headers:          headers,
+		RequestBytes:     reqBody,
+		ResponseJSON:     respJSON,
+		SensitiveContent: true,
+		Client:           oc.HTTPClient,
+	})
+	var httpErr HTTPError
+	if errors.As(err, &httpErr) && httpErr.Response != nil && httpErr.RespError == nil {
+		oauthErr := &OAuthError{StatusCode: httpErr.Response.StatusCode}
+		if json.Unmarshal(content, oauthErr) == nil && oauthErr.ErrorCode != "" {
+			return oauthErr
+		}
+	}
+	return err
+}
+
+// Register registers this client at the authorization server using dynamic client registration
+// and stores the returned client ID.
+//
+// See https://spec.matrix.org/v1.15/client-server-api/#client-registration
+func (oc *OAuthClient) Register(ctx context.Context, metadata *OAuthClientMetadata) (*RespOAuthClientRegistration, error) {
+	if oc.Metadata.RegistrationEndpoint == "" {
+		return nil, errors.New("authorization server doesn't support dynamic client registration")
+	}
+	if metadata.GrantTypes == nil {
+		metadata.GrantTypes = []string{"authorization_code", "refresh_token"}
+	}
+	if metadata.ResponseTypes == nil {
+		metadata.ResponseTypes = []string{"code"}
+	}
+	if metadata.TokenEndpointAuthMethod == "" {
+		metadata.TokenEndpointAuthMethod = "none"
+	}
+	if metadata.ApplicationType == "" {
+		metadata.ApplicationType = "native"
+	}
+	body, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	var resp *RespOAuthClientRegistration
+	err = oc.makeRequest(ctx, http.MethodPost, oc.Metadata.RegistrationEndpoint, body, "application/json", &resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register client: %w", err)
+	}
+	oc.ClientID = resp.ClientID
+	return resp, nil
+}
+
+// PKCE contains the code verifier and challenge for an authorization request (RFC 7636).
+type PKCE struct {
+	Verifier  string
+	Challenge string
+}
+
+// NewPKCE generates a new random code verifier and its S256 challenge.
+func NewPKCE() *PKCE {
+	verifier := random.String(64)
+	hash := sha256.Sum256([]byte(verifier))
+	return &PKCE{
+		Verifier:  verifier,
+		Challenge: base64.RawURLEncoding.EncodeToString(hash[:]),
+	}
+}
+
+// Scope returns the scope to request for the given device ID.
+func (oc *OAuthClient) Scope(deviceID id.DeviceID) string {
+	if oc.UseUnstableScopes {
+		return OAuthScopeUnstableClientAPI + " " + OAuthScopeUnstableDevicePrefix + string(deviceID)
+	}
+	return OAuthScopeClientAPI + " " + OAuthScopeDevicePrefix + string(deviceID)
+}
+
+// AuthorizationURL builds the URL that the user should open to authorize the login.
+func (oc *OAuthClient) AuthorizationURL(redirectURI, scope, state string, pkce *PKCE) (string, error) {
+	authURL, err := url.Parse(oc.Metadata.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse authorization endpoint: %w", err)
+	}
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("response_mode", "query")
+	query.Set("client_id", oc.ClientID)
+	query.Set("redirect_uri", redirectURI)
+	query.Set("scope", scope)
+	query.Set("state", state)
+	query.Set("code_challenge", pkce.Challenge)
+	query.Set("code_challenge_method", "S256")
+	authURL.RawQuery = query.Encode()
+	return authURL.String(), nil
+}
+
+func (oc *OAuthClient) tokenRequest(ctx context.Context, form url.Values) (resp *RespOAuthToken, err error) {
+	form.Set("client_id", oc.ClientID)
+	err = oc.makeRequest(ctx, http.MethodPost, oc.Metadata.TokenEndpoint, []byte(form.Encode()), oauthFormContentType, &resp)
+	return
+}
+
+// ExchangeCode exchanges an authorization code for tokens.
+func (oc *OAuthClient) ExchangeCode(ctx context.Context, code, redirectURI string, pkce *PKCE) (*RespOAuthToken, error) {
+	return oc.tokenRequest(ctx, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {pkce.Verifier},
+	})
+}
+
+// RefreshToken uses a refresh token to get new tokens from the authorization server.
+func (oc *OAuthClient) RefreshToken(ctx context.Context, refreshToken string) (*RespOAuthToken, error) {
+	return oc.tokenRequest(ctx, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	})
+}
+
+// TokenRefresher can be used as Client.TokenRefresher to refresh tokens using the authorization server.
+func (oc *OAuthClient) TokenRefresher(ctx context.Context, refreshToken string) (*RespRefresh, error) {
+	resp, err := oc.RefreshToken(ctx, refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	return &RespRefresh{
+		AccessToken:  resp.AccessToken,
+		RefreshToken: resp.RefreshToken,
+		ExpiresInMS:  resp.ExpiresIn * 1000,
+	}, nil
+}
+
+// OAuthLoginParams contains the parameters for OAuthClient.Login.
+type OAuthLoginParams struct {
+	LoopbackParams
+	// DeviceID is the device ID to request. A random one is generated if empty.
+	DeviceID id.DeviceID
+	// Prompt is passed to the authorization endpoint, e.g. "create" to ask the server to show the registration page.
+	Prompt string
+}
+
+// Login logs in using the authorization code flow: it starts a local HTTP listener, asks the user to open
+// the authorization URL, waits for the redirect and exchanges the code for tokens. The credentials are
+// stored in the Matrix client, which is also set up to refresh the tokens using the authorization server.
+//
+// See https://spec.matrix.org/v1.15/client-server-api/#login-flow
+func (oc *OAuthClient) Login(ctx context.Context, params *OAuthLoginParams) (*RespWhoami, error) {
+	if oc.ClientID == "" {
+		return nil, errors.New("client is not registered")
+	} else if params == nil {
+		params = &OAuthLoginParams{}
+	}
+	deviceID := params.DeviceID
+	if deviceID == "" {
+		deviceID = id.DeviceID(random.String(10))
+	}
+	callback, err := startLoopbackCallback(&params.LoopbackParams, "state")
+	if err != nil {
+		return nil, err
+	}
+	pkce := NewPKCE()
+	authURL, err := oc.AuthorizationURL(callback.URL, oc.Scope(deviceID), callback.state, pkce)
+	if err != nil {
+		_ = callback.server.Close()
+		return nil, err
+	}
+	if params.Prompt != "" {
+		authURL += "&prompt=" + url.QueryEscape(params.Prompt)
+	}
+	query, err := callback.Wait(ctx, authURL)
+	if err != nil {
+		return nil, err
+	} else if errCode := query.Get("error"); errCode != "" {
+		return nil, &OAuthError{ErrorCode: errCode, Description: query.Get("error_description")}
+	}
+	code := query.Get("code")
+	if code == "" {
+		return nil, fmt.Errorf("%w: missing code", ErrLoopbackCallbackInvalid)
+	}
+	tokens, err := oc.ExchangeCode(ctx, code, callback.URL, pkce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange authorization code: %w", err)
+	}
+	return oc.storeTokens(ctx, deviceID, tokens)
+}
+
+func (oc *OAuthClient) storeTokens(ctx context.Context, deviceID id.DeviceID, tokens *RespOAuthToken) (*RespWhoami, error) {
+	cli := oc.Client
+	// Check the new access token before storing it, so that a failed login doesn't replace working credentials
+	var whoami *RespWhoami
+	_, err := cli.MakeFullRequest(context.WithValue(ctx, unauthenticatedContextKey, true), FullRequest{
+		Method:       http.MethodGet,
+		URL:          cli.BuildClientURL("v3", "account", "whoami"),
+		Headers:      http.Header{"Authorization": {"Bearer " + tokens.AccessToken}},
+		ResponseJSON: &whoami,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user ID after login: %w", err)
+	}
+	if whoami.DeviceID != "" {
+		deviceID = whoami.DeviceID
+	}
+	cli.SetFullCredentials(&Credentials{
+		UserID:       whoami.UserID,
+		DeviceID:     deviceID,
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		ExpiresAt:    expiryFromMS(tokens.ExpiresIn * 1000),
+	})
+	cli.TokenRefresher = oc.TokenRefresher
+	cli.saveCredentials(ctx)
+	return whoami, nil
+}
@@ -0,0 +1,251 @@
+package mautrix
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/De-IM/mautrix/id"
+)
+
+type fakeOAuthServer struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	lock          sync.Mutex
+	challenge     string
+	redirectURI   string
+	codeExchanged bool
+	accessToken   string
+	refreshToken  string
+	rejectWhoami  bool
+}
+
+const (
+	testOAuthClientID = "test-client"
+	testOAuthCode     = "test-code"
+	testOAuthUserID   = id.UserID("@alice:example.com")
+)
+
+func newFakeOAuthServer(t *testing.T) *fakeOAuthServer {
+	fs := &fakeOAuthServer{t: t}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_matrix/client/v1/auth_metadata", fs.handleMetadata)
+	mux.HandleFunc("/register", fs.handleRegister)
+	mux.HandleFunc("/authorize", fs.handleAuthorize)
+	mux.HandleFunc("/token", fs.handleToken)
+	mux.HandleFunc("/_matrix/client/v3/account/whoami", fs.handleWhoami)
+	fs.srv = httptest.NewServer(mux)
+	t.Cleanup(fs.srv.Close)
+	return fs
+}
+
+func writeTestJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func (fs *fakeOAuthServer) handleMetadata(w http.ResponseWriter, r *http.Request) {
+	writeTestJSON(w, http.StatusOK, &OAuthServerMetadata{
+		Issuer:                        fs.srv.URL + "/",
+		AuthorizationEndpoint:         fs.srv.URL + "/authorize",
+		TokenEndpoint:                 fs.srv.URL + "/token",
+		RegistrationEndpoint:          fs.srv.URL + "/register",
+		ResponseTypesSupported:        []string{"code"},
+		GrantTypesSupported:           []string{"authorization_code", "refresh_token"},
+		CodeChallengeMethodsSupported: []string{"S256"},
+	})
+}
+
+func (fs *fakeOAuthServer) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var metadata OAuthClientMetadata
+	if err := json.NewDecoder(r.Body).Decode(&metadata); err != nil {
+		writeTestJSON(w, http.StatusBadRequest, &OAuthError{ErrorCode: "invalid_client_metadata"})
+		return
+	}
+	if metadata.TokenEndpointAuthMethod != "none" || len(metadata.RedirectURIs) == 0 {
+		fs.t.Errorf("unexpected client metadata: %+v", metadata)
+	}
+	writeTestJSON(w, http.StatusCreated, &RespOAuthClientRegistration{ClientID: testOAuthClientID})
+}
+
+func (fs *fakeOAuthServer) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != testOAuthClientID || query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" {
+		fs.t.Errorf("unexpected authorization request: %s", r.URL.RawQuery)
+	}
+	if !strings.Contains(query.Get("scope"), OAuthScopeDevicePrefix+"TESTDEVICE") {
+		fs.t.Errorf("scope doesn't contain device ID: %q", query.Get("scope"))
+	}
+	fs.lock.Lock()
+	fs.challenge = query.Get("code_challenge")
+	fs.redirectURI = query.Get("redirect_uri")
+	fs.lock.Unlock()
+
+	// A callback with the wrong state must be rejected by the loopback listener
+	wrongState, err := url.Parse(fs.redirectURI)
+	if err != nil {
+		fs.t.Errorf("invalid redirect URI: %v", err)
+		return
+	}
+	wrongState.RawQuery = url.Values{"code": {"attacker-code"}, "state": {"wrong"}}.Encode()
+	resp, err := http.Get(wrongState.String())
+	if err != nil {
+		fs.t.Errorf("failed to send callback with wrong state: %v", err)
+	} else {
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			fs.t.Errorf("callback with wrong state returned %d, expected 400", resp.StatusCode)
+		}
+	}
+
+	redirect, _ := url.Parse(fs.redirectURI)
+	redirect.RawQuery = url.Values{"code": {testOAuthCode}, "state": {query.Get("state")}}.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (fs *fakeOAuthServer) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("client_id") != testOAuthClientID {
+		writeTestJSON(w, http.StatusUnauthorized, &OAuthError{ErrorCode: "invalid_client"})
+		return
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		hash := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if fs.codeExchanged || r.PostForm.Get("code") != testOAuthCode ||
+			r.PostForm.Get("redirect_uri") != fs.redirectURI ||
+			base64.RawURLEncoding.EncodeToString(hash[:]) != fs.challenge {
+			writeTestJSON(w, http.StatusBadRequest, &OAuthError{ErrorCode: "invalid_grant"})
+			return
+		}
+		fs.codeExchanged = true
+		fs.accessToken, fs.refreshToken = "access1", "refresh1"
+	case "refresh_token":
+		if r.PostForm.Get("refresh_token") != fs.refreshToken {
+			writeTestJSON(w, http.StatusBadRequest, &OAuthError{ErrorCode: "invalid_grant"})
+			return
+		}
+		fs.accessToken, fs.refreshToken = "access2", "refresh2"
+	default:
+		writeTestJSON(w, http.StatusBadRequest, &OAuthError{ErrorCode: "unsupported_grant_type"})
+		return
+	}
+	writeTestJSON(w, http.StatusOK, &RespOAuthToken{
+		AccessToken:  fs.accessToken,
+		RefreshToken: fs.refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    300,
+	})
+}
+
+func (fs *fakeOAuthServer) handleWhoami(w http.ResponseWriter, r *http.Request) {
+	fs.lock.Lock()
+	expected := "Bearer " + fs.accessToken
+	reject := fs.rejectWhoami
+	fs.lock.Unlock()
+	if reject || r.Header.Get("Authorization") != expected {
+		writeTestJSON(w, http.StatusUnauthorized, map[string]string{"errcode": "M_UNKNOWN_TOKEN", "error": "Invalid token"})
+		return
+	}
+	writeTestJSON(w, http.StatusOK, &RespWhoami{UserID: testOAuthUserID, DeviceID: "TESTDEVICE"})
+}
+
+func openURLWithHTTP(_ context.Context, openURL string) error {
+	resp, err := http.Get(openURL)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func TestOAuthClient_Login(t *testing.T) {
+	fs := newFakeOAuthServer(t)
+	ctx := context.Background()
+	cli, err := NewClient(fs.srv.URL, "", "")
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	oc, err := NewOAuthClient(ctx, cli)
+	if err != nil {
+		t.Fatalf("failed to discover authorization server: %v", err)
+	}
+	_, err = oc.Register(ctx, &OAuthClientMetadata{
+		ClientName:   "test",
+		ClientURI:    "https://example.com",
+		RedirectURIs: []string{"http://127.0.0.1/callback"},
+	})
+	if err != nil {
+		t.Fatalf("failed to register client: %v", err)
+	} else if oc.ClientID != testOAuthClientID {
+		t.Fatalf("unexpected client ID %q", oc.ClientID)
+	}
+
+	whoami, err := oc.Login(ctx, &OAuthLoginParams{
+		LoopbackParams: LoopbackParams{OpenURL: openURLWithHTTP},
+		DeviceID:       "TESTDEVICE",
+	})
+	if err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	} else if whoami.UserID != testOAuthUserID || cli.UserID != testOAuthUserID {
+		t.Fatalf("unexpected user ID %q", whoami.UserID)
+	} else if creds := cli.Credentials(); creds.AccessToken != "access1" || creds.RefreshToken != "refresh1" || creds.ExpiresAt.IsZero() {
+		t.Fatalf("unexpected credentials after login: %+v", creds)
+	}
+
+	err = cli.RefreshAccessToken(ctx)
+	if err != nil {
+		t.Fatalf("failed to refresh access token: %v", err)
+	} else if creds := cli.Credentials(); creds.AccessToken != "access2" || creds.RefreshToken != "refresh2" {
+		t.Fatalf("unexpected credentials after refresh: %+v", creds)
+	}
+	_, err = cli.Whoami(ctx)
+	if err != nil {
+		t.Fatalf("refreshed access token wasn't accepted: %v", err)
+	}
+}
+
+func TestOAuthClient_LoginKeepsCredentialsOnFailure(t *testing.T) {
+	fs := newFakeOAuthServer(t)
+	fs.rejectWhoami = true
+	ctx := context.Background()
+	cli, err := NewClient(fs.srv.URL, "@bob:example.com", "old-token")
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	oc, err := NewOAuthClient(ctx, cli)
+	if err != nil {
+		t.Fatalf("failed to discover authorization server: %v", err)
+	}
+	oc.ClientID = testOAuthClientID
+
+	_, err = oc.Login(ctx, &OAuthLoginParams{
+		LoopbackParams: LoopbackParams{OpenURL: openURLWithHTTP},
+		DeviceID:       "TESTDEVICE",
+	})
+	if err == nil {
+		t.Fatal("login with a rejected access token didn't fail")
+	} else if creds := cli.Credentials(); creds.AccessToken != "old-token" || creds.UserID != "@bob:example.com" || creds.RefreshToken != "" {
+		t.Fatalf("credentials changed after failed login: %+v", creds)
+	} else if cli.TokenRefresher != nil {
+		t.Fatal("token refresher was set after failed login")
+	}
+}
+
+func TestOAuthClient_LoginNilParams(t *testing.T) {
+	oc := &OAuthClient{Metadata: &OAuthServerMetadata{}, ClientID: testOAuthClientID}
+	_, err := oc.Login(context.Background(), nil)
+	if err == nil {
+		t.Fatal("login without OpenURL didn't fail")
+	}
+}
@@ -0,0 +1,85 @@
+package mautrix
+
+import (
+	"context"
+)
+
+// PageFetcher fetches a single page of results starting from the given
+// pagination token. It returns the items in the page and the token for the
+// next page, which is empty if there are no more pages.
+type PageFetcher[T any] func(ctx context.Context, from string) (items []T, next string, err error)
+
+// Paginator follows the pagination tokens of an endpoint that returns results
+// in batches (e.g. next_batch), fetching one page at a time.
+//
+// A Paginator is not safe for concurrent use.
+type Paginator[T any] struct {
+	fetch PageFetcher[T]
+	token string
+	done  bool
+}
+
+// NewPaginator creates a new paginator that starts fetching from the given
+// token. The token may be empty to start from the beginning.
+func NewPaginator[T any](from string, fetch PageFetcher[T]) *Paginator[T] {
+	return &Paginator[T]{fetch: fetch, token: from}
+}
+
+// HasMore returns true if there may be more pages to fetch.
+func (p *Paginator[T]) HasMore() bool {
+	return !p.done
+}
+
+// Token returns the pagination token of the next page. It can be stored and
+// passed to a new paginator to continue later.
+func (p *Paginator[T]) Token() string {
+	return p.token
+}
+
+// Next fetches the next page. It returns nil without an error when there are
+// no more pages. If an error is returned, the paginator doesn't advance, so
+// calling Next again retries the same page.
+func (p *Paginator[T]) Next(ctx context.Context) ([]T, error) {
+	if p.done {
+		return nil, nil
+	}
+	items, next, err := p.fetch(ctx, p.token)
+	if err != nil {
+		return nil, err
+	}
+	if next == "" || next == p.token {
+		p.done = true
+	}
+	p.token = next
+	return items, nil
+}
+
+// Iter calls the given function for each item in all remaining pages until
+// the function returns false or an error, or there are no more pages. If
+// iteration is stopped early, the rest of the current page is skipped.
+func (p *Paginator[T]) Iter(ctx context.Context, fn func(T) (bool, error)) error {
+	for p.HasMore() {
+		items, err := p.Next(ctx)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if cont, err := fn(item); err != nil {
+				return err
+			} else if !cont {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// All fetches all remaining pages and returns the items in a single list.
+func (p *Paginator[T]) All(ctx context.Context) ([]T, error) {
+	var all []T
+	err := p.Iter(ctx, func(item T) (bool, error) {
+		all = append(all, item)
+		return true, nil
+	})
+	return all, err
+}
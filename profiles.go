@@ -0,0 +1,185 @@
+package mautrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/De-IM/mautrix/event"
+	"github.com/De-IM/mautrix/id"
+)
+
+const (
+	DefaultProfileFetchConcurrency = 4
+	DefaultProfileFetchInterval    = 50 * time.Millisecond
+	DefaultProfileCacheTTL         = time.Hour
+)
+
+// ProfileFetcher fetches the global profiles of many users concurrently while
+// limiting the request rate. If the state store of the client implements
+// [ProfileStateStore], fetched profiles are cached there.
+type ProfileFetcher struct {
+	Client *Client
+
+	// Concurrency is the maximum number of profile requests in flight.
+	// Defaults to DefaultProfileFetchConcurrency.
+	Concurrency int
+	// Interval is the minimum time between starting two profile requests.
+	// Defaults to DefaultProfileFetchInterval. Negative values disable rate limiting.
+	Interval time.Duration
+	// CacheTTL is how long cached profiles are used before fetching them again.
+	// Defaults to DefaultProfileCacheTTL. Negative values disable the cache.
+	CacheTTL time.Duration
+}
+
+// NewProfileFetcher creates a new profile fetcher with the default settings.
+func NewProfileFetcher(cli *Client) *ProfileFetcher {
+	return &ProfileFetcher{Client: cli}
+}
+
+// FetchProfiles fetches the global profiles of the given users using
+// [ProfileFetcher]. See [ProfileFetcher.FetchProfiles] for details.
+func (cli *Client) FetchProfiles(ctx context.Context, userIDs []id.UserID) (map[id.UserID]*event.MemberEventContent, error) {
+	return NewProfileFetcher(cli).FetchProfiles(ctx, userIDs)
+}
+
+func (pf *ProfileFetcher) cache() ProfileStateStore {
+	if pf.CacheTTL < 0 {
+		return nil
+	}
+	cache, _ := pf.Client.StateStore.(ProfileStateStore)
+	return cache
+}
+
+func (pf *ProfileFetcher) cacheTTL() time.Duration {
+	if pf.CacheTTL > 0 {
+		return pf.CacheTTL
+	}
+	return DefaultProfileCacheTTL
+}
+
+// FetchProfiles returns the global profiles of the given users. The membership
+// field of the returned member contents is always empty.
+//
+// Users who don't exist or whose profiles aren't visible are left out of the
+// result. If fetching some of the profiles fails for other reasons, the
+// successfully fetched profiles are returned along with the errors.
+func (pf *ProfileFetcher) FetchProfiles(ctx context.Context, userIDs []id.UserID) (map[id.UserID]*event.MemberEventContent, error) {
+	log := zerolog.Ctx(ctx)
+	cache := pf.cache()
+	result := make(map[id.UserID]*event.MemberEventContent, len(userIDs))
+	toFetch := make([]id.UserID, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if _, alreadyAdded := result[userID]; alreadyAdded {
+			continue
+		}
+		if cache != nil {
+			cached, err := cache.GetCachedProfile(ctx, userID)
+			if err != nil {
+				log.Warn().Err(err).Stringer("user_id", userID).Msg("Failed to get cached profile")
+			} else if cached != nil && time.Since(cached.FetchedAt) < pf.cacheTTL() {
+				result[userID] = cached.Profile
+				continue
+			}
+		}
+		// Reserve the slot to skip duplicates, it's removed if fetching fails
+		result[userID] = nil
+		toFetch = append(toFetch, userID)
+	}
+	if len(toFetch) == 0 {
+		return result, nil
+	}
+
+	concurrency := pf.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultProfileFetchConcurrency
+	}
+	interval := pf.Interval
+	if interval == 0 {
+		interval = DefaultProfileFetchInterval
+	}
+	var ticker *time.Ticker
+	if interval > 0 {
+		ticker = time.NewTicker(interval)
+		defer ticker.Stop()
+	}
+
+	queue := make(chan id.UserID)
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var errs []error
+	worker := func() {
+		defer wg.Done()
+		for userID := range queue {
+			profile, err := pf.fetchProfile(ctx, cache, userID)
+			lock.Lock()
+			if profile != nil {
+				result[userID] = profile
+			} else {
+				delete(result, userID)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to fetch profile of %s: %w", userID, err))
+			}
+			lock.Unlock()
+		}
+	}
+	for range min(concurrency, len(toFetch)) {
+		wg.Add(1)
+		go worker()
+	}
+	var ctxErr error
+Loop:
+	for i, userID := range toFetch {
+		if ticker != nil && i > 0 {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				ctxErr = ctx.Err()
+				break Loop
+			}
+		}
+		select {
+		case queue <- userID:
+		case <-ctx.Done():
+			ctxErr = ctx.Err()
+			break Loop
+		}
+	}
+	close(queue)
+	wg.Wait()
+	if ctxErr != nil {
+		// Drop the reserved slots of users that were never fetched
+		for userID, profile := range result {
+			if profile == nil {
+				delete(result, userID)
+			}
+		}
+		errs = append(errs, ctxErr)
+	}
+	return result, errors.Join(errs...)
+}
+
+func (pf *ProfileFetcher) fetchProfile(ctx context.Context, cache ProfileStateStore, userID id.UserID) (*event.MemberEventContent, error) {
+	resp, err := pf.Client.GetProfile(ctx, userID)
+	if errors.Is(err, MNotFound) || errors.Is(err, MForbidden) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	profile := &event.MemberEventContent{
+		Displayname: resp.DisplayName,
+		AvatarURL:   resp.AvatarURL.CUString(),
+	}
+	if cache != nil {
+		err = cache.SetCachedProfile(ctx, userID, profile)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Stringer("user_id", userID).Msg("Failed to cache profile")
+		}
+	}
+	return profile, nil
+}
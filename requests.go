@@ -23,6 +23,8 @@ const (
 	AuthTypeDummy      AuthType = "m.login.dummy"
 	AuthTypeAppservice AuthType = "m.login.application_service"
 
+	AuthTypeRegistrationToken AuthType = "m.login.registration_token"
+
 	AuthTypeSynapseJWT AuthType = "org.matrix.login.jwt"
 
 	AuthTypeDevtureSharedSecret AuthType = "com.devture.shared_secret_auth"
@@ -71,6 +73,42 @@ type BaseAuthData struct {
 	Session string   `json:"session,omitempty"`
 }
 
+// ReqUIAuthPassword is the auth data for the m.login.password stage of
+// https://spec.matrix.org/v1.12/client-server-api/#password-based
+type ReqUIAuthPassword struct {
+	BaseAuthData
+	Identifier UserIdentifier `json:"identifier"`
+	Password   string         `json:"password"`
+}
+
+// ReqUIAuthRecaptcha is the auth data for the m.login.recaptcha stage of
+// https://spec.matrix.org/v1.12/client-server-api/#google-recaptcha
+type ReqUIAuthRecaptcha struct {
+	BaseAuthData
+	Response string `json:"response"`
+}
+
+// ReqUIAuthThreePID is the auth data for the m.login.email.identity and
+// m.login.msisdn stages of https://spec.matrix.org/v1.12/client-server-api/#email-based-identity--homeserver
+type ReqUIAuthThreePID struct {
+	BaseAuthData
+	ThreePIDCreds ThreePIDCredentials `json:"threepid_creds"`
+}
+
+type ThreePIDCredentials struct {
+	SessionID     string `json:"sid"`
+	ClientSecret  string `json:"client_secret"`
+	IDServer      string `json:"id_server,omitempty"`
+	IDAccessToken string `json:"id_access_token,omitempty"`
+}
+
+// ReqUIAuthRegistrationToken is the auth data for the m.login.registration_token stage of
+// https://spec.matrix.org/v1.12/client-server-api/#token-authenticated-registration
+type ReqUIAuthRegistrationToken struct {
+	BaseAuthData
+	Token string `json:"token"`
+}
+
 type UserIdentifier struct {
 	Type IdentifierType `json:"type"`
 
@@ -91,7 +129,10 @@ type ReqLogin struct {
 	Token                    string         `json:"token,omitempty"`
 	DeviceID                 id.DeviceID    `json:"device_id,omitempty"`
 	InitialDeviceDisplayName string         `json:"initial_device_display_name,omitempty"`
-	RefreshToken             bool           `json:"refresh_token,omitempty"`
+	// Whether or not the client supports refresh tokens. If true, the server may return a refresh token and
+	// an expiry time for the access token, which the Client will use to refresh the token automatically
+	// if StoreCredentials is also true.
+	RefreshToken bool `json:"refresh_token,omitempty"`
 
 	// Whether or not the returned credentials should be stored in the Client
 	StoreCredentials bool `json:"-"`
@@ -99,6 +140,11 @@ type ReqLogin struct {
 	StoreHomeserverURL bool `json:"-"`
 }
 
+// ReqRefresh is the JSON request for https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3refresh
+type ReqRefresh struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
 type ReqUIAuthFallback struct {
 	Session string `json:"session"`
 	User    string `json:"user"`
@@ -111,6 +157,56 @@ type ReqUIAuthLogin struct {
 	Token    string `json:"token,omitempty"`
 }
 
+// ReqKnockRoom is the JSON request for https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3knockroomidoralias
+type ReqKnockRoom struct {
+	// The servers to attempt to knock on the room through. One of the servers
+	// must be participating in the room.
+	Via    []string `json:"-"`
+	Reason string   `json:"reason,omitempty"`
+}
+
+type ThumbnailMethod string
+
+const (
+	ThumbnailMethodCrop  ThumbnailMethod = "crop"
+	ThumbnailMethodScale ThumbnailMethod = "scale"
+)
+
+// ReqThumbnail contains the parameters for https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv1mediathumbnailservernamemediaid
+//
+// As it's a GET method, there is no JSON body, so this is only query parameters.
+type ReqThumbnail struct {
+	// The desired width and height of the thumbnail. Both are required. The
+	// actual thumbnail may be larger than the size specified.
+	Width  int
+	Height int
+	// The desired resizing method. Defaults to scale.
+	Method ThumbnailMethod
+	// Whether the thumbnail should be animated if possible.
+	Animated bool
+}
+
+func (req *ReqThumbnail) Query() map[string]string {
+	query := map[string]string{}
+	if req == nil {
+		return query
+	}
+	query["width"] = strconv.Itoa(req.Width)
+	query["height"] = strconv.Itoa(req.Height)
+	if req.Method != "" {
+		query["method"] = string(req.Method)
+	}
+	if req.Animated {
+		query["animated"] = "true"
+	}
+	return query
+}
+
+// ReqUpgradeRoom is the JSON request for https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3roomsroomidupgrade
+type ReqUpgradeRoom struct {
+	NewVersion event.RoomVersion `json:"new_version"`
+}
+
 // ReqCreateRoom is the JSON request for https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3createroom
 type ReqCreateRoom struct {
 	Visibility      string                 `json:"visibility,omitempty"`
@@ -146,6 +242,93 @@ type ReqMembers struct {
 	NotMembership event.Membership `json:"not_membership,omitempty"`
 }
 
+type ThreePIDMedium string
+
+const (
+	ThreePIDMediumEmail  ThreePIDMedium = "email"
+	ThreePIDMediumMSISDN ThreePIDMedium = "msisdn"
+)
+
+// ReqChangePassword is the JSON request for https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3accountpassword
+type ReqChangePassword struct {
+	NewPassword string `json:"new_password"`
+	// Whether the user's other access tokens and their associated devices
+	// should be revoked. Defaults to true on the server.
+	LogoutDevices *bool       `json:"logout_devices,omitempty"`
+	Auth          interface{} `json:"auth,omitempty"`
+}
+
+// ReqDeactivateAccount is the JSON request for https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3accountdeactivate
+type ReqDeactivateAccount struct {
+	// Whether the user would like their content to be erased as much as possible from the server.
+	Erase bool `json:"erase,omitempty"`
+	// The identity server to unbind all of the user's 3PIDs from.
+	IDServer string      `json:"id_server,omitempty"`
+	Auth     interface{} `json:"auth,omitempty"`
+}
+
+// ReqAdd3PID is the JSON request for https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3account3pidadd
+type ReqAdd3PID struct {
+	ClientSecret string      `json:"client_secret"`
+	SessionID    string      `json:"sid"`
+	Auth         interface{} `json:"auth,omitempty"`
+}
+
+// ReqBind3PID is the JSON request for https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3account3pidbind
+type ReqBind3PID struct {
+	ClientSecret  string `json:"client_secret"`
+	IDAccessToken string `json:"id_access_token"`
+	IDServer      string `json:"id_server"`
+	SessionID     string `json:"sid"`
+}
+
+// ReqDelete3PID is the JSON request for https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3account3piddelete
+// and https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3account3pidunbind
+type ReqDelete3PID struct {
+	Medium   ThreePIDMedium `json:"medium"`
+	Address  string         `json:"address"`
+	IDServer string         `json:"id_server,omitempty"`
+}
+
+// RequestTokenPurpose specifies which flow a validation token is requested for.
+type RequestTokenPurpose string
+
+const (
+	RequestTokenRegister RequestTokenPurpose = "register"
+	RequestTokenAdd3PID  RequestTokenPurpose = "3pid"
+	RequestTokenPassword RequestTokenPurpose = "password"
+)
+
+// ReqRequestToken contains the fields that are common to all requestToken endpoints.
+type ReqRequestToken struct {
+	// A unique string generated by the client, used to identify the validation attempt.
+	ClientSecret string `json:"client_secret"`
+	// The server will only send a new message if this number is greater than
+	// the one used in the previous request with the same client secret.
+	SendAttempt int `json:"send_attempt"`
+	// An optional URL to redirect the user to after validation.
+	NextLink      string `json:"next_link,omitempty"`
+	IDServer      string `json:"id_server,omitempty"`
+	IDAccessToken string `json:"id_access_token,omitempty"`
+}
+
+// ReqRequestEmailToken is the JSON request for https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3account3pidemailrequesttoken
+// and the other email requestToken endpoints.
+type ReqRequestEmailToken struct {
+	ReqRequestToken
+	Email string `json:"email"`
+}
+
+// ReqRequestMSISDNToken is the JSON request for https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3account3pidmsisdnrequesttoken
+// and the other msisdn requestToken endpoints.
+type ReqRequestMSISDNToken struct {
+	ReqRequestToken
+	// The two-letter uppercase ISO-3166-1 alpha-2 country code that the number
+	// in PhoneNumber should be parsed as if it were dialled from.
+	Country     string `json:"country"`
+	PhoneNumber string `json:"phone_number"`
+}
+
 // ReqInvite3PID is the JSON request for https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3roomsroomidinvite-1
 // It is also a JSON object used in https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3createroom
 type ReqInvite3PID struct {
@@ -427,6 +610,347 @@ func (req *ReqHierarchy) Query() map[string]string {
 	return query
 }
 
+// ReqGetRelations contains the parameters for https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv1roomsroomidrelationseventid
+//
+// As it's a GET method, there is no JSON body, so this is only query parameters
+// and the optional relation and event type path segments.
+type ReqGetRelations struct {
+	// Only return events with this relation type.
+	RelationType event.RelationType
+	// Only return events of this type. Requires RelationType to be set.
+	EventType event.Type
+
+	// The direction to return events in. Defaults to backwards (newest first).
+	Dir Direction
+	// A pagination token from a previous GetRelations call.
+	From string
+	// The pagination token to stop returning results at.
+	To string
+	// Limit for the maximum number of events to include per response.
+	// The server will apply a default value if a limit isn't provided.
+	Limit int
+	// Flag to indicate whether the server should also include events that relate
+	// to the given event indirectly, e.g. reactions to replies in a thread.
+	Recurse bool
+}
+
+// PathSuffix returns the optional relation type and event type path segments.
+func (rgr *ReqGetRelations) PathSuffix() ClientURLPath {
+	if rgr == nil || rgr.RelationType == "" {
+		return ClientURLPath{}
+	} else if rgr.EventType.Type == "" {
+		return ClientURLPath{rgr.RelationType}
+	}
+	return ClientURLPath{rgr.RelationType, rgr.EventType.Type}
+}
+
+func (rgr *ReqGetRelations) Query() map[string]string {
+	query := map[string]string{}
+	if rgr == nil {
+		return query
+	}
+	if rgr.Dir != 0 {
+		query["dir"] = string(rgr.Dir)
+	}
+	if rgr.From != "" {
+		query["from"] = rgr.From
+	}
+	if rgr.To != "" {
+		query["to"] = rgr.To
+	}
+	if rgr.Limit > 0 {
+		query["limit"] = strconv.Itoa(rgr.Limit)
+	}
+	if rgr.Recurse {
+		query["recurse"] = "true"
+	}
+	return query
+}
+
+type ThreadsInclude string
+
+const (
+	ThreadsIncludeAll          ThreadsInclude = "all"
+	ThreadsIncludeParticipated ThreadsInclude = "participated"
+)
+
+// ReqGetThreads contains the parameters for https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv1roomsroomidthreads
+//
+// As it's a GET method, there is no JSON body, so this is only query parameters.
+type ReqGetThreads struct {
+	// Which threads to include. Defaults to all threads in the room.
+	Include ThreadsInclude
+	// A pagination token from a previous GetThreads call.
+	From string
+	// Limit for the maximum number of thread roots to include per response.
+	// The server will apply a default value if a limit isn't provided.
+	Limit int
+}
+
+func (rgt *ReqGetThreads) Query() map[string]string {
+	query := map[string]string{}
+	if rgt == nil {
+		return query
+	}
+	if rgt.Include != "" {
+		query["include"] = string(rgt.Include)
+	}
+	if rgt.From != "" {
+		query["from"] = rgt.From
+	}
+	if rgt.Limit > 0 {
+		query["limit"] = strconv.Itoa(rgt.Limit)
+	}
+	return query
+}
+
+type SearchKey string
+
+const (
+	SearchKeyContentBody  SearchKey = "content.body"
+	SearchKeyContentName  SearchKey = "content.name"
+	SearchKeyContentTopic SearchKey = "content.topic"
+)
+
+type SearchOrder string
+
+const (
+	SearchOrderRank   SearchOrder = "rank"
+	SearchOrderRecent SearchOrder = "recent"
+)
+
+type SearchGroupKey string
+
+const (
+	SearchGroupByRoomID SearchGroupKey = "room_id"
+	SearchGroupBySender SearchGroupKey = "sender"
+)
+
+// ReqSearch is the JSON request for https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3search
+type ReqSearch struct {
+	SearchCategories ReqSearchCategories `json:"search_categories"`
+}
+
+type ReqSearchCategories struct {
+	RoomEvents *ReqSearchRoomEvents `json:"room_events,omitempty"`
+}
+
+type ReqSearchRoomEvents struct {
+	// The string to search events for.
+	SearchTerm string `json:"search_term"`
+	// The keys to search. Defaults to all of them.
+	Keys []SearchKey `json:"keys,omitempty"`
+	// A filter to apply to the search, e.g. to only search in certain rooms.
+	Filter *FilterPart `json:"filter,omitempty"`
+	// The order in which to search for results. Defaults to rank.
+	OrderBy SearchOrder `json:"order_by,omitempty"`
+	// Configures whether any context for the results should be included.
+	EventContext *ReqSearchEventContext `json:"event_context,omitempty"`
+	// Requests the server to return the current state of the rooms of the results.
+	IncludeState bool `json:"include_state,omitempty"`
+	// Requests the server to partition the results into groups.
+	Groupings *ReqSearchGroupings `json:"groupings,omitempty"`
+}
+
+type ReqSearchEventContext struct {
+	// How many events before the result are returned. Defaults to 5.
+	BeforeLimit *int `json:"before_limit,omitempty"`
+	// How many events after the result are returned. Defaults to 5.
+	AfterLimit *int `json:"after_limit,omitempty"`
+	// Requests that the server returns the historic profile information for the
+	// users that sent the events that were returned.
+	IncludeProfile bool `json:"include_profile,omitempty"`
+}
+
+type ReqSearchGroupings struct {
+	GroupBy []ReqSearchGroupBy `json:"group_by"`
+}
+
+type ReqSearchGroupBy struct {
+	Key SearchGroupKey `json:"key"`
+}
+
+type RoomDirectoryVisibility string
+
+const (
+	RoomDirectoryVisibilityPublic  RoomDirectoryVisibility = "public"
+	RoomDirectoryVisibilityPrivate RoomDirectoryVisibility = "private"
+)
+
+// ReqSetRoomDirectoryVisibility is the JSON request for https://spec.matrix.org/v1.12/client-server-api/#put_matrixclientv3directorylistroomroomid
+// and https://spec.matrix.org/v1.12/application-service-api/#put_matrixclientv3directorylistappservicenetworkidroomid
+type ReqSetRoomDirectoryVisibility struct {
+	Visibility RoomDirectoryVisibility `json:"visibility"`
+}
+
+// ReqPublicRooms contains the parameters for https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv3publicrooms
+// and https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3publicrooms
+//
+// The filter and network fields are only supported by the POST variant.
+type ReqPublicRooms struct {
+	// The server to fetch the public room directory from. Defaults to the local server.
+	Server string `json:"-"`
+	// Limit for the maximum number of rooms to include per response.
+	Limit int `json:"limit,omitempty"`
+	// A pagination token from a previous PublicRooms call.
+	Since string `json:"since,omitempty"`
+
+	// Filter to apply to the results.
+	Filter *ReqPublicRoomsFilter `json:"filter,omitempty"`
+	// Whether to include all known networks/protocols from application services
+	// on the homeserver. Defaults to false.
+	IncludeAllNetworks bool `json:"include_all_networks,omitempty"`
+	// The specific third party network/protocol to request from the homeserver.
+	// Can only be used if IncludeAllNetworks is false.
+	ThirdPartyInstanceID string `json:"third_party_instance_id,omitempty"`
+}
+
+// NeedsPost returns true if the request has parameters that are only
+// supported by the POST variant of the endpoint.
+func (req *ReqPublicRooms) NeedsPost() bool {
+	return req != nil && (req.Filter != nil || req.IncludeAllNetworks || req.ThirdPartyInstanceID != "")
+}
+
+// Query returns the query parameters for the GET variant of the endpoint.
+// The POST variant only uses the server parameter.
+func (req *ReqPublicRooms) Query() map[string]string {
+	query := map[string]string{}
+	if req == nil {
+		return query
+	}
+	if req.Server != "" {
+		query["server"] = req.Server
+	}
+	if req.Limit > 0 {
+		query["limit"] = strconv.Itoa(req.Limit)
+	}
+	if req.Since != "" {
+		query["since"] = req.Since
+	}
+	return query
+}
+
+type ReqPublicRoomsFilter struct {
+	// An optional string to search for in the room metadata, e.g. name, topic,
+	// canonical alias, etc.
+	GenericSearchTerm string `json:"generic_search_term,omitempty"`
+	// An optional list of room types to search for. event.RoomTypeDefault
+	// matches rooms that don't have a type.
+	RoomTypes []event.RoomType `json:"-"`
+}
+
+func (filter *ReqPublicRoomsFilter) MarshalJSON() ([]byte, error) {
+	type rawFilter ReqPublicRoomsFilter
+	var roomTypes []*event.RoomType
+	if filter.RoomTypes != nil {
+		roomTypes = make([]*event.RoomType, len(filter.RoomTypes))
+		for i, roomType := range filter.RoomTypes {
+			if roomType != event.RoomTypeDefault {
+				roomTypes[i] = &roomType
+			}
+		}
+	}
+	return json.Marshal(&struct {
+		*rawFilter
+		RoomTypes []*event.RoomType `json:"room_types,omitempty"`
+	}{(*rawFilter)(filter), roomTypes})
+}
+
+// ReqSearchUserDirectory is the JSON request for https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3user_directorysearch
+type ReqSearchUserDirectory struct {
+	SearchTerm string `json:"search_term"`
+	Limit      int    `json:"limit,omitempty"`
+}
+
+// ReqGetNotifications contains the parameters for https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv3notifications
+//
+// As it's a GET method, there is no JSON body, so this is only query parameters.
+type ReqGetNotifications struct {
+	// A pagination token from a previous GetNotifications call.
+	From string
+	// Limit for the maximum number of notifications to include per response.
+	// The server will apply a default value if a limit isn't provided.
+	Limit int
+	// Flag to indicate whether only notifications which triggered a highlight should be returned.
+	OnlyHighlight bool
+}
+
+func (req *ReqGetNotifications) Query() map[string]string {
+	query := map[string]string{}
+	if req == nil {
+		return query
+	}
+	if req.From != "" {
+		query["from"] = req.From
+	}
+	if req.Limit > 0 {
+		query["limit"] = strconv.Itoa(req.Limit)
+	}
+	if req.OnlyHighlight {
+		query["only"] = "highlight"
+	}
+	return query
+}
+
+type PusherKind string
+
+const (
+	PusherKindHTTP  PusherKind = "http"
+	PusherKindEmail PusherKind = "email"
+)
+
+type PushFormat string
+
+const (
+	PushFormatEventIDOnly PushFormat = "event_id_only"
+)
+
+// Pusher is a pusher as returned by https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv3pushers
+type Pusher struct {
+	// A reverse-DNS style identifier for the application.
+	AppID string `json:"app_id"`
+	// A unique identifier for this pusher. For HTTP pushers, this is the
+	// device-specific push token. For email pushers, this is the email address.
+	Pushkey string `json:"pushkey"`
+	// The kind of pusher.
+	Kind PusherKind `json:"kind"`
+	// A string that will allow the user to identify what application owns this pusher.
+	AppDisplayName string `json:"app_display_name"`
+	// A string that will allow the user to identify what device owns this pusher.
+	DeviceDisplayName string `json:"device_display_name"`
+	// The preferred language for receiving notifications (e.g. "en" or "en-US").
+	Lang string `json:"lang"`
+	// This string determines which set of device specific rules this pusher executes.
+	ProfileTag string `json:"profile_tag,omitempty"`
+	// Information for the pusher implementation itself.
+	Data PusherData `json:"data"`
+}
+
+type PusherData struct {
+	// The URL to use to send notifications to. Required for HTTP pushers and
+	// must use the /_matrix/push/v1/notify path.
+	URL string `json:"url,omitempty"`
+	// The format to send notifications in to push gateways for HTTP pushers.
+	Format PushFormat `json:"format,omitempty"`
+}
+
+// ReqSetPusher is the JSON request for https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3pushersset
+type ReqSetPusher struct {
+	Pusher
+	// If true, the homeserver should add another pusher with the given pushkey
+	// and app ID in addition to any others with different user IDs. Otherwise,
+	// the homeserver must remove any other pushers with the same app ID and
+	// pushkey for different users.
+	Append bool `json:"append,omitempty"`
+}
+
+// ReqDeletePusher is the JSON request for deleting a pusher with https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3pushersset
+type ReqDeletePusher struct {
+	AppID   string      `json:"app_id"`
+	Pushkey string      `json:"pushkey"`
+	Kind    *PusherKind `json:"kind"`
+}
+
 type ReqAppservicePing struct {
 	TxnID string `json:"transaction_id,omitempty"`
 }
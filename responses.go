@@ -14,6 +14,7 @@ import (
 
 	"github.com/De-IM/mautrix/event"
 	"github.com/De-IM/mautrix/id"
+	"github.com/De-IM/mautrix/pushrules"
 )
 
 // RespWhoami is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3accountwhoami
@@ -149,6 +150,39 @@ func (r RespUserInteractive) HasSingleStageFlow(stageName AuthType) bool {
 	return false
 }
 
+// RespDeactivateAccount is the JSON response for https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3accountdeactivate
+type RespDeactivateAccount struct {
+	// "success" if the identity server unbound all 3PIDs, "no-support" otherwise.
+	IDServerUnbindResult string `json:"id_server_unbind_result"`
+}
+
+// RespDelete3PID is the JSON response for https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3account3piddelete
+// and https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3account3pidunbind
+type RespDelete3PID struct {
+	IDServerUnbindResult string `json:"id_server_unbind_result"`
+}
+
+// RespGet3PIDs is the JSON response for https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv3account3pid
+type RespGet3PIDs struct {
+	ThreePIDs []ThirdPartyIdentifier `json:"threepids"`
+}
+
+type ThirdPartyIdentifier struct {
+	Medium      ThreePIDMedium     `json:"medium"`
+	Address     string             `json:"address"`
+	AddedAt     jsontime.UnixMilli `json:"added_at"`
+	ValidatedAt jsontime.UnixMilli `json:"validated_at"`
+}
+
+// RespRequestToken is the JSON response for the requestToken endpoints, e.g.
+// https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3account3pidemailrequesttoken
+type RespRequestToken struct {
+	SessionID string `json:"sid"`
+	// An optional URL where the client should submit the validation token,
+	// used for msisdn validation.
+	SubmitURL string `json:"submit_url,omitempty"`
+}
+
 // RespUserDisplayName is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3profileuseriddisplayname
 type RespUserDisplayName struct {
 	DisplayName string `json:"displayname"`
@@ -159,6 +193,19 @@ type RespUserProfile struct {
 	AvatarURL   id.ContentURI `json:"avatar_url"`
 }
 
+// RespSearchUserDirectory is the JSON response for https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3user_directorysearch
+type RespSearchUserDirectory struct {
+	// Limited is true if the results were cut off by the limit.
+	Limited bool                   `json:"limited"`
+	Results []*UserDirectoryResult `json:"results"`
+}
+
+type UserDirectoryResult struct {
+	UserID      id.UserID     `json:"user_id"`
+	DisplayName string        `json:"display_name,omitempty"`
+	AvatarURL   id.ContentURI `json:"avatar_url,omitempty"`
+}
+
 // RespRegisterAvailable is the JSON response for https://spec.matrix.org/v1.4/client-server-api/#get_matrixclientv3registeravailable
 type RespRegisterAvailable struct {
 	Available bool `json:"available"`
@@ -179,6 +226,17 @@ type RespRegister struct {
 
 type LoginFlow struct {
 	Type AuthType `json:"type"`
+
+	// IdentityProviders contains the identity providers that can be used with m.login.sso flows.
+	IdentityProviders []IdentityProvider `json:"identity_providers,omitempty"`
+}
+
+// IdentityProvider is an SSO identity provider, see https://spec.matrix.org/v1.12/client-server-api/#definition-mloginsso-identity-provider
+type IdentityProvider struct {
+	ID    string              `json:"id"`
+	Name  string              `json:"name"`
+	Icon  id.ContentURIString `json:"icon,omitempty"`
+	Brand string              `json:"brand,omitempty"`
 }
 
 // RespLoginFlows is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3login
@@ -207,6 +265,16 @@ type RespLogin struct {
 	DeviceID    id.DeviceID      `json:"device_id"`
 	UserID      id.UserID        `json:"user_id"`
 	WellKnown   *ClientWellKnown `json:"well_known,omitempty"`
+
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresInMS  int64  `json:"expires_in_ms,omitempty"`
+}
+
+// RespRefresh is the JSON response for https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3refresh
+type RespRefresh struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresInMS  int64  `json:"expires_in_ms,omitempty"`
 }
 
 // RespLogout is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3logout
@@ -217,6 +285,16 @@ type RespCreateRoom struct {
 	RoomID id.RoomID `json:"room_id"`
 }
 
+// RespKnockRoom is the JSON response for https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3knockroomidoralias
+type RespKnockRoom struct {
+	RoomID id.RoomID `json:"room_id"`
+}
+
+// RespUpgradeRoom is the JSON response for https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3roomsroomidupgrade
+type RespUpgradeRoom struct {
+	ReplacementRoom id.RoomID `json:"replacement_room"`
+}
+
 type RespMembers struct {
 	Chunk []*event.Event `json:"chunk"`
 }
@@ -248,6 +326,9 @@ type RespSync struct {
 	DeviceLists    DeviceLists       `json:"device_lists"`
 	DeviceOTKCount OTKCount          `json:"device_one_time_keys_count"`
 	FallbackKeys   []id.KeyAlgorithm `json:"device_unused_fallback_key_types"`
+	// NoOTKCount is set if the response doesn't contain one-time key counts at all (e.g. a converted
+	// sliding sync response without the e2ee extension), so the zero DeviceOTKCount must be ignored.
+	NoOTKCount bool `json:"-"`
 
 	Rooms RespSyncRooms `json:"rooms"`
 }
@@ -558,6 +639,72 @@ type RespHierarchy struct {
 	Rooms     []ChildRoomsChunk `json:"rooms"`
 }
 
+// RespGetRelations is the JSON response for https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv1roomsroomidrelationseventid
+type RespGetRelations struct {
+	Chunk          []*event.Event `json:"chunk"`
+	NextBatch      string         `json:"next_batch,omitempty"`
+	PrevBatch      string         `json:"prev_batch,omitempty"`
+	RecursionDepth int            `json:"recursion_depth,omitempty"`
+}
+
+// RespGetThreads is the JSON response for https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv1roomsroomidthreads
+type RespGetThreads struct {
+	Chunk     []*event.Event `json:"chunk"`
+	NextBatch string         `json:"next_batch,omitempty"`
+}
+
+// RespSearch is the JSON response for https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3search
+type RespSearch struct {
+	SearchCategories RespSearchCategories `json:"search_categories"`
+}
+
+type RespSearchCategories struct {
+	RoomEvents *RespSearchRoomEvents `json:"room_events,omitempty"`
+}
+
+type RespSearchRoomEvents struct {
+	// An approximate count of the total number of results found.
+	Count int `json:"count,omitempty"`
+	// List of words which should be highlighted, useful for stemming which may
+	// change the query terms.
+	Highlights []string `json:"highlights,omitempty"`
+	// Token that can be used to get the next batch of results.
+	NextBatch string `json:"next_batch,omitempty"`
+	// List of results in the requested order.
+	Results []*SearchResult `json:"results"`
+	// The current state of each room in the results, if include_state was set.
+	State map[id.RoomID][]*event.Event `json:"state,omitempty"`
+	// Any groups that were requested, keyed by the grouping key and then by the
+	// group value (e.g. room ID or sender).
+	Groups map[SearchGroupKey]map[string]*SearchGroup `json:"groups,omitempty"`
+}
+
+type SearchResult struct {
+	// A number that describes how closely this result matches the search.
+	Rank float64 `json:"rank,omitempty"`
+	// The event that matched.
+	Result *event.Event `json:"result"`
+	// Context for the result, if requested.
+	Context *SearchEventContext `json:"context,omitempty"`
+}
+
+type SearchEventContext struct {
+	Start        string                         `json:"start,omitempty"`
+	End          string                         `json:"end,omitempty"`
+	EventsBefore []*event.Event                 `json:"events_before"`
+	EventsAfter  []*event.Event                 `json:"events_after"`
+	ProfileInfo  map[id.UserID]*RespUserProfile `json:"profile_info,omitempty"`
+}
+
+type SearchGroup struct {
+	// Token that can be used to get the next batch of results in the group.
+	NextBatch string `json:"next_batch,omitempty"`
+	// Key that can be used to order different groups.
+	Order int `json:"order"`
+	// The IDs of the events in the group.
+	Results []id.EventID `json:"results"`
+}
+
 type ChildRoomsChunk struct {
 	AvatarURL        id.ContentURI           `json:"avatar_url,omitempty"`
 	CanonicalAlias   id.RoomAlias            `json:"canonical_alias,omitempty"`
@@ -572,6 +719,52 @@ type ChildRoomsChunk struct {
 	WorldReadble     bool                    `json:"world_readable"`
 }
 
+// RespRoomDirectoryVisibility is the JSON response for https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv3directorylistroomroomid
+type RespRoomDirectoryVisibility struct {
+	Visibility RoomDirectoryVisibility `json:"visibility"`
+}
+
+// RespPublicRooms is the JSON response for https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv3publicrooms
+type RespPublicRooms struct {
+	Chunk                  []*PublicRoomsChunk `json:"chunk"`
+	NextBatch              string              `json:"next_batch,omitempty"`
+	PrevBatch              string              `json:"prev_batch,omitempty"`
+	TotalRoomCountEstimate int                 `json:"total_room_count_estimate,omitempty"`
+}
+
+type PublicRoomsChunk struct {
+	AvatarURL        id.ContentURI  `json:"avatar_url,omitempty"`
+	CanonicalAlias   id.RoomAlias   `json:"canonical_alias,omitempty"`
+	GuestCanJoin     bool           `json:"guest_can_join"`
+	JoinRule         event.JoinRule `json:"join_rule,omitempty"`
+	Name             string         `json:"name,omitempty"`
+	NumJoinedMembers int            `json:"num_joined_members"`
+	RoomID           id.RoomID      `json:"room_id"`
+	RoomType         event.RoomType `json:"room_type,omitempty"`
+	Topic            string         `json:"topic,omitempty"`
+	WorldReadable    bool           `json:"world_readable"`
+}
+
+// RespGetNotifications is the JSON response for https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv3notifications
+type RespGetNotifications struct {
+	NextToken     string          `json:"next_token,omitempty"`
+	Notifications []*Notification `json:"notifications"`
+}
+
+type Notification struct {
+	Actions    pushrules.PushActionArray `json:"actions"`
+	Event      *event.Event              `json:"event"`
+	ProfileTag string                    `json:"profile_tag,omitempty"`
+	Read       bool                      `json:"read"`
+	RoomID     id.RoomID                 `json:"room_id"`
+	Timestamp  jsontime.UnixMilli        `json:"ts"`
+}
+
+// RespGetPushers is the JSON response for https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv3pushers
+type RespGetPushers struct {
+	Pushers []*Pusher `json:"pushers"`
+}
+
 type StrippedStateWithTime struct {
 	event.StrippedState
 	Timestamp jsontime.UnixMilli `json:"origin_server_ts"`
@@ -0,0 +1,405 @@
+package mautrix
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/De-IM/mautrix/event"
+	"github.com/De-IM/mautrix/id"
+)
+
+// Special values for the state key in RequiredState.
+const (
+	RequiredStateWildcard = "*"
+	RequiredStateLazy     = "$LAZY"
+	RequiredStateMe       = "$ME"
+)
+
+// ReqSlidingSync is the JSON request for simplified sliding sync (MSC4186).
+//
+// See https://github.com/matrix-org/matrix-spec-proposals/pull/4186
+type ReqSlidingSync struct {
+	// Pos is the position returned by the previous response. Empty for the initial sync.
+	Pos string `json:"-"`
+	// Timeout is the maximum time in milliseconds to wait for new data.
+	Timeout int `json:"-"`
+	// SetPresence controls whether the client is automatically marked as online by polling this API.
+	SetPresence event.Presence `json:"-"`
+
+	ConnID            string                                     `json:"conn_id,omitempty"`
+	Lists             map[string]*SlidingSyncList                `json:"lists,omitempty"`
+	RoomSubscriptions map[id.RoomID]*SlidingSyncRoomSubscription `json:"room_subscriptions,omitempty"`
+	Extensions        *SlidingSyncExtensions                     `json:"extensions,omitempty"`
+}
+
+func (req *ReqSlidingSync) Query() map[string]string {
+	query := map[string]string{}
+	if req == nil {
+		return query
+	}
+	if req.Pos != "" {
+		query["pos"] = req.Pos
+	}
+	if req.Timeout > 0 {
+		query["timeout"] = strconv.Itoa(req.Timeout)
+	}
+	if req.SetPresence != "" {
+		query["set_presence"] = string(req.SetPresence)
+	}
+	return query
+}
+
+// SlidingSyncRoomSubscription specifies which data to include for rooms in a list or an explicit room subscription.
+type SlidingSyncRoomSubscription struct {
+	// RequiredState is a list of [event type, state key] pairs of state events to include.
+	// The state key may be one of the special values RequiredStateWildcard, RequiredStateLazy or RequiredStateMe.
+	RequiredState [][2]string `json:"required_state"`
+	TimelineLimit int         `json:"timeline_limit"`
+}
+
+// SlidingSyncList is a sorted list of rooms, of which the rooms in Ranges are returned.
+type SlidingSyncList struct {
+	SlidingSyncRoomSubscription
+	// Ranges are the inclusive index ranges of rooms in the list to return.
+	Ranges  [][2]int                `json:"ranges,omitempty"`
+	Filters *SlidingSyncListFilters `json:"filters,omitempty"`
+}
+
+type SlidingSyncListFilters struct {
+	IsDM         *bool            `json:"is_dm,omitempty"`
+	Spaces       []id.RoomID      `json:"spaces,omitempty"`
+	IsEncrypted  *bool            `json:"is_encrypted,omitempty"`
+	IsInvite     *bool            `json:"is_invite,omitempty"`
+	RoomTypes    []event.RoomType `json:"room_types,omitempty"`
+	NotRoomTypes []event.RoomType `json:"not_room_types,omitempty"`
+	RoomNameLike string           `json:"room_name_like,omitempty"`
+	Tags         []event.RoomTag  `json:"tags,omitempty"`
+	NotTags      []event.RoomTag  `json:"not_tags,omitempty"`
+}
+
+type SlidingSyncExtensions struct {
+	ToDevice    *SlidingSyncToDeviceExtension `json:"to_device,omitempty"`
+	E2EE        *SlidingSyncExtension         `json:"e2ee,omitempty"`
+	AccountData *SlidingSyncRoomExtension     `json:"account_data,omitempty"`
+	Receipts    *SlidingSyncRoomExtension     `json:"receipts,omitempty"`
+	Typing      *SlidingSyncRoomExtension     `json:"typing,omitempty"`
+}
+
+type SlidingSyncExtension struct {
+	Enabled bool `json:"enabled"`
+}
+
+type SlidingSyncToDeviceExtension struct {
+	Enabled bool `json:"enabled"`
+	Limit   int  `json:"limit,omitempty"`
+	// Since is the next_batch token of the previous to-device extension response.
+	// It's filled automatically by Client.SlidingSyncWithContext.
+	Since string `json:"since,omitempty"`
+}
+
+// SlidingSyncRoomExtension is an extension that can be limited to specific lists and rooms.
+// If Lists and Rooms are nil, the extension applies to all lists and room subscriptions.
+type SlidingSyncRoomExtension struct {
+	Enabled bool        `json:"enabled"`
+	Lists   []string    `json:"lists,omitempty"`
+	Rooms   []id.RoomID `json:"rooms,omitempty"`
+}
+
+// RespSlidingSync is the JSON response for simplified sliding sync (MSC4186).
+type RespSlidingSync struct {
+	Pos        string                              `json:"pos"`
+	Lists      map[string]*SlidingSyncListResponse `json:"lists,omitempty"`
+	Rooms      map[id.RoomID]*SlidingSyncRoom      `json:"rooms,omitempty"`
+	Extensions SlidingSyncExtensionsResponse       `json:"extensions"`
+}
+
+type SlidingSyncListResponse struct {
+	Count int `json:"count"`
+}
+
+type SlidingSyncRoom struct {
+	Name             string              `json:"name,omitempty"`
+	Avatar           id.ContentURIString `json:"avatar,omitempty"`
+	Heroes           []SlidingSyncHero   `json:"heroes,omitempty"`
+	IsDM             bool                `json:"is_dm,omitempty"`
+	Initial          bool                `json:"initial,omitempty"`
+	ExpandedTimeline bool                `json:"expanded_timeline,omitempty"`
+
+	RequiredState []*event.Event `json:"required_state,omitempty"`
+	InviteState   []*event.Event `json:"invite_state,omitempty"`
+	Timeline      []*event.Event `json:"timeline,omitempty"`
+	PrevBatch     string         `json:"prev_batch,omitempty"`
+	Limited       bool           `json:"limited,omitempty"`
+	NumLive       int            `json:"num_live,omitempty"`
+	BumpStamp     int64          `json:"bump_stamp,omitempty"`
+
+	JoinedCount       int `json:"joined_count,omitempty"`
+	InvitedCount      int `json:"invited_count,omitempty"`
+	NotificationCount int `json:"notification_count,omitempty"`
+	HighlightCount    int `json:"highlight_count,omitempty"`
+}
+
+type SlidingSyncHero struct {
+	UserID      id.UserID           `json:"user_id"`
+	DisplayName string              `json:"displayname,omitempty"`
+	AvatarURL   id.ContentURIString `json:"avatar_url,omitempty"`
+}
+
+type SlidingSyncExtensionsResponse struct {
+	ToDevice    *SlidingSyncToDeviceResponse    `json:"to_device,omitempty"`
+	E2EE        *SlidingSyncE2EEResponse        `json:"e2ee,omitempty"`
+	AccountData *SlidingSyncAccountDataResponse `json:"account_data,omitempty"`
+	Receipts    *SlidingSyncEphemeralResponse   `json:"receipts,omitempty"`
+	Typing      *SlidingSyncEphemeralResponse   `json:"typing,omitempty"`
+}
+
+type SlidingSyncToDeviceResponse struct {
+	NextBatch string         `json:"next_batch"`
+	Events    []*event.Event `json:"events,omitempty"`
+}
+
+type SlidingSyncE2EEResponse struct {
+	DeviceLists    DeviceLists       `json:"device_lists"`
+	DeviceOTKCount OTKCount          `json:"device_one_time_keys_count"`
+	FallbackKeys   []id.KeyAlgorithm `json:"device_unused_fallback_key_types"`
+}
+
+type SlidingSyncAccountDataResponse struct {
+	Global []*event.Event               `json:"global,omitempty"`
+	Rooms  map[id.RoomID][]*event.Event `json:"rooms,omitempty"`
+}
+
+// SlidingSyncEphemeralResponse contains a single ephemeral event (e.g. m.receipt or m.typing) per room.
+type SlidingSyncEphemeralResponse struct {
+	Rooms map[id.RoomID]*event.Event `json:"rooms,omitempty"`
+}
+
+func findOwnMembership(userID id.UserID, eventLists ...[]*event.Event) event.Membership {
+	var membership event.Membership
+	for _, evts := range eventLists {
+		for _, evt := range evts {
+			if evt.Type == event.StateMember && evt.GetStateKey() == userID.String() {
+				rawMembership, _ := evt.Content.Raw["membership"].(string)
+				membership = event.Membership(rawMembership)
+			}
+		}
+	}
+	return membership
+}
+
+// ToSync converts the sliding sync response into a /sync response, so that it can be passed to
+// Syncer.ProcessResponse and handled by existing event handlers, the crypto machine and the state store.
+//
+// If the e2ee extension isn't enabled, NoOTKCount is set in the returned response so that the
+// crypto machine doesn't mistake the missing counts for an empty key pool and upload new keys.
+//
+// The user ID is needed to sort rooms into joined, invited, knocked and left rooms
+// based on the user's own membership event.
+func (resp *RespSlidingSync) ToSync(userID id.UserID) *RespSync {
+	syncResp := &RespSync{
+		NextBatch: resp.Pos,
+		Rooms: RespSyncRooms{
+			Join:   make(map[id.RoomID]*SyncJoinedRoom),
+			Invite: make(map[id.RoomID]*SyncInvitedRoom),
+			Leave:  make(map[id.RoomID]*SyncLeftRoom),
+			Knock:  make(map[id.RoomID]*SyncKnockedRoom),
+		},
+	}
+	ext := &resp.Extensions
+	if ext.ToDevice != nil {
+		syncResp.ToDevice.Events = ext.ToDevice.Events
+	}
+	if ext.E2EE != nil {
+		syncResp.DeviceLists = ext.E2EE.DeviceLists
+		syncResp.DeviceOTKCount = ext.E2EE.DeviceOTKCount
+		syncResp.FallbackKeys = ext.E2EE.FallbackKeys
+	} else {
+		syncResp.NoOTKCount = true
+	}
+	if ext.AccountData != nil {
+		syncResp.AccountData.Events = ext.AccountData.Global
+	}
+	for roomID, room := range resp.Rooms {
+		if len(room.InviteState) > 0 {
+			if findOwnMembership(userID, room.InviteState) == event.MembershipKnock {
+				syncResp.Rooms.Knock[roomID] = &SyncKnockedRoom{State: SyncEventsList{Events: room.InviteState}}
+			} else {
+				syncResp.Rooms.Invite[roomID] = &SyncInvitedRoom{State: SyncEventsList{Events: room.InviteState}}
+			}
+			continue
+		}
+		timeline := SyncTimeline{
+			SyncEventsList: SyncEventsList{Events: room.Timeline},
+			Limited:        room.Limited,
+			PrevBatch:      room.PrevBatch,
+		}
+		switch findOwnMembership(userID, room.RequiredState, room.Timeline) {
+		case event.MembershipLeave, event.MembershipBan:
+			syncResp.Rooms.Leave[roomID] = &SyncLeftRoom{
+				State:    SyncEventsList{Events: room.RequiredState},
+				Timeline: timeline,
+			}
+		default:
+			syncResp.Rooms.Join[roomID] = &SyncJoinedRoom{
+				State:    SyncEventsList{Events: room.RequiredState},
+				Timeline: timeline,
+				UnreadNotifications: &UnreadNotificationCounts{
+					HighlightCount:    room.HighlightCount,
+					NotificationCount: room.NotificationCount,
+				},
+			}
+		}
+	}
+	getJoinedRoom := func(roomID id.RoomID) *SyncJoinedRoom {
+		room, ok := syncResp.Rooms.Join[roomID]
+		if !ok {
+			room = &SyncJoinedRoom{}
+			syncResp.Rooms.Join[roomID] = room
+		}
+		return room
+	}
+	if ext.AccountData != nil {
+		for roomID, evts := range ext.AccountData.Rooms {
+			if _, isLeft := syncResp.Rooms.Leave[roomID]; !isLeft {
+				room := getJoinedRoom(roomID)
+				room.AccountData.Events = append(room.AccountData.Events, evts...)
+			}
+		}
+	}
+	for _, ephemeral := range []*SlidingSyncEphemeralResponse{ext.Receipts, ext.Typing} {
+		if ephemeral == nil {
+			continue
+		}
+		for roomID, evt := range ephemeral.Rooms {
+			if _, isLeft := syncResp.Rooms.Leave[roomID]; !isLeft && evt != nil {
+				room := getJoinedRoom(roomID)
+				room.Ephemeral.Events = append(room.Ephemeral.Events, evt)
+			}
+		}
+	}
+	return syncResp
+}
+
+// SlidingSyncRequest makes a single simplified sliding sync (MSC4186) request.
+func (cli *Client) SlidingSyncRequest(ctx context.Context, req *ReqSlidingSync) (resp *RespSlidingSync, err error) {
+	_, err = cli.MakeFullRequest(ctx, FullRequest{
+		Method:       http.MethodPost,
+		URL:          cli.BuildURLWithQuery(ClientURLPath{"unstable", "org.matrix.simplified_msc3575", "sync"}, req.Query()),
+		RequestJSON:  req,
+		ResponseJSON: &resp,
+		// We don't want automatic retries for sync requests, the SlidingSyncWithContext wrapper handles those.
+		MaxAttempts: 1,
+	})
+	return
+}
+
+// SlidingSyncHandler handles a whole sliding sync response. If the return value is false,
+// the response won't be passed to ProcessResponse.
+type SlidingSyncHandler func(ctx context.Context, resp *RespSlidingSync, since string) bool
+
+// SlidingSyncListener is an optional interface for syncers that want the raw sliding sync responses,
+// e.g. to get list counts or computed room names. Responses are passed to ProcessResponse afterwards
+// unless this returns false.
+type SlidingSyncListener interface {
+	ProcessSlidingSyncResponse(ctx context.Context, resp *RespSlidingSync, since string) bool
+}
+
+// SlidingSyncWithContext syncs using simplified sliding sync (MSC4186) instead of /v3/sync. The request is used as
+// the template for every sync: Pos, Timeout and the to-device since token are filled automatically.
+//
+// Each response is converted with RespSlidingSync.ToSync and passed to Syncer.ProcessResponse, so event handlers,
+// the crypto machine and the state store work the same way as with Sync. The position is persisted if the
+// SyncStore implements SlidingSyncStore. If the server has forgotten the position, the sync is restarted
+// from scratch, which means the next response is processed like an initial sync.
+//
+// Like SyncWithContext, this blocks until a fatal error occurs or StopSync is called.
+func (cli *Client) SlidingSyncWithContext(ctx context.Context, req *ReqSlidingSync) error {
+	syncingID := cli.incrementSyncingID()
+	posStore, _ := cli.Store.(SlidingSyncStore)
+	var pos SlidingSyncPosition
+	if posStore != nil {
+		loadedPos, err := posStore.LoadSlidingSyncPosition(ctx, cli.UserID, req.ConnID)
+		if err != nil {
+			return err
+		} else if loadedPos != nil {
+			pos = *loadedPos
+		}
+	}
+	reqCopy := *req
+	if req.Extensions != nil {
+		extCopy := *req.Extensions
+		reqCopy.Extensions = &extCopy
+		if extCopy.ToDevice != nil {
+			toDeviceCopy := *extCopy.ToDevice
+			extCopy.ToDevice = &toDeviceCopy
+		}
+	}
+	if reqCopy.SetPresence == "" {
+		reqCopy.SetPresence = cli.SyncPresence
+	}
+	// Always do first sync with 0 timeout
+	isFailing := true
+	for {
+		reqCopy.Pos = pos.Pos
+		reqCopy.Timeout = 30000
+		if isFailing {
+			reqCopy.Timeout = 0
+		}
+		if reqCopy.Extensions != nil && reqCopy.Extensions.ToDevice != nil {
+			reqCopy.Extensions.ToDevice.Since = pos.ToDeviceSince
+		}
+		resp, err := cli.SlidingSyncRequest(ctx, &reqCopy)
+		if errors.Is(err, MUnknownPos) {
+			cli.Log.Warn().Str("pos", pos.Pos).Msg("Server doesn't recognize sliding sync position, restarting sync")
+			// The to-device stream is independent of the connection, so keep its token
+			pos.Pos = ""
+			isFailing = true
+			continue
+		} else if err != nil {
+			isFailing = true
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			duration, err2 := cli.Syncer.OnFailedSync(nil, err)
+			if err2 != nil {
+				return err2
+			}
+			if duration <= 0 {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(duration):
+				continue
+			}
+		}
+		isFailing = false
+
+		if cli.getSyncingID() != syncingID {
+			return nil
+		}
+
+		since := pos.Pos
+		pos.Pos = resp.Pos
+		if resp.Extensions.ToDevice != nil && resp.Extensions.ToDevice.NextBatch != "" {
+			pos.ToDeviceSince = resp.Extensions.ToDevice.NextBatch
+		}
+		// Save the position before processing, see SyncWithContext for the reasoning
+		if posStore != nil {
+			err = posStore.SaveSlidingSyncPosition(ctx, cli.UserID, req.ConnID, &pos)
+			if err != nil {
+				return err
+			}
+		}
+		if listener, ok := cli.Syncer.(SlidingSyncListener); ok && !listener.ProcessSlidingSyncResponse(ctx, resp, since) {
+			continue
+		}
+		if err = cli.Syncer.ProcessResponse(ctx, resp.ToSync(cli.UserID), since); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Package sqlbackfillstore implements a [mautrix.BackfillStore] using a SQL database.
+package sqlbackfillstore
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+
+	"github.com/De-IM/mautrix"
+	"github.com/De-IM/mautrix/id"
+)
+
+//go:embed *.sql
+var rawUpgrades embed.FS
+
+var UpgradeTable dbutil.UpgradeTable
+
+func init() {
+	UpgradeTable.RegisterFS(rawUpgrades)
+}
+
+const VersionTableName = "mx_backfill_version"
+
+// SQLBackfillStore stores the last seen event of each room and the timeline gaps being filled
+// by a [mautrix.GapBackfiller] in a SQL database.
+//
+// The data is keyed by the user and device ID of the store, so multiple accounts and devices
+// can share the same database.
+type SQLBackfillStore struct {
+	*dbutil.Database
+	UserID   id.UserID
+	DeviceID id.DeviceID
+}
+
+var _ mautrix.BackfillStore = (*SQLBackfillStore)(nil)
+
+// NewSQLBackfillStore creates a new backfill store for the given user and device. The database must be
+// upgraded with Upgrade before use.
+func NewSQLBackfillStore(db *dbutil.Database, log dbutil.DatabaseLogger, userID id.UserID, deviceID id.DeviceID) *SQLBackfillStore {
+	return &SQLBackfillStore{
+		Database: db.Child(VersionTableName, UpgradeTable, log),
+		UserID:   userID,
+		DeviceID: deviceID,
+	}
+}
+
+const (
+	getLastSeenEventQuery = `
+		SELECT event_id FROM mx_backfill_last_seen WHERE user_id=$1 AND device_id=$2 AND room_id=$3
+	`
+	putLastSeenEventQuery = `
+		INSERT INTO mx_backfill_last_seen (user_id, device_id, room_id, event_id) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, device_id, room_id) DO UPDATE SET event_id=excluded.event_id
+	`
+	putGapQuery = `
+		INSERT INTO mx_backfill_gap (user_id, device_id, room_id, prev_batch, last_seen, latest, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (user_id, device_id, room_id, prev_batch) DO UPDATE
+			SET last_seen=excluded.last_seen, latest=excluded.latest
+	`
+	deleteGapQuery = `
+		DELETE FROM mx_backfill_gap WHERE user_id=$1 AND device_id=$2 AND room_id=$3 AND prev_batch=$4
+	`
+	getGapsQuery = `
+		SELECT room_id, prev_batch, last_seen, latest FROM mx_backfill_gap WHERE user_id=$1 AND device_id=$2
+		ORDER BY created_at
+	`
+)
+
+func (store *SQLBackfillStore) GetLastSeenEvent(ctx context.Context, roomID id.RoomID) (eventID id.EventID, err error) {
+	err = store.QueryRow(ctx, getLastSeenEventQuery, store.UserID, store.DeviceID, roomID).Scan(&eventID)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return
+}
+
+func (store *SQLBackfillStore) SetLastSeenEvent(ctx context.Context, roomID id.RoomID, eventID id.EventID) error {
+	_, err := store.Exec(ctx, putLastSeenEventQuery, store.UserID, store.DeviceID, roomID, eventID)
+	return err
+}
+
+func (store *SQLBackfillStore) PutGap(ctx context.Context, gap *mautrix.TimelineGap) error {
+	_, err := store.Exec(
+		ctx, putGapQuery, store.UserID, store.DeviceID, gap.RoomID, gap.From, gap.LastSeen, gap.Latest, time.Now().UnixNano(),
+	)
+	return err
+}
+
+func (store *SQLBackfillStore) DeleteGap(ctx context.Context, gap *mautrix.TimelineGap) error {
+	_, err := store.Exec(ctx, deleteGapQuery, store.UserID, store.DeviceID, gap.RoomID, gap.From)
+	return err
+}
+
+func scanGap(row dbutil.Scannable) (*mautrix.TimelineGap, error) {
+	var gap mautrix.TimelineGap
+	err := row.Scan(&gap.RoomID, &gap.From, &gap.LastSeen, &gap.Latest)
+	if err != nil {
+		return nil, err
+	}
+	return &gap, nil
+}
+
+func (store *SQLBackfillStore) GetGaps(ctx context.Context) ([]*mautrix.TimelineGap, error) {
+	rows, err := store.Query(ctx, getGapsQuery, store.UserID, store.DeviceID)
+	return dbutil.NewRowIterWithError(rows, scanGap, err).AsList()
+}
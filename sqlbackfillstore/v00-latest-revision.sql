@@ -0,0 +1,22 @@
+-- v0 -> v1: Latest revision
+
+CREATE TABLE mx_backfill_last_seen (
+	user_id   TEXT NOT NULL,
+	device_id TEXT NOT NULL,
+	room_id   TEXT NOT NULL,
+	event_id  TEXT NOT NULL,
+
+	PRIMARY KEY (user_id, device_id, room_id)
+);
+
+CREATE TABLE mx_backfill_gap (
+	user_id    TEXT   NOT NULL,
+	device_id  TEXT   NOT NULL,
+	room_id    TEXT   NOT NULL,
+	prev_batch TEXT   NOT NULL,
+	last_seen  TEXT   NOT NULL,
+	latest     TEXT   NOT NULL,
+	created_at BIGINT NOT NULL,
+
+	PRIMARY KEY (user_id, device_id, room_id, prev_batch)
+);
@@ -15,12 +15,14 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog"
 	"go.mau.fi/util/confusable"
 	"go.mau.fi/util/dbutil"
 	"go.mau.fi/util/exslices"
 
+	"github.com/De-IM/mautrix"
 	"github.com/De-IM/mautrix/event"
 	"github.com/De-IM/mautrix/id"
 )
@@ -471,3 +473,70 @@ func (store *SQLStateStore) HasPowerLevel(ctx context.Context, roomID id.RoomID,
 		return levels.GetUserLevel(userID) >= levels.GetEventLevel(eventType), nil
 	}
 }
+
+const (
+	getCachedProfileQuery = `
+		SELECT displayname, avatar_url, fetched_at FROM mx_global_profile WHERE user_id=$1
+	`
+	setCachedProfileQuery = `
+		INSERT INTO mx_global_profile (user_id, displayname, avatar_url, fetched_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE
+			SET displayname=excluded.displayname, avatar_url=excluded.avatar_url, fetched_at=excluded.fetched_at
+	`
+)
+
+func (store *SQLStateStore) GetCachedProfile(ctx context.Context, userID id.UserID) (*mautrix.CachedProfile, error) {
+	var profile event.MemberEventContent
+	var fetchedAt int64
+	err := store.QueryRow(ctx, getCachedProfileQuery, userID).Scan(&profile.Displayname, &profile.AvatarURL, &fetchedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &mautrix.CachedProfile{Profile: &profile, FetchedAt: time.UnixMilli(fetchedAt)}, nil
+}
+
+func (store *SQLStateStore) SetCachedProfile(ctx context.Context, userID id.UserID, profile *event.MemberEventContent) error {
+	_, err := store.Exec(ctx, setCachedProfileQuery, userID, profile.Displayname, profile.AvatarURL, time.Now().UnixMilli())
+	return err
+}
+
+const (
+	moveRoomMembersQuery = `
+		INSERT INTO mx_user_profile (room_id, user_id, membership, displayname, avatar_url, name_skeleton)
+		SELECT $2, user_id, CASE WHEN membership='ban' THEN membership ELSE 'leave' END, displayname, avatar_url, name_skeleton
+		FROM mx_user_profile WHERE room_id=$1
+		ON CONFLICT (room_id, user_id) DO NOTHING
+	`
+	moveRoomStateQuery = `
+		INSERT INTO mx_room_state (room_id, power_levels, encryption)
+		SELECT $2, power_levels, encryption FROM mx_room_state WHERE room_id=$1
+		ON CONFLICT (room_id) DO UPDATE
+			SET power_levels=COALESCE(mx_room_state.power_levels, excluded.power_levels),
+				encryption=COALESCE(mx_room_state.encryption, excluded.encryption)
+	`
+)
+
+func (store *SQLStateStore) MoveRoomState(ctx context.Context, oldRoomID, newRoomID id.RoomID) error {
+	return store.DoTxn(ctx, nil, func(ctx context.Context) error {
+		_, err := store.Exec(ctx, moveRoomMembersQuery, oldRoomID, newRoomID)
+		if err != nil {
+			return fmt.Errorf("failed to move members: %w", err)
+		}
+		_, err = store.Exec(ctx, moveRoomStateQuery, oldRoomID, newRoomID)
+		if err != nil {
+			return fmt.Errorf("failed to move room state: %w", err)
+		}
+		_, err = store.Exec(ctx, "DELETE FROM mx_user_profile WHERE room_id=$1", oldRoomID)
+		if err != nil {
+			return fmt.Errorf("failed to delete old members: %w", err)
+		}
+		_, err = store.Exec(ctx, "DELETE FROM mx_room_state WHERE room_id=$1", oldRoomID)
+		if err != nil {
+			return fmt.Errorf("failed to delete old room state: %w", err)
+		}
+		return nil
+	})
+}
@@ -1,4 +1,4 @@
--- v0 -> v7 (compatible with v3+): Latest revision
+-- v0 -> v8 (compatible with v3+): Latest revision
 
 CREATE TABLE mx_registrations (
 	user_id TEXT PRIMARY KEY
@@ -28,3 +28,10 @@ CREATE TABLE mx_room_state (
 	encryption      jsonb,
 	members_fetched BOOLEAN NOT NULL DEFAULT false
 );
+
+CREATE TABLE mx_global_profile (
+	user_id     TEXT   PRIMARY KEY,
+	displayname TEXT   NOT NULL DEFAULT '',
+	avatar_url  TEXT   NOT NULL DEFAULT '',
+	fetched_at  BIGINT NOT NULL
+);
@@ -0,0 +1,7 @@
+-- v8 (compatible with v3+): Add table for caching global user profiles
+CREATE TABLE mx_global_profile (
+	user_id     TEXT   PRIMARY KEY,
+	displayname TEXT   NOT NULL DEFAULT '',
+	avatar_url  TEXT   NOT NULL DEFAULT '',
+	fetched_at  BIGINT NOT NULL
+);
@@ -0,0 +1,170 @@
+// Package sqlsyncstore implements a [mautrix.SyncStore] using a SQL database.
+package sqlsyncstore
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"sync"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+
+	"github.com/De-IM/mautrix"
+	"github.com/De-IM/mautrix/id"
+)
+
+//go:embed *.sql
+var rawUpgrades embed.FS
+
+var UpgradeTable dbutil.UpgradeTable
+
+func init() {
+	UpgradeTable.RegisterFS(rawUpgrades)
+}
+
+const VersionTableName = "mx_sync_version"
+
+// SQLSyncStore stores sync tokens and filter IDs in a SQL database.
+//
+// The data is keyed by the user ID passed to the methods and the device ID of the store,
+// so multiple accounts and devices can share the same database.
+type SQLSyncStore struct {
+	*dbutil.Database
+	DeviceID id.DeviceID
+
+	// CheckpointInterval is the minimum time between writes of the next batch token. If zero, the token is
+	// written on every sync. Otherwise, tokens are kept in memory in between, which means that some sync responses
+	// may be received again after a crash. Checkpoint should be called before shutting down to save the latest token.
+	CheckpointInterval time.Duration
+
+	pending        map[id.UserID]string
+	lastCheckpoint map[id.UserID]time.Time
+	lock           sync.Mutex
+}
+
+var (
+	_ mautrix.SyncStore           = (*SQLSyncStore)(nil)
+	_ mautrix.FilterHashSyncStore = (*SQLSyncStore)(nil)
+	_ mautrix.SlidingSyncStore    = (*SQLSyncStore)(nil)
+)
+
+// NewSQLSyncStore creates a new sync store for the given device. The database must be upgraded
+// with Upgrade before use.
+func NewSQLSyncStore(db *dbutil.Database, log dbutil.DatabaseLogger, deviceID id.DeviceID) *SQLSyncStore {
+	return &SQLSyncStore{
+		Database:       db.Child(VersionTableName, UpgradeTable, log),
+		DeviceID:       deviceID,
+		pending:        make(map[id.UserID]string),
+		lastCheckpoint: make(map[id.UserID]time.Time),
+	}
+}
+
+const (
+	getFilterQuery = `
+		SELECT filter_id, filter_hash FROM mx_sync_store WHERE user_id=$1 AND device_id=$2
+	`
+	putFilterQuery = `
+		INSERT INTO mx_sync_store (user_id, device_id, filter_id, filter_hash) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, device_id) DO UPDATE SET filter_id=excluded.filter_id, filter_hash=excluded.filter_hash
+	`
+	getNextBatchQuery = `
+		SELECT next_batch FROM mx_sync_store WHERE user_id=$1 AND device_id=$2
+	`
+	putNextBatchQuery = `
+		INSERT INTO mx_sync_store (user_id, device_id, next_batch) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, device_id) DO UPDATE SET next_batch=excluded.next_batch
+	`
+	getSlidingSyncPositionQuery = `
+		SELECT pos, to_device_since FROM mx_sliding_sync_position WHERE user_id=$1 AND device_id=$2 AND conn_id=$3
+	`
+	putSlidingSyncPositionQuery = `
+		INSERT INTO mx_sliding_sync_position (user_id, device_id, conn_id, pos, to_device_since) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, device_id, conn_id) DO UPDATE SET pos=excluded.pos, to_device_since=excluded.to_device_since
+	`
+)
+
+func (store *SQLSyncStore) SaveFilterID(ctx context.Context, userID id.UserID, filterID string) error {
+	return store.SaveFilterIDWithHash(ctx, userID, filterID, "")
+}
+
+func (store *SQLSyncStore) LoadFilterID(ctx context.Context, userID id.UserID) (string, error) {
+	filterID, _, err := store.LoadFilterIDWithHash(ctx, userID)
+	return filterID, err
+}
+
+func (store *SQLSyncStore) SaveFilterIDWithHash(ctx context.Context, userID id.UserID, filterID, filterHash string) error {
+	_, err := store.Exec(ctx, putFilterQuery, userID, store.DeviceID, filterID, filterHash)
+	return err
+}
+
+func (store *SQLSyncStore) LoadFilterIDWithHash(ctx context.Context, userID id.UserID) (filterID, filterHash string, err error) {
+	err = store.QueryRow(ctx, getFilterQuery, userID, store.DeviceID).Scan(&filterID, &filterHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return
+}
+
+func (store *SQLSyncStore) SaveNextBatch(ctx context.Context, userID id.UserID, nextBatchToken string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if store.CheckpointInterval > 0 && time.Since(store.lastCheckpoint[userID]) < store.CheckpointInterval {
+		store.pending[userID] = nextBatchToken
+		return nil
+	}
+	return store.saveNextBatch(ctx, userID, nextBatchToken)
+}
+
+func (store *SQLSyncStore) saveNextBatch(ctx context.Context, userID id.UserID, nextBatchToken string) error {
+	_, err := store.Exec(ctx, putNextBatchQuery, userID, store.DeviceID, nextBatchToken)
+	if err != nil {
+		return err
+	}
+	delete(store.pending, userID)
+	store.lastCheckpoint[userID] = time.Now()
+	return nil
+}
+
+func (store *SQLSyncStore) LoadNextBatch(ctx context.Context, userID id.UserID) (nextBatch string, err error) {
+	store.lock.Lock()
+	pending, ok := store.pending[userID]
+	store.lock.Unlock()
+	if ok {
+		return pending, nil
+	}
+	err = store.QueryRow(ctx, getNextBatchQuery, userID, store.DeviceID).Scan(&nextBatch)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return
+}
+
+// Checkpoint writes the next batch tokens that haven't been written yet because of CheckpointInterval.
+func (store *SQLSyncStore) Checkpoint(ctx context.Context) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for userID, nextBatch := range store.pending {
+		if err := store.saveNextBatch(ctx, userID, nextBatch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *SQLSyncStore) SaveSlidingSyncPosition(ctx context.Context, userID id.UserID, connID string, pos *mautrix.SlidingSyncPosition) error {
+	_, err := store.Exec(ctx, putSlidingSyncPositionQuery, userID, store.DeviceID, connID, pos.Pos, pos.ToDeviceSince)
+	return err
+}
+
+func (store *SQLSyncStore) LoadSlidingSyncPosition(ctx context.Context, userID id.UserID, connID string) (*mautrix.SlidingSyncPosition, error) {
+	var pos mautrix.SlidingSyncPosition
+	err := store.QueryRow(ctx, getSlidingSyncPositionQuery, userID, store.DeviceID, connID).Scan(&pos.Pos, &pos.ToDeviceSince)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &pos, nil
+}
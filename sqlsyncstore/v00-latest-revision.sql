@@ -0,0 +1,21 @@
+-- v0 -> v1: Latest revision
+
+CREATE TABLE mx_sync_store (
+	user_id     TEXT NOT NULL,
+	device_id   TEXT NOT NULL,
+	filter_id   TEXT NOT NULL DEFAULT '',
+	filter_hash TEXT NOT NULL DEFAULT '',
+	next_batch  TEXT NOT NULL DEFAULT '',
+
+	PRIMARY KEY (user_id, device_id)
+);
+
+CREATE TABLE mx_sliding_sync_position (
+	user_id         TEXT NOT NULL,
+	device_id       TEXT NOT NULL,
+	conn_id         TEXT NOT NULL,
+	pos             TEXT NOT NULL,
+	to_device_since TEXT NOT NULL DEFAULT '',
+
+	PRIMARY KEY (user_id, device_id, conn_id)
+);
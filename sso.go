@@ -0,0 +1,164 @@
+package mautrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"go.mau.fi/util/random"
+)
+
+var ErrLoopbackCallbackInvalid = errors.New("invalid loopback callback request")
+
+// DefaultLoopbackSuccessHTML is the page shown in the browser after the loopback callback is received.
+const DefaultLoopbackSuccessHTML = `<!DOCTYPE html>
+<html><head><title>Login successful</title></head>
+<body><p>Login successful. You can close this window now.</p></body></html>`
+
+// LoopbackParams contains the parameters for the local HTTP listener that receives
+// the browser redirect at the end of an SSO or OAuth login.
+type LoopbackParams struct {
+	// ListenAddress is the address to listen on. Defaults to 127.0.0.1 with a random port.
+	ListenAddress string
+	// SuccessHTML is the page shown in the browser after the redirect. Defaults to DefaultLoopbackSuccessHTML.
+	SuccessHTML string
+	// OpenURL is called with the URL that the user must open in their browser,
+	// e.g. by launching a browser or printing the URL. Required.
+	OpenURL func(ctx context.Context, url string) error
+}
+
+type loopbackCallback struct {
+	URL string
+
+	params *LoopbackParams
+	state  string
+	server *http.Server
+	result chan url.Values
+}
+
+const loopbackCallbackPath = "/callback"
+
+// startLoopbackCallback starts a local HTTP server that waits for a single redirect with the given state.
+// If stateParam is empty, the state is included in the callback URL path instead.
+func startLoopbackCallback(params *LoopbackParams, stateParam string) (*loopbackCallback, error) {
+	if params == nil || params.OpenURL == nil {
+		return nil, errors.New("OpenURL must be set for loopback logins")
+	}
+	addr := params.ListenAddress
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start loopback listener: %w", err)
+	}
+	lc := &loopbackCallback{
+		params: params,
+		state:  random.String(32),
+		result: make(chan url.Values, 1),
+	}
+	callbackURL := url.URL{Scheme: "http", Host: listener.Addr().String(), Path: loopbackCallbackPath}
+	mux := http.NewServeMux()
+	if stateParam == "" {
+		callbackURL.Path += "/" + lc.state
+		mux.HandleFunc(callbackURL.Path, lc.handle(func(r *http.Request) bool { return true }))
+	} else {
+		mux.HandleFunc(callbackURL.Path, lc.handle(func(r *http.Request) bool {
+			return r.URL.Query().Get(stateParam) == lc.state
+		}))
+	}
+	lc.URL = callbackURL.String()
+	lc.server = &http.Server{Handler: mux}
+	go func() {
+		_ = lc.server.Serve(listener)
+	}()
+	return lc, nil
+}
+
+func (lc *loopbackCallback) handle(checkState func(r *http.Request) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || !checkState(r) {
+			http.Error(w, ErrLoopbackCallbackInvalid.Error(), http.StatusBadRequest)
+			return
+		}
+		successHTML := lc.params.SuccessHTML
+		if successHTML == "" {
+			successHTML = DefaultLoopbackSuccessHTML
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(successHTML))
+		select {
+		case lc.result <- r.URL.Query():
+		default:
+		}
+	}
+}
+
+// Wait opens the given URL with the OpenURL callback and waits for the redirect.
+func (lc *loopbackCallback) Wait(ctx context.Context, openURL string) (url.Values, error) {
+	defer lc.server.Close()
+	err := lc.params.OpenURL(ctx, openURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open login URL: %w", err)
+	}
+	select {
+	case query := <-lc.result:
+		return query, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// SSORedirectURL returns the URL that the user should open in their browser to start an SSO login.
+// If idpID is empty, the homeserver will let the user choose the identity provider.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv3loginssoredirect
+func (cli *Client) SSORedirectURL(idpID, redirectURL string) string {
+	urlPath := ClientURLPath{"v3", "login", "sso", "redirect"}
+	if idpID != "" {
+		urlPath = append(urlPath, idpID)
+	}
+	return cli.BuildURLWithQuery(urlPath, map[string]string{"redirectUrl": redirectURL})
+}
+
+// SSOLoginParams contains the parameters for LoginSSO.
+type SSOLoginParams struct {
+	LoopbackParams
+	// IdentityProviderID is the ID of the identity provider to use (from the identity_providers
+	// field of the m.login.sso flow). If empty, the homeserver will let the user choose.
+	IdentityProviderID string
+	// Login is used as the base of the m.login.token login request, e.g. to set the device ID,
+	// refresh token support or StoreCredentials. The Type and Token fields are overwritten.
+	Login ReqLogin
+}
+
+// LoginSSO completes an SSO login: it starts a local HTTP listener, asks the user to open the SSO
+// redirect URL, waits for the homeserver to redirect back with a login token and exchanges the
+// token for an access token.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#client-login-via-sso
+func (cli *Client) LoginSSO(ctx context.Context, params *SSOLoginParams) (*RespLogin, error) {
+	if params == nil {
+		params = &SSOLoginParams{}
+	}
+	callback, err := startLoopbackCallback(&params.LoopbackParams, "")
+	if err != nil {
+		return nil, err
+	}
+	query, err := callback.Wait(ctx, cli.SSORedirectURL(params.IdentityProviderID, callback.URL))
+	if err != nil {
+		return nil, err
+	}
+	loginToken := query.Get("loginToken")
+	if loginToken == "" {
+		return nil, fmt.Errorf("%w: missing loginToken", ErrLoopbackCallbackInvalid)
+	}
+	loginReq := params.Login
+	loginReq.Type = AuthTypeToken
+	loginReq.Token = loginToken
+	return cli.Login(ctx, &loginReq)
+}
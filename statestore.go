@@ -10,6 +10,7 @@ import (
 	"context"
 	"maps"
 	"sync"
+	"time"
 
 	"github.com/rs/zerolog"
 	"go.mau.fi/util/exerrors"
@@ -44,6 +45,32 @@ type StateStore interface {
 	GetRoomJoinedOrInvitedMembers(ctx context.Context, roomID id.RoomID) ([]id.UserID, error)
 }
 
+// CachedProfile is a global user profile cached in a [ProfileStateStore].
+type CachedProfile struct {
+	Profile   *event.MemberEventContent `json:"profile"`
+	FetchedAt time.Time                 `json:"fetched_at"`
+}
+
+// ProfileStateStore is an optional extension of StateStore for caching global
+// user profiles, which are used by [ProfileFetcher].
+type ProfileStateStore interface {
+	// GetCachedProfile returns the cached profile of the given user, or nil if
+	// the profile hasn't been cached.
+	GetCachedProfile(ctx context.Context, userID id.UserID) (*CachedProfile, error)
+	// SetCachedProfile caches the given profile with the current time.
+	SetCachedProfile(ctx context.Context, userID id.UserID, profile *event.MemberEventContent) error
+}
+
+// RoomStateMover is an optional extension of StateStore for moving the cached
+// state of a room to another room, e.g. after the room is upgraded.
+type RoomStateMover interface {
+	// MoveRoomState moves the cached members, power levels and encryption info
+	// of the old room to the new room. Bans are kept as-is, but other members
+	// are moved with the leave membership, as they have to join the new room
+	// separately. State that is already cached for the new room is kept.
+	MoveRoomState(ctx context.Context, oldRoomID, newRoomID id.RoomID) error
+}
+
 type StateStoreUpdater interface {
 	UpdateState(ctx context.Context, evt *event.Event)
 }
@@ -101,11 +128,13 @@ type MemoryStateStore struct {
 	MembersFetched map[id.RoomID]bool                                    `json:"members_fetched"`
 	PowerLevels    map[id.RoomID]*event.PowerLevelsEventContent          `json:"power_levels"`
 	Encryption     map[id.RoomID]*event.EncryptionEventContent           `json:"encryption"`
+	GlobalProfiles map[id.UserID]*CachedProfile                          `json:"global_profiles"`
 
 	registrationsLock sync.RWMutex
 	membersLock       sync.RWMutex
 	powerLevelsLock   sync.RWMutex
 	encryptionLock    sync.RWMutex
+	profilesLock      sync.RWMutex
 }
 
 func NewMemoryStateStore() StateStore {
@@ -115,6 +144,7 @@ func NewMemoryStateStore() StateStore {
 		MembersFetched: make(map[id.RoomID]bool),
 		PowerLevels:    make(map[id.RoomID]*event.PowerLevelsEventContent),
 		Encryption:     make(map[id.RoomID]*event.EncryptionEventContent),
+		GlobalProfiles: make(map[id.UserID]*CachedProfile),
 	}
 }
 
@@ -342,3 +372,62 @@ func (store *MemoryStateStore) FindSharedRooms(ctx context.Context, userID id.Us
 	}
 	return rooms, nil
 }
+
+func (store *MemoryStateStore) GetCachedProfile(_ context.Context, userID id.UserID) (*CachedProfile, error) {
+	store.profilesLock.RLock()
+	defer store.profilesLock.RUnlock()
+	return store.GlobalProfiles[userID], nil
+}
+
+func (store *MemoryStateStore) SetCachedProfile(_ context.Context, userID id.UserID, profile *event.MemberEventContent) error {
+	store.profilesLock.Lock()
+	defer store.profilesLock.Unlock()
+	if store.GlobalProfiles == nil {
+		store.GlobalProfiles = make(map[id.UserID]*CachedProfile)
+	}
+	store.GlobalProfiles[userID] = &CachedProfile{Profile: profile, FetchedAt: time.Now()}
+	return nil
+}
+
+func (store *MemoryStateStore) MoveRoomState(_ context.Context, oldRoomID, newRoomID id.RoomID) error {
+	store.membersLock.Lock()
+	if oldMembers, ok := store.Members[oldRoomID]; ok {
+		newMembers, ok := store.Members[newRoomID]
+		if !ok {
+			newMembers = make(map[id.UserID]*event.MemberEventContent, len(oldMembers))
+			store.Members[newRoomID] = newMembers
+		}
+		for userID, member := range oldMembers {
+			if _, alreadyExists := newMembers[userID]; alreadyExists {
+				continue
+			}
+			movedMember := *member
+			if movedMember.Membership != event.MembershipBan {
+				movedMember.Membership = event.MembershipLeave
+			}
+			newMembers[userID] = &movedMember
+		}
+		delete(store.Members, oldRoomID)
+		delete(store.MembersFetched, oldRoomID)
+	}
+	store.membersLock.Unlock()
+
+	store.powerLevelsLock.Lock()
+	if levels, ok := store.PowerLevels[oldRoomID]; ok {
+		if _, alreadyExists := store.PowerLevels[newRoomID]; !alreadyExists {
+			store.PowerLevels[newRoomID] = levels
+		}
+		delete(store.PowerLevels, oldRoomID)
+	}
+	store.powerLevelsLock.Unlock()
+
+	store.encryptionLock.Lock()
+	if encryption, ok := store.Encryption[oldRoomID]; ok {
+		if _, alreadyExists := store.Encryption[newRoomID]; !alreadyExists {
+			store.Encryption[newRoomID] = encryption
+		}
+		delete(store.Encryption, oldRoomID)
+	}
+	store.encryptionLock.Unlock()
+	return nil
+}
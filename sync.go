@@ -50,6 +50,8 @@ type DispatchableSyncer interface {
 type DefaultSyncer struct {
 	// syncListeners want the whole sync response, e.g. the crypto machine
 	syncListeners []SyncHandler
+	// slidingSyncListeners want the raw sliding sync response
+	slidingSyncListeners []SlidingSyncHandler
 	// globalListeners want all events
 	globalListeners []EventHandler
 	// listeners want a specific event type
@@ -65,6 +67,7 @@ type DefaultSyncer struct {
 
 var _ Syncer = (*DefaultSyncer)(nil)
 var _ ExtensibleSyncer = (*DefaultSyncer)(nil)
+var _ SlidingSyncListener = (*DefaultSyncer)(nil)
 
 // NewDefaultSyncer returns an instantiated DefaultSyncer
 func NewDefaultSyncer() *DefaultSyncer {
@@ -73,15 +76,17 @@ func NewDefaultSyncer() *DefaultSyncer {
 		syncListeners:     []SyncHandler{},
 		globalListeners:   []EventHandler{},
 		ParseEventContent: true,
-		ParseErrorHandler: func(evt *event.Event, err error) bool {
-			// By default, drop known events that can't be parsed, but let unknown events through
-			return errors.Is(err, event.ErrUnsupportedContentType) ||
-				// Also allow events that had their content already parsed by some other function
-				errors.Is(err, event.ErrContentAlreadyParsed)
-		},
+		ParseErrorHandler: defaultParseErrorHandler,
 	}
 }
 
+func defaultParseErrorHandler(evt *event.Event, err error) bool {
+	// By default, drop known events that can't be parsed, but let unknown events through
+	return errors.Is(err, event.ErrUnsupportedContentType) ||
+		// Also allow events that had their content already parsed by some other function
+		errors.Is(err, event.ErrContentAlreadyParsed)
+}
+
 // ProcessResponse processes the /sync response in a way suitable for bots. "Suitable for bots" means a stream of
 // unrepeating events. Returns a fatal error if a listener panics.
 func (s *DefaultSyncer) ProcessResponse(ctx context.Context, res *RespSync, since string) (err error) {
@@ -114,6 +119,9 @@ func (s *DefaultSyncer) ProcessResponse(ctx context.Context, res *RespSync, sinc
 		s.processSyncEvents(ctx, roomID, roomData.State.Events, event.SourceLeave|event.SourceState)
 		s.processSyncEvents(ctx, roomID, roomData.Timeline.Events, event.SourceLeave|event.SourceTimeline)
 	}
+	for roomID, roomData := range res.Rooms.Knock {
+		s.processSyncEvents(ctx, roomID, roomData.State.Events, event.SourceKnock|event.SourceState)
+	}
 	return
 }
 
@@ -178,6 +186,22 @@ func (s *DefaultSyncer) OnSync(callback SyncHandler) {
 	s.syncListeners = append(s.syncListeners, callback)
 }
 
+// OnSlidingSync registers a handler for raw sliding sync responses. The handlers are called before
+// the response is converted and passed to ProcessResponse.
+func (s *DefaultSyncer) OnSlidingSync(callback SlidingSyncHandler) {
+	s.slidingSyncListeners = append(s.slidingSyncListeners, callback)
+}
+
+// ProcessSlidingSyncResponse calls the handlers registered with OnSlidingSync.
+func (s *DefaultSyncer) ProcessSlidingSyncResponse(ctx context.Context, resp *RespSlidingSync, since string) bool {
+	for _, listener := range s.slidingSyncListeners {
+		if !listener(ctx, resp, since) {
+			return false
+		}
+	}
+	return true
+}
+
 func (s *DefaultSyncer) OnEvent(callback EventHandler) {
 	s.globalListeners = append(s.globalListeners, callback)
 }
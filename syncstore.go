@@ -2,6 +2,9 @@ package mautrix
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 
@@ -26,16 +29,55 @@ type SyncStore interface {
 // Deprecated: renamed to SyncStore
 type Storer = SyncStore
 
+// FilterHashSyncStore is an optional interface for SyncStores that store a hash of the filter JSON together
+// with the filter ID. If the hash of the syncer's current filter doesn't match the stored hash, the client
+// uploads the filter again instead of reusing the old filter ID.
+type FilterHashSyncStore interface {
+	SaveFilterIDWithHash(ctx context.Context, userID id.UserID, filterID, filterHash string) error
+	LoadFilterIDWithHash(ctx context.Context, userID id.UserID) (filterID, filterHash string, err error)
+}
+
+// HashFilter returns the hash of the given filter that is stored by FilterHashSyncStores.
+func HashFilter(filter *Filter) (string, error) {
+	data, err := json.Marshal(filter)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// SlidingSyncPosition is the state of a sliding sync connection that is needed to resume it.
+type SlidingSyncPosition struct {
+	Pos           string `json:"pos"`
+	ToDeviceSince string `json:"to_device_since,omitempty"`
+}
+
+// SlidingSyncStore is an optional interface for SyncStores that can persist sliding sync positions.
+// If the store doesn't implement it, sliding sync starts from scratch after every restart.
+type SlidingSyncStore interface {
+	SaveSlidingSyncPosition(ctx context.Context, userID id.UserID, connID string, pos *SlidingSyncPosition) error
+	LoadSlidingSyncPosition(ctx context.Context, userID id.UserID, connID string) (*SlidingSyncPosition, error)
+}
+
 // MemorySyncStore implements the Storer interface.
 //
 // Everything is persisted in-memory as maps. It is not safe to load/save filter IDs
 // or next batch tokens on any goroutine other than the syncing goroutine: the one
 // which called Client.Sync().
 type MemorySyncStore struct {
-	Filters   map[id.UserID]string
-	NextBatch map[id.UserID]string
+	Filters        map[id.UserID]string
+	NextBatch      map[id.UserID]string
+	SlidingSyncPos map[slidingSyncConnKey]SlidingSyncPosition
 }
 
+type slidingSyncConnKey struct {
+	userID id.UserID
+	connID string
+}
+
+var _ SlidingSyncStore = (*MemorySyncStore)(nil)
+
 // SaveFilterID to memory.
 func (s *MemorySyncStore) SaveFilterID(ctx context.Context, userID id.UserID, filterID string) error {
 	s.Filters[userID] = filterID
@@ -58,11 +100,30 @@ func (s *MemorySyncStore) LoadNextBatch(ctx context.Context, userID id.UserID) (
 	return s.NextBatch[userID], nil
 }
 
+// SaveSlidingSyncPosition to memory.
+func (s *MemorySyncStore) SaveSlidingSyncPosition(ctx context.Context, userID id.UserID, connID string, pos *SlidingSyncPosition) error {
+	if s.SlidingSyncPos == nil {
+		s.SlidingSyncPos = make(map[slidingSyncConnKey]SlidingSyncPosition)
+	}
+	s.SlidingSyncPos[slidingSyncConnKey{userID, connID}] = *pos
+	return nil
+}
+
+// LoadSlidingSyncPosition from memory.
+func (s *MemorySyncStore) LoadSlidingSyncPosition(ctx context.Context, userID id.UserID, connID string) (*SlidingSyncPosition, error) {
+	pos, ok := s.SlidingSyncPos[slidingSyncConnKey{userID, connID}]
+	if !ok {
+		return nil, nil
+	}
+	return &pos, nil
+}
+
 // NewMemorySyncStore constructs a new MemorySyncStore.
 func NewMemorySyncStore() *MemorySyncStore {
 	return &MemorySyncStore{
-		Filters:   make(map[id.UserID]string),
-		NextBatch: make(map[id.UserID]string),
+		Filters:        make(map[id.UserID]string),
+		NextBatch:      make(map[id.UserID]string),
+		SlidingSyncPos: make(map[slidingSyncConnKey]SlidingSyncPosition),
 	}
 }
 
@@ -0,0 +1,182 @@
+package mautrix
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/rs/zerolog"
+
+	"github.com/De-IM/mautrix/event"
+	"github.com/De-IM/mautrix/id"
+)
+
+// MaxTombstoneChainLength is the maximum number of room upgrades that
+// [Client.FollowTombstones] follows.
+const MaxTombstoneChainLength = 32
+
+var (
+	ErrTombstoneLoop    = errors.New("room upgrade chain contains a loop")
+	ErrInvalidTombstone = errors.New("replacement room doesn't have the tombstoned room as its predecessor")
+)
+
+// FollowTombstonesParams contains the options for [Client.FollowTombstones].
+type FollowTombstonesParams struct {
+	// Join the successor rooms. Rooms in the middle of the chain are only
+	// joined if their tombstones can't be read otherwise.
+	Join bool
+	// MoveStateStore moves the cached state of each room in the chain to its
+	// successor in the client's state store, which must implement
+	// [RoomStateMover]. This is mostly useful for appservices that keep
+	// using the state store after a room is upgraded.
+	MoveStateStore bool
+}
+
+// FollowTombstones resolves the given room ID to the newest room in its
+// upgrade chain by following m.room.tombstone events. If the room hasn't been
+// upgraded, the same room ID is returned.
+//
+// A successor is only followed if the predecessor in its m.room.create event
+// points back to the tombstoned room. If the create event of a successor
+// can't be read because the user isn't in the room, the successor is joined
+// first if Join is set (and left again if the verification fails). Otherwise,
+// the last verified room is returned.
+func (cli *Client) FollowTombstones(ctx context.Context, roomID id.RoomID, params *FollowTombstonesParams) (id.RoomID, error) {
+	if params == nil {
+		params = &FollowTombstonesParams{}
+	}
+	var mover RoomStateMover
+	if params.MoveStateStore {
+		var ok bool
+		mover, ok = cli.StateStore.(RoomStateMover)
+		if !ok {
+			return roomID, fmt.Errorf("state store doesn't support moving room state")
+		}
+	}
+	log := zerolog.Ctx(ctx).With().Stringer("original_room_id", roomID).Logger()
+	visited := map[id.RoomID]struct{}{roomID: {}}
+	current := roomID
+	// currentServer is the server of the user who sent the tombstone pointing at the current room
+	var currentServer string
+	joined := false
+	for {
+		successor, sender, err := cli.getTombstone(ctx, current)
+		if errors.Is(err, MForbidden) && current != roomID && !joined {
+			if !params.Join {
+				break
+			}
+			err = cli.joinUpgradedRoom(ctx, current, currentServer)
+			if err != nil {
+				return current, err
+			}
+			joined = true
+			successor, sender, err = cli.getTombstone(ctx, current)
+		}
+		if err != nil {
+			return current, fmt.Errorf("failed to get tombstone of %s: %w", current, err)
+		} else if successor == "" {
+			break
+		} else if _, alreadyVisited := visited[successor]; alreadyVisited {
+			return current, fmt.Errorf("%w at %s", ErrTombstoneLoop, successor)
+		} else if len(visited) > MaxTombstoneChainLength {
+			return current, fmt.Errorf("room upgrade chain is longer than %d rooms", MaxTombstoneChainLength)
+		}
+		successorServer := sender.Homeserver()
+		joinedSuccessor := false
+		err = cli.verifyPredecessor(ctx, successor, current)
+		if errors.Is(err, MForbidden) {
+			if !params.Join {
+				break
+			}
+			err = cli.joinUpgradedRoom(ctx, successor, successorServer)
+			if err != nil {
+				return current, err
+			}
+			joinedSuccessor = true
+			err = cli.verifyPredecessor(ctx, successor, current)
+			if errors.Is(err, ErrInvalidTombstone) {
+				if _, leaveErr := cli.LeaveRoom(ctx, successor); leaveErr != nil {
+					log.Warn().Err(leaveErr).Stringer("room_id", successor).Msg("Failed to leave invalid replacement room")
+				}
+			}
+		}
+		if err != nil {
+			return current, fmt.Errorf("failed to verify replacement room %s of %s: %w", successor, current, err)
+		}
+		log.Debug().
+			Stringer("room_id", current).
+			Stringer("replacement_room_id", successor).
+			Msg("Following room tombstone")
+		visited[successor] = struct{}{}
+		if mover != nil {
+			err = mover.MoveRoomState(ctx, current, successor)
+			if err != nil {
+				return current, fmt.Errorf("failed to move state of %s to %s: %w", current, successor, err)
+			}
+		}
+		current = successor
+		currentServer = successorServer
+		joined = joinedSuccessor
+	}
+	if params.Join && current != roomID && !joined {
+		err := cli.joinUpgradedRoom(ctx, current, currentServer)
+		if err != nil {
+			return current, err
+		}
+	}
+	return current, nil
+}
+
+// getTombstone returns the replacement room and the sender of the tombstone in the given room.
+func (cli *Client) getTombstone(ctx context.Context, roomID id.RoomID) (id.RoomID, id.UserID, error) {
+	var raw json.RawMessage
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "rooms", roomID, "state", event.StateTombstone.String(), ""}, map[string]string{
+		"format": "event",
+	})
+	_, err := cli.MakeRequest(ctx, http.MethodGet, urlPath, nil, &raw)
+	if errors.Is(err, MNotFound) {
+		return "", "", nil
+	} else if err != nil {
+		return "", "", err
+	}
+	var evt struct {
+		Sender  id.UserID                    `json:"sender"`
+		Content *event.TombstoneEventContent `json:"content"`
+	}
+	if err = json.Unmarshal(raw, &evt); err != nil {
+		return "", "", fmt.Errorf("failed to parse tombstone: %w", err)
+	} else if evt.Content == nil {
+		// The server doesn't support format=event and returned only the content
+		evt.Content = &event.TombstoneEventContent{}
+		if err = json.Unmarshal(raw, evt.Content); err != nil {
+			return "", "", fmt.Errorf("failed to parse tombstone: %w", err)
+		}
+	}
+	return evt.Content.ReplacementRoom, evt.Sender, nil
+}
+
+// verifyPredecessor checks that the m.room.create event of the given room has the expected predecessor.
+func (cli *Client) verifyPredecessor(ctx context.Context, roomID, expectedPredecessor id.RoomID) error {
+	var content event.CreateEventContent
+	err := cli.StateEvent(ctx, roomID, event.StateCreate, "", &content)
+	if err != nil {
+		return err
+	} else if content.Predecessor == nil || content.Predecessor.RoomID != expectedPredecessor {
+		return ErrInvalidTombstone
+	}
+	return nil
+}
+
+func (cli *Client) joinUpgradedRoom(ctx context.Context, roomID id.RoomID, serverName string) error {
+	if cli.StateStore != nil && cli.StateStore.IsInRoom(ctx, roomID, cli.UserID) {
+		return nil
+	}
+	// The server of the user who upgraded the room is most likely in the new room
+	_, err := cli.JoinRoom(ctx, string(roomID), serverName, nil)
+	if err != nil {
+		return fmt.Errorf("failed to join upgraded room %s: %w", roomID, err)
+	}
+	return nil
+}
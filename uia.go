@@ -0,0 +1,218 @@
+package mautrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/De-IM/mautrix/id"
+)
+
+var ErrNoSupportedUIAFlow = errors.New("no supported user-interactive auth flow")
+
+// UIAStageHandler completes a single stage of a user-interactive auth flow. It receives the
+// session ID and the stage parameters from the server (which may be nil) and returns the auth
+// data to submit. The Type and Session fields of the auth data must be filled by the handler.
+type UIAStageHandler func(ctx context.Context, session string, params interface{}) (interface{}, error)
+
+// UIAFallbackHandler completes a stage using the fallback web page of the homeserver,
+// e.g. by showing the URL to the user and waiting for them to finish. It should return
+// once the stage is done on the server side.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#fallback
+type UIAFallbackHandler func(ctx context.Context, stage AuthType, fallbackURL string) error
+
+// UIAuthenticator drives user-interactive auth flows with pluggable stage handlers.
+// Use Callback to get a UIACallback that can be passed to any method that supports UIA.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#user-interactive-authentication-api
+type UIAuthenticator struct {
+	Client *Client
+	// Stages contains the handlers for each supported stage type.
+	Stages map[AuthType]UIAStageHandler
+	// Fallback is used for stages that don't have a handler. If nil, flows
+	// with unsupported stages are not used.
+	Fallback UIAFallbackHandler
+}
+
+// NewUIAuthenticator creates a new UI auth flow engine. The m.login.dummy stage is supported by default.
+func NewUIAuthenticator(cli *Client) *UIAuthenticator {
+	return &UIAuthenticator{
+		Client: cli,
+		Stages: map[AuthType]UIAStageHandler{
+			AuthTypeDummy: UIADummyStage(),
+		},
+	}
+}
+
+// WithStage sets the handler for the given stage type and returns the authenticator for chaining.
+func (ua *UIAuthenticator) WithStage(stage AuthType, handler UIAStageHandler) *UIAuthenticator {
+	if ua.Stages == nil {
+		ua.Stages = make(map[AuthType]UIAStageHandler)
+	}
+	ua.Stages[stage] = handler
+	return ua
+}
+
+func (ua *UIAuthenticator) isSupported(stage AuthType) (supported, needsFallback bool) {
+	if _, ok := ua.Stages[stage]; ok {
+		return true, false
+	}
+	return ua.Fallback != nil, true
+}
+
+func isCompletedPrefix(flow UIAFlow, completed []string) bool {
+	if len(completed) > len(flow.Stages) {
+		return false
+	}
+	for i, stage := range completed {
+		if flow.Stages[i] != AuthType(stage) {
+			return false
+		}
+	}
+	return true
+}
+
+// NextStage picks the flow to continue with and returns the next stage in it.
+//
+// Only flows that start with the already completed stages and whose remaining stages are all
+// supported are considered. Flows that don't need the fallback are preferred, then shorter flows.
+func (ua *UIAuthenticator) NextStage(uia *RespUserInteractive) (AuthType, error) {
+	var best []AuthType
+	bestFallbacks := -1
+	for _, flow := range uia.Flows {
+		if !isCompletedPrefix(flow, uia.Completed) {
+			continue
+		}
+		remaining := flow.Stages[len(uia.Completed):]
+		if len(remaining) == 0 {
+			continue
+		}
+		fallbacks := 0
+		supported := true
+		for _, stage := range remaining {
+			isSupported, needsFallback := ua.isSupported(stage)
+			if !isSupported {
+				supported = false
+				break
+			} else if needsFallback {
+				fallbacks++
+			}
+		}
+		if !supported {
+			continue
+		}
+		if bestFallbacks == -1 || fallbacks < bestFallbacks || (fallbacks == bestFallbacks && len(remaining) < len(best)) {
+			best = remaining
+			bestFallbacks = fallbacks
+		}
+	}
+	if best == nil {
+		return "", ErrNoSupportedUIAFlow
+	}
+	return best[0], nil
+}
+
+// FallbackURL returns the URL of the fallback web page for the given stage and session.
+func (ua *UIAuthenticator) FallbackURL(stage AuthType, session string) string {
+	return ua.Client.BuildURLWithQuery(ClientURLPath{"v3", "auth", stage, "fallback", "web"}, map[string]string{
+		"session": session,
+	})
+}
+
+// Handle completes the next stage of the given UIA response and returns the auth data to submit.
+func (ua *UIAuthenticator) Handle(ctx context.Context, uia *RespUserInteractive) (interface{}, error) {
+	stage, err := ua.NextStage(uia)
+	if err != nil {
+		return nil, err
+	}
+	handler, ok := ua.Stages[stage]
+	if !ok {
+		err = ua.Fallback(ctx, stage, ua.FallbackURL(stage, uia.Session))
+		if err != nil {
+			return nil, fmt.Errorf("failed to complete %s stage with fallback: %w", stage, err)
+		}
+		// After the fallback is completed, the request is retried with only the session ID
+		return map[string]string{"session": uia.Session}, nil
+	}
+	auth, err := handler(ctx, uia.Session, uia.Params[stage])
+	if err != nil {
+		return nil, fmt.Errorf("failed to complete %s stage: %w", stage, err)
+	}
+	return auth, nil
+}
+
+// Callback returns a UIACallback that completes stages with Handle.
+// If handling a stage fails, the error is returned from the request method.
+func (ua *UIAuthenticator) Callback(ctx context.Context) UIACallback {
+	return func(uia *RespUserInteractive) interface{} {
+		auth, err := ua.Handle(ctx, uia)
+		if err != nil {
+			return err
+		}
+		return auth
+	}
+}
+
+// UIADummyStage returns a handler for the m.login.dummy stage.
+func UIADummyStage() UIAStageHandler {
+	return func(ctx context.Context, session string, params interface{}) (interface{}, error) {
+		return &BaseAuthData{Type: AuthTypeDummy, Session: session}, nil
+	}
+}
+
+// UIAPasswordStage returns a handler for the m.login.password stage that authenticates as the given user.
+func UIAPasswordStage(userID id.UserID, password string) UIAStageHandler {
+	return func(ctx context.Context, session string, params interface{}) (interface{}, error) {
+		return &ReqUIAuthPassword{
+			BaseAuthData: BaseAuthData{Type: AuthTypePassword, Session: session},
+			Identifier:   UserIdentifier{Type: IdentifierTypeUser, User: string(userID)},
+			Password:     password,
+		}, nil
+	}
+}
+
+// UIARecaptchaStage returns a handler for the m.login.recaptcha stage. The solve function
+// receives the public key from the stage params and must return the reCAPTCHA response.
+func UIARecaptchaStage(solve func(ctx context.Context, publicKey string) (string, error)) UIAStageHandler {
+	return func(ctx context.Context, session string, params interface{}) (interface{}, error) {
+		var publicKey string
+		if paramMap, ok := params.(map[string]interface{}); ok {
+			publicKey, _ = paramMap["public_key"].(string)
+		}
+		response, err := solve(ctx, publicKey)
+		if err != nil {
+			return nil, err
+		}
+		return &ReqUIAuthRecaptcha{
+			BaseAuthData: BaseAuthData{Type: AuthTypeReCAPTCHA, Session: session},
+			Response:     response,
+		}, nil
+	}
+}
+
+// UIAEmailIdentityStage returns a handler for the m.login.email.identity stage. The getCreds
+// function must return the credentials of a validated email session, e.g. one created with
+// RequestEmailToken after the user has clicked the link in the email.
+func UIAEmailIdentityStage(getCreds func(ctx context.Context) (*ThreePIDCredentials, error)) UIAStageHandler {
+	return func(ctx context.Context, session string, params interface{}) (interface{}, error) {
+		creds, err := getCreds(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &ReqUIAuthThreePID{
+			BaseAuthData:  BaseAuthData{Type: AuthTypeEmail, Session: session},
+			ThreePIDCreds: *creds,
+		}, nil
+	}
+}
+
+// UIARegistrationTokenStage returns a handler for the m.login.registration_token stage.
+func UIARegistrationTokenStage(token string) UIAStageHandler {
+	return func(ctx context.Context, session string, params interface{}) (interface{}, error) {
+		return &ReqUIAuthRegistrationToken{
+			BaseAuthData: BaseAuthData{Type: AuthTypeRegistrationToken, Session: session},
+			Token:        token,
+		}, nil
+	}
+}